@@ -27,8 +27,8 @@ let
       # Too slow for me to want to run it on every commit. Not defined
       # precisely.
       "slow"
-      # I've seen it fail and I didn't think it was my fault.
-      "flaky"
+      # Note "flaky" (I've seen it fail and I didn't think it was my fault)
+      # isn't here, tests with that tag get retried instead, see installPhase.
     ];
     # parse-kselftest-list will generate the actual list of kselftests, but also
     # here we add tags and stuff for the ones we know about. This gets merged into
@@ -36,28 +36,26 @@ let
     # Note that the ksefltests package doesn't build all the tests (see
     # TARGETS=).
     kselftests = {
-      # Note this is also affected by the bug with .sh being in the name.
       mm = {
         # TODO: This fails because mkstemp()/unlink() run into a read-only
         # filesystem.
-        ksft_gup_test_sh.tags = [ "lk-broken" ];
+        "ksft_gup_test.sh".tags = [ "lk-broken" ];
         # TODO: There is a bug in split_huge_page_test, the ksft_set_plan() call
         # is broken under my configuratoin leading to:
         # Planned tests != run tests (62 != 10)
-        ksft_thp_sh.tags = [ "lk-broken" ];
-        # TODO: This needs CONFIG_TEST_VMALLOC=m in the kernel.
-        ksft_vmalloc_sh.tags = [ "lk-broken" ];
+        "ksft_thp.sh".tags = [ "lk-broken" ];
+        "ksft_vmalloc.sh".requires_kconfig = [ "TEST_VMALLOC=m|y" ];
         # Not sure what's wrong with these ones:
-        ksft_hmm_sh.tags = [ "lk-broken" ];
-        ksft_hugetlb_sh.tags = [ "lk-broken" ];
-        ksft_hugevm_sh.tags = [ "lk-broken" ];
-        ksft_madv_guard_sh.tags = [ "lk-broken" ];
-        ksft_mremap_sh.tags = [ "lk-broken" ];
-        ksft_vma_merge_sh.tags = [ "lk-broken" ];
+        "ksft_hmm.sh".tags = [ "lk-broken" ];
+        "ksft_hugetlb.sh".tags = [ "lk-broken" ];
+        "ksft_hugevm.sh".tags = [ "lk-broken" ];
+        "ksft_madv_guard.sh".tags = [ "lk-broken" ];
+        "ksft_mremap.sh".tags = [ "lk-broken" ];
+        "ksft_vma_merge.sh".tags = [ "lk-broken" ];
         # https://github.com/bjackman/limmat-kernel-nix/actions/runs/23900155339#user-content-tr-BFu3lw-r0s3
-        ksft_userfaultfd_sh = [ "flaky" ];
+        "ksft_userfaultfd.sh".tags = [ "flaky" ];
         # https://github.com/bjackman/limmat-kernel-nix/actions/runs/25218560161/job/73944777420
-        ksft_mkdirty_sh = [ "lk-broken" ];
+        "ksft_mkdirty.sh".tags = [ "lk-broken" ];
       };
       kvm = {
         dirty_log_test.tags = [ "slow" ]; # It's not THAT slow
@@ -74,10 +72,10 @@ let
         xapic_state_test.tags = [ "slow" ];
         # This test runs a guest with 128GiB of RAM, it's not gonna work in our
         # puny little VM.
-        mmu_stress_test.tags = [
-          "slow"
-          "lk-broken"
-        ];
+        mmu_stress_test = {
+          tags = [ "slow" ];
+          requires.min_memory = "128GiB";
+        };
         # Confirmed by seanjc to be flaky
         vmx_preemption_timer_test.tags = [ "flaky" ];
         # Fails with something that looks like a flaky assertion
@@ -97,12 +95,12 @@ let
         # https://github.com/bjackman/limmat-kernel-nix/actions/runs/19393418421/job/55490088190
         # Passed:
         # https://github.com/bjackman/limmat-kernel-nix/actions/runs/19392874394/job/55488849774
-        msrs_test = [ "flaky" ];
+        msrs_test.tags = [ "flaky" ];
         # Failed:
         # https://github.com/bjackman/limmat-kernel-nix/actions/runs/19392874394/job/55488849774
         # Passed:
         # https://github.com/bjackman/limmat-kernel-nix/actions/runs/19393418421/job/55490088190
-        nx_huge_pages_test_sh.tags = [ "flaky" ];
+        "nx_huge_pages_test.sh".tags = [ "flaky" ];
         vmx_apic_access_test.tags = [ "flaky" ];
         vmx_dirty_log_test.tags = [ "flaky" ];
         # https://github.com/bjackman/limmat-kernel-nix/actions/runs/19412387941
@@ -116,16 +114,22 @@ let
         apic_bus_clock_test.tags = [ "flaky" ];
       };
       x86 = {
-        # It prints SKIP but returns an error.
+        # It prints SKIP but returns an error, not KSFT_SKIP, so the exit
+        # code mapping doesn't help.
         test_shadow_stack_64.tags = [ "lk-broken" ];
         # This one goes into an infinite loop but only in GHA:
         # https://github.com/bjackman/limmat-kernel-nix/actions/runs/20803287757/job/59752430820#step:8:32
-        mov_ss_trap_32 = [ "lk-broken" ];
-        mov_ss_trap_64 = [ "lk-broken" ];
+        mov_ss_trap_32.tags = [ "lk-broken" ];
+        mov_ss_trap_64.tags = [ "lk-broken" ];
         # On 32-bit kernels this fails, even when dmesg reports "NX (Execute
         # Disable) protection: active" (requires PAE). Seems bad but no time to
         # debug it.
-        nx_stack_32 = [ "lk-broken" ];
+        nx_stack_32.tags = [
+          {
+            tag = "lk-broken";
+            when.arch = "i686";
+          }
+        ];
       };
     };
 
@@ -133,15 +137,15 @@ let
     blktests =
       let
         blktestTags = {
+          # See requires_kconfig below.
           throtl = {
-            # Oh. So none of these actually work, scsi_debug has to be a module.
-            "001" = [ "lk-broken" ];
-            "002" = [ "lk-broken" ];
-            "003" = [ "lk-broken" ];
-            "004" = [ "lk-broken" ];
-            "005" = [ "lk-broken" ];
-            "006" = [ "lk-broken" ];
-            "007" = [ "lk-broken" ];
+            "001" = [ ];
+            "002" = [ ];
+            "003" = [ ];
+            "004" = [ ];
+            "005" = [ ];
+            "006" = [ ];
+            "007" = [ ];
           };
           block = {
             # AI says this exercises the block cgroup stuff I wanted to play with
@@ -152,13 +156,14 @@ let
         # logs (otherwise some tests just fail silently). Actually this doesn't
         # run an individual test it runs the same tests multiple times under
         # different configurations so there might be multiple logs :)
-        # Note this will often print duplicate logs.
+        # Note this will often print duplicate logs. The logs also get kept in
+        # the test's artifact dir.
         wrapper = pkgs.writeShellScript "blktests-wrapper.sh" ''
           name="$1"
-          ${blktests}/bin/blktests --output /tmp/blktests "$name"
+          ${blktests}/bin/blktests --output "$TEST_ARTIFACT_DIR" "$name"
           rc="$?"
           if [ "$rc" != 0 ]; then
-            for log in /tmp/blktests/**/"$name"*; do
+            for log in "$TEST_ARTIFACT_DIR"/**/"$name"*; do
               if [ -s "$log" ]; then
                 echo "[ktests wrapper] Something failed, dumping $log"
                 cat $log
@@ -168,33 +173,41 @@ let
           exit "$rc"
         '';
       in
-      lib.mapAttrsRecursive (path: tags: {
-        __is_test = true;
-        inherit tags;
-        command = [
-          wrapper
-          (lib.concatStringsSep "/" path)
-        ];
-      }) blktestTags;
+      lib.recursiveUpdate
+        (lib.mapAttrsRecursive (path: tags: {
+          __is_test = true;
+          inherit tags;
+          command = [ (lib.concatStringsSep "/" path) ];
+        }) blktestTags)
+        {
+          # Every test goes through the wrapper, it's prepended to the command.
+          command_prefix = [ wrapper ];
+          # These all need scsi_debug to be a module.
+          throtl.requires_kconfig = [ "SCSI_DEBUG=m" ];
+        };
   };
 
+  allowStale = lib.optionalString (stdenv.hostPlatform.system != "x86_64-linux") "--allow-stale";
+
   # Convert the tests config to JSON and store in nix store
   testConfigJson =
     runCommand "tests-config.json"
       {
-        nativeBuildInputs = [
-          pkgs.jq
-          test-runner
-        ];
+        nativeBuildInputs = [ test-runner ];
       }
       ''
         test-runner parse-kselftest-list ${kselftests}/bin/kselftest-list.txt > kselftests.json
         # Combine the JSON generated from the Nix above, with the one generated by
-        # parse-kselftest-list, but put the latter under the kselftests key.
-        jq --slurp '{ "kselftests": .[0] } * .[1]' \
+        # parse-kselftest-list, but put the latter under the kselftests key. This
+        # fails if the Nix config annotates kselftests that don't exist (e.g.
+        # because they got renamed upstream). Only x86_64 builds all the
+        # kselftests targets that are annotated, so elsewhere that's just a
+        # warning.
+        test-runner merge-config --base-key kselftests ${allowStale} \
           kselftests.json \
           ${writeText "tests.json" (builtins.toJSON testConfig)} \
           > $out
+        test-runner validate --test-config $out
       '';
 in
 # Create the wrapper that provides the config to test-runner
@@ -212,7 +225,7 @@ stdenv.mkDerivation {
     # The parse-kselftest-list result will generate JSON that expects to find
     # run_kselftest.sh in the PATH.
     makeWrapper ${test-runner}/bin/test-runner $out/bin/ktests \
-      --add-flags "--test-config ${testConfigJson}" \
+      --add-flags "--test-config ${testConfigJson} --retry-tag flaky=3" \
       --prefix PATH : "${kselftests}/bin"
   '';
 
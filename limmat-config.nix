@@ -280,7 +280,7 @@ in
           # With ASI compiled out, not much point in running too many tests,
           # just run the mm ones since that's the stuff the ASI patchs are most
           # likely to break.
-          command = ''${run-ktests}/bin/run-ktests "$LIMMAT_ARTIFACTS_build_ksft" "*" ""'';
+          command = ''${run-ktests}/bin/run-ktests "$LIMMAT_ARTIFACTS_build_ksft" "**" ""'';
         }
         {
           name = "kunit_x86";
@@ -308,7 +308,7 @@ in
           requires_worktree = false;
           # Just want to check boot really, pick some arbitrary test that's quick
           # and reliable.
-          command = ''${run-ktests}/bin/run-ktests "$LIMMAT_ARTIFACTS_build_asi" "*" "asi=off"'';
+          command = ''${run-ktests}/bin/run-ktests "$LIMMAT_ARTIFACTS_build_asi" "**" "asi=off"'';
           run_by_default = false;
         }
         {
@@ -317,7 +317,7 @@ in
           depends_on = [ "build_asi" ]; # Defined by a mkBuild call with name = "asi"
           resources = [ "qemu_throttle" ];
           requires_worktree = false;
-          command = ''${run-ktests}/bin/run-ktests "$LIMMAT_ARTIFACTS_build_asi" "*" "asi=on"'';
+          command = ''${run-ktests}/bin/run-ktests "$LIMMAT_ARTIFACTS_build_asi" "**" "asi=on"'';
           run_by_default = false;
         }
         {
@@ -48,7 +48,7 @@ SHUTDOWN=false
 VSOCK_CID=3
 USE_NIXOS_KERNEL=false
 
-KTESTS_ARGS=("--bail-on-failure" "*")
+KTESTS_ARGS=("--bail-on-failure" "**")
 KTESTS_OUTPUT_HOST=
 
 # Default arch comes from the launcher (TARGET_SYSTEM is baked in per package,
@@ -0,0 +1,239 @@
+// Package compare diffs the results of two runs, to find out what broke (or got
+// fixed) between them.
+package compare
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"os"
+	"sort"
+
+	"test-runner/runner"
+	"test-runner/test_conf"
+)
+
+// Outcome is what a result boils down to for comparison purposes.
+type Outcome string
+
+const (
+	Pass Outcome = "pass"
+	Fail Outcome = "fail"
+	Skip Outcome = "skip"
+)
+
+// Result is a single test's result in one of the runs.
+type Result struct {
+	Outcome Outcome `json:"outcome"`
+	// The more specific status, like "TIMEOUT". For JUnit this is just
+	// "PASS", "FAIL", "ERROR" or "SKIP".
+	Status string `json:"status"`
+}
+
+func outcomeForStatus(status runner.TestStatus) Outcome {
+	switch status {
+	case runner.TestPassed, runner.TestFlaky:
+		return Pass
+	case runner.TestSkipped, runner.TestDropped:
+		return Skip
+	}
+	return Fail
+}
+
+// Load reads the results of a run, either from a JUnit XML report or from a
+// file written with --results-json. The results are keyed by test ID.
+func Load(path string) (map[string]Result, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("<")) {
+		results, err := parseJUnit(data)
+		if err != nil {
+			return nil, fmt.Errorf("parsing JUnit report %s: %w", path, err)
+		}
+		return results, nil
+	}
+	testResults, _, err := runner.ReadResultsJSON(path)
+	if err != nil {
+		return nil, err
+	}
+	results := make(map[string]Result)
+	for _, r := range testResults {
+		results[r.TestID] = Result{Outcome: outcomeForStatus(r.Result), Status: r.Result.Name()}
+	}
+	return results, nil
+}
+
+// Just enough of JUnit to get the results out, this isn't specific to our own
+// reports. Suites can be nested, and the root can be a testsuite or a
+// testsuites element.
+type junitSuite struct {
+	Suites []junitSuite `xml:"testsuite"`
+	Cases  []junitCase  `xml:"testcase"`
+}
+
+type junitCase struct {
+	Name      string    `xml:"name,attr"`
+	ClassName string    `xml:"classname,attr"`
+	Failure   *struct{} `xml:"failure"`
+	Error     *struct{} `xml:"error"`
+	Skipped   *struct{} `xml:"skipped"`
+}
+
+func parseJUnit(data []byte) (map[string]Result, error) {
+	var root junitSuite
+	if err := xml.Unmarshal(data, &root); err != nil {
+		return nil, err
+	}
+	var cases []junitCase
+	var walk func(s *junitSuite)
+	walk = func(s *junitSuite) {
+		cases = append(cases, s.Cases...)
+		for i := range s.Suites {
+			walk(&s.Suites[i])
+		}
+	}
+	walk(&root)
+
+	ids := make(map[string]bool)
+	for _, c := range cases {
+		ids[junitTestID(c)] = true
+	}
+	results := make(map[string]Result)
+	for _, c := range cases {
+		id := junitTestID(c)
+		// Our reports have the KTAP subtests of a test as cases with the
+		// test's ID as their class name. They're not tests themselves.
+		if c.ClassName != id && ids[c.ClassName] {
+			continue
+		}
+		results[id] = junitResult(c)
+	}
+	return results, nil
+}
+
+// junitTestID returns the test ID for a test case. The class name is the ID of
+// the suite, but the name isn't escaped, see test_conf.JoinID.
+func junitTestID(c junitCase) string {
+	name := test_conf.EscapeName(c.Name)
+	if c.ClassName == "" || c.ClassName == name {
+		return name
+	}
+	return c.ClassName + "." + name
+}
+
+func junitResult(c junitCase) Result {
+	switch {
+	case c.Failure != nil:
+		return Result{Outcome: Fail, Status: "FAIL"}
+	case c.Error != nil:
+		return Result{Outcome: Fail, Status: "ERROR"}
+	case c.Skipped != nil:
+		return Result{Outcome: Skip, Status: "SKIP"}
+	}
+	return Result{Outcome: Pass, Status: "PASS"}
+}
+
+// Change is how a test's result differs between the runs.
+type Change string
+
+const (
+	// Failed in the candidate but not in the baseline. These are the
+	// regressions.
+	NewFailure Change = "new_failure"
+	// Failed in the baseline, passed in the candidate.
+	Fixed        Change = "fixed"
+	StillFailing Change = "still_failing"
+	// Ran in the baseline, skipped in the candidate.
+	NewlySkipped Change = "newly_skipped"
+	// Only in the candidate.
+	Added Change = "added"
+	// Only in the baseline.
+	Removed Change = "removed"
+	// Anything else, e.g. passed in both, or skipped in the baseline and
+	// passed in the candidate.
+	Unchanged Change = "unchanged"
+)
+
+// Changes in the order they get reported.
+var Changes = []Change{NewFailure, Fixed, StillFailing, NewlySkipped, Added, Removed, Unchanged}
+
+// Titles for the human-readable output.
+var changeTitles = map[Change]string{
+	NewFailure:   "New failures",
+	Fixed:        "Fixed",
+	StillFailing: "Still failing",
+	NewlySkipped: "Newly skipped",
+	Added:        "Added",
+	Removed:      "Removed",
+	Unchanged:    "Unchanged",
+}
+
+func (c Change) Title() string {
+	return changeTitles[c]
+}
+
+// TestDiff is the comparison for one test. Baseline or Candidate is nil if the
+// test is only in the other run.
+type TestDiff struct {
+	TestID    string  `json:"test_id"`
+	Change    Change  `json:"change"`
+	Baseline  *Result `json:"baseline,omitempty"`
+	Candidate *Result `json:"candidate,omitempty"`
+}
+
+// Compare classifies every test that's in either run. The result is sorted by
+// test ID.
+func Compare(baseline, candidate map[string]Result) []TestDiff {
+	ids := make(map[string]bool)
+	for id := range baseline {
+		ids[id] = true
+	}
+	for id := range candidate {
+		ids[id] = true
+	}
+	var diffs []TestDiff
+	for id := range ids {
+		d := TestDiff{TestID: id}
+		if r, ok := baseline[id]; ok {
+			d.Baseline = &r
+		}
+		if r, ok := candidate[id]; ok {
+			d.Candidate = &r
+		}
+		d.Change = classify(d.Baseline, d.Candidate)
+		diffs = append(diffs, d)
+	}
+	sort.Slice(diffs, func(i, j int) bool { return diffs[i].TestID < diffs[j].TestID })
+	return diffs
+}
+
+func classify(baseline, candidate *Result) Change {
+	switch {
+	case baseline == nil:
+		return Added
+	case candidate == nil:
+		return Removed
+	case candidate.Outcome == Fail && baseline.Outcome == Fail:
+		return StillFailing
+	case candidate.Outcome == Fail:
+		return NewFailure
+	case baseline.Outcome == Fail && candidate.Outcome == Pass:
+		return Fixed
+	case baseline.Outcome != Skip && candidate.Outcome == Skip:
+		return NewlySkipped
+	}
+	return Unchanged
+}
+
+// Regressions returns how many tests are NewFailure.
+func Regressions(diffs []TestDiff) int {
+	n := 0
+	for _, d := range diffs {
+		if d.Change == NewFailure {
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,169 @@
+package compare
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+
+	"test-runner/runner"
+)
+
+func TestCompare(t *testing.T) {
+	pass := Result{Outcome: Pass, Status: "PASS"}
+	fail := Result{Outcome: Fail, Status: "FAIL"}
+	timeout := Result{Outcome: Fail, Status: "TIMEOUT"}
+	skip := Result{Outcome: Skip, Status: "SKIP"}
+	baseline := map[string]Result{
+		"a.new_failure":   pass,
+		"a.fixed":         fail,
+		"a.still_failing": fail,
+		"a.newly_skipped": pass,
+		"a.skip_to_fail":  skip,
+		"a.skip_to_pass":  skip,
+		"a.removed":       pass,
+		"a.unchanged":     pass,
+	}
+	candidate := map[string]Result{
+		"a.new_failure":   timeout,
+		"a.fixed":         pass,
+		"a.still_failing": fail,
+		"a.newly_skipped": skip,
+		"a.skip_to_fail":  fail,
+		"a.skip_to_pass":  pass,
+		"a.added":         fail,
+		"a.unchanged":     pass,
+	}
+	want := map[string]Change{
+		"a.new_failure":   NewFailure,
+		"a.fixed":         Fixed,
+		"a.still_failing": StillFailing,
+		"a.newly_skipped": NewlySkipped,
+		"a.skip_to_fail":  NewFailure,
+		"a.skip_to_pass":  Unchanged,
+		"a.removed":       Removed,
+		"a.added":         Added,
+		"a.unchanged":     Unchanged,
+	}
+
+	diffs := Compare(baseline, candidate)
+	got := make(map[string]Change)
+	for i, d := range diffs {
+		got[d.TestID] = d.Change
+		if i > 0 && diffs[i-1].TestID >= d.TestID {
+			t.Errorf("diffs not sorted: %s after %s", d.TestID, diffs[i-1].TestID)
+		}
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("changes mismatch (-want +got):\n%s", diff)
+	}
+	if n := Regressions(diffs); n != 2 {
+		t.Errorf("expected 2 regressions, got %d", n)
+	}
+}
+
+func TestLoadJUnit(t *testing.T) {
+	testCases := []struct {
+		name string
+		xml  string
+	}{
+		{
+			name: "flat",
+			xml: `<?xml version="1.0" encoding="UTF-8"?>
+<testsuites>
+  <testsuite name="suite" tests="3">
+    <testcase name="pass" classname="suite" time="0.1"></testcase>
+    <testcase name="gup.sh" classname="suite" time="0.1"></testcase>
+    <testcase name="fail" classname="suite" time="0.1"><failure message="Test failed"><![CDATA[oops]]></failure></testcase>
+    <testcase name="skip" classname="suite" time="0.0"><skipped message="Test skipped"></skipped></testcase>
+  </testsuite>
+  <testsuite name="toplevel" tests="1">
+    <testcase name="toplevel" classname="toplevel" time="0.1"><error message="boom"></error></testcase>
+  </testsuite>
+</testsuites>`,
+		},
+		{
+			name: "nested",
+			xml: `<testsuite name="all">
+  <testsuite name="suite">
+    <testcase name="pass" classname="suite"/>
+    <testcase name="gup.sh" classname="suite"/>
+    <testcase name="fail" classname="suite"><failure/></testcase>
+    <testcase name="skip" classname="suite"><skipped/></testcase>
+  </testsuite>
+  <testcase name="toplevel"><error/></testcase>
+</testsuite>`,
+		},
+		{
+			name: "KTAP subtests",
+			xml: `<testsuites>
+  <testsuite name="suite">
+    <testcase name="pass" classname="suite"/>
+    <testcase name="gup.sh" classname="suite"/>
+    <testcase name="fail" classname="suite"><failure/></testcase>
+    <testcase name="skip" classname="suite"><skipped/></testcase>
+    <testsuite name="suite.gup\.sh">
+      <testcase name="read" classname="suite.gup\.sh"/>
+      <testcase name="write" classname="suite.gup\.sh"><failure/></testcase>
+    </testsuite>
+  </testsuite>
+  <testsuite name="toplevel">
+    <testcase name="toplevel" classname="toplevel"><error/></testcase>
+    <testsuite name="toplevel">
+      <testcase name="sub / case" classname="toplevel"/>
+    </testsuite>
+  </testsuite>
+</testsuites>`,
+		},
+	}
+	want := map[string]Result{
+		"suite.pass": {Outcome: Pass, Status: "PASS"},
+		// Dots in names are escaped in the IDs.
+		`suite.gup\.sh`: {Outcome: Pass, Status: "PASS"},
+		"suite.fail":    {Outcome: Fail, Status: "FAIL"},
+		"suite.skip":    {Outcome: Skip, Status: "SKIP"},
+		"toplevel":      {Outcome: Fail, Status: "ERROR"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "junit.xml")
+			if err := os.WriteFile(path, []byte(tc.xml), 0644); err != nil {
+				t.Fatal(err)
+			}
+			got, err := Load(path)
+			if err != nil {
+				t.Fatalf("Load returned error: %v", err)
+			}
+			if diff := cmp.Diff(want, got); diff != "" {
+				t.Errorf("results mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestLoadResultsJSON(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "results.json")
+	now := time.Now()
+	results := []*runner.TestResult{
+		{TestID: "suite.flaky", Result: runner.TestFlaky, StartTime: now, EndTime: now},
+		{TestID: "suite.dropped", Result: runner.TestDropped, StartTime: now, EndTime: now},
+		{TestID: "suite.crashed", Result: runner.TestCrashed, StartTime: now, EndTime: now},
+	}
+	if err := runner.WriteResultsJSON(results, runner.Host{}, path); err != nil {
+		t.Fatal(err)
+	}
+	got, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load returned error: %v", err)
+	}
+	want := map[string]Result{
+		"suite.flaky":   {Outcome: Pass, Status: "FLAKY"},
+		"suite.dropped": {Outcome: Skip, Status: "DROP"},
+		"suite.crashed": {Outcome: Fail, Status: "CRASH"},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("results mismatch (-want +got):\n%s", diff)
+	}
+}
@@ -4,42 +4,90 @@ import (
 	"encoding/xml"
 	"fmt"
 	"os"
+	"sort"
 	"strings"
 	"time"
 
+	"test-runner/kmsg"
+	"test-runner/ktap"
 	"test-runner/runner"
+	"test-runner/test_conf"
 )
 
-// TestSuites is the top-level element of the JUnit XML report.
+// TestSuites is the top-level element of the JUnit XML report. The counts are
+// totals of the tests in the report, not including their subtests, so they
+// match the runner's summary.
 type TestSuites struct {
-	XMLName xml.Name    `xml:"testsuites"`
-	Suites  []TestSuite `xml:"testsuite"`
+	XMLName  xml.Name     `xml:"testsuites"`
+	Tests    int          `xml:"tests,attr"`
+	Failures int          `xml:"failures,attr"`
+	Errors   int          `xml:"errors,attr"`
+	Skipped  int          `xml:"skipped,attr"`
+	Time     string       `xml:"time,attr"`
+	Suites   []*TestSuite `xml:"testsuite"`
 }
 
-// TestSuite represents a single test suite.
+// TestSuite holds the test cases directly inside one suite of the test
+// hierarchy, named by the suite's ID. The suites aren't nested in the report:
+// consumers like dorny/test-reporter only look at the cases directly under
+// each suite, so "a.b.c" is in suite "a.b", which is a sibling of suite "a".
 type TestSuite struct {
-	XMLName   xml.Name   `xml:"testsuite"`
-	Name      string     `xml:"name,attr"`
-	Tests     int        `xml:"tests,attr"`
-	Failures  int        `xml:"failures,attr"`
-	Errors    int        `xml:"errors,attr"`
-	Skipped   int        `xml:"skipped,attr"`
-	Time      string     `xml:"time,attr"`
-	TestCases []TestCase `xml:"testcase"`
+	XMLName    xml.Name    `xml:"testsuite"`
+	Name       string      `xml:"name,attr"`
+	Tests      int         `xml:"tests,attr"`
+	Failures   int         `xml:"failures,attr"`
+	Errors     int         `xml:"errors,attr"`
+	Skipped    int         `xml:"skipped,attr"`
+	Time       string      `xml:"time,attr"`
+	Timestamp  string      `xml:"timestamp,attr,omitempty"`
+	Hostname   string      `xml:"hostname,attr,omitempty"`
+	Properties *Properties `xml:"properties,omitempty"`
+	TestCases  []TestCase  `xml:"testcase"`
 }
 
 // TestCase represents a single test case.
 type TestCase struct {
-	XMLName   xml.Name `xml:"testcase"`
-	Name      string   `xml:"name,attr"`
-	ClassName string   `xml:"classname,attr"`
-	Time      string   `xml:"time,attr"`
-	Failure   *Failure `xml:"failure,omitempty"`
-	Skipped   *Skipped `xml:"skipped,omitempty"`
-	Error     *Error   `xml:"error,omitempty"`
+	XMLName    xml.Name    `xml:"testcase"`
+	Name       string      `xml:"name,attr"`
+	ClassName  string      `xml:"classname,attr"`
+	Time       string      `xml:"time,attr"`
+	Timestamp  string      `xml:"timestamp,attr,omitempty"`
+	Hostname   string      `xml:"hostname,attr,omitempty"`
+	Properties *Properties `xml:"properties,omitempty"`
+	Failure    *Failure    `xml:"failure,omitempty"`
+	Skipped    *Skipped    `xml:"skipped,omitempty"`
+	Error      *Error      `xml:"error,omitempty"`
+	// The test's output.
+	SystemOut *LogOutput `xml:"system-out,omitempty"`
+	// The kernel log from while the test was running.
+	SystemErr string `xml:"system-err,omitempty"`
+	// Earlier failed attempts at a test that was retried. These follow the
+	// Maven Surefire convention: flakyFailure when the test eventually passed,
+	// rerunFailure when it never did.
+	FlakyFailures []Rerun `xml:"flakyFailure,omitempty"`
+	RerunFailures []Rerun `xml:"rerunFailure,omitempty"`
+	// Only used while building the report.
+	duration time.Duration
 }
 
-// Failure represents a test failure.
+// Properties holds extra information about a test case.
+type Properties struct {
+	Properties []Property `xml:"property"`
+}
+
+type Property struct {
+	Name  string `xml:"name,attr"`
+	Value string `xml:"value,attr"`
+}
+
+// Rerun represents one failed attempt at a test that was retried.
+type Rerun struct {
+	Message   string     `xml:"message,attr"`
+	SystemOut *LogOutput `xml:"system-out,omitempty"`
+}
+
+// Failure represents a test failure. If the content has "]]>" in it,
+// encoding/xml splits it across several CDATA sections.
 type Failure struct {
 	XMLName xml.Name `xml:"failure"`
 	Message string   `xml:"message,attr"`
@@ -59,72 +107,250 @@ type Error struct {
 	Content string   `xml:",cdata"`
 }
 
-func GenerateReport(results []*runner.TestResult, path string) error {
-	suites := make(map[string]*TestSuite)
-	for _, result := range results {
-		suiteName, testName := splitTestID(result.TestID)
-		if _, ok := suites[suiteName]; !ok {
-			suites[suiteName] = &TestSuite{
-				Name:      suiteName,
-				TestCases: []TestCase{},
-			}
+// JUnit timestamps don't have a time zone. Using UTC means the report doesn't
+// depend on where it was generated.
+const timestampFormat = "2006-01-02T15:04:05"
+
+func formatTimestamp(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(timestampFormat)
+}
+
+func formatDuration(d time.Duration) string {
+	return fmt.Sprintf("%.3f", d.Seconds())
+}
+
+// suiteNode is a TestSuite that's still being built.
+type suiteNode struct {
+	suite *TestSuite
+	// Whether the suite holds a test's subtests. They're already in a
+	// meaningful order, and they're not counted in the report's totals.
+	subtests bool
+	// Of the suite's test cases, filled in by finish.
+	start    time.Time
+	duration time.Duration
+}
+
+type reportBuilder struct {
+	host runner.Host
+	// Keyed by the suite name.
+	suites map[string]*suiteNode
+}
+
+func (b *reportBuilder) newNode(name string) *suiteNode {
+	node := &suiteNode{
+		suite: &TestSuite{
+			Name:     name,
+			Hostname: b.host.Hostname,
+		},
+	}
+	if b.host.KernelRelease != "" {
+		node.suite.Properties = &Properties{Properties: []Property{
+			{Name: "kernel.release", Value: b.host.KernelRelease},
+		}}
+	}
+	return node
+}
+
+// suiteNamed returns the suite with the given name, creating it if needed.
+func (b *reportBuilder) suiteNamed(name string) *suiteNode {
+	node := b.suites[name]
+	if node == nil {
+		node = b.newNode(name)
+		b.suites[name] = node
+	}
+	return node
+}
+
+// parentSuite returns the suite that a test belongs in, and the test's name
+// within it. Suite names are the full ID of the suite, so e.g. test "a.b.c" is
+// called "c" in suite "a.b". Names with dots in them are escaped in the IDs
+// (see test_conf.JoinID) but not in the test case names. A test at the top
+// level gets a suite of its own with the same name.
+func (b *reportBuilder) parentSuite(testID string) (*suiteNode, string) {
+	names := test_conf.SplitID(testID)
+	if len(names) == 1 {
+		return b.suiteNamed(testID), names[0]
+	}
+	return b.suiteNamed(test_conf.JoinID(names[:len(names)-1]...)), names[len(names)-1]
+}
+
+// finish sorts the suite's contents and works out its totals.
+func (n *suiteNode) finish() {
+	s := n.suite
+	if !n.subtests {
+		sort.SliceStable(s.TestCases, func(i, j int) bool { return s.TestCases[i].Name < s.TestCases[j].Name })
+	}
+	for _, tc := range s.TestCases {
+		s.Tests++
+		switch {
+		case tc.Failure != nil:
+			s.Failures++
+		case tc.Error != nil:
+			s.Errors++
+		case tc.Skipped != nil:
+			s.Skipped++
 		}
+		n.duration += tc.duration
+	}
+	s.Time = formatDuration(n.duration)
+	s.Timestamp = formatTimestamp(n.start)
+}
 
-		suite := suites[suiteName]
-		suite.Tests++
+func (n *suiteNode) addCase(tc TestCase, start time.Time) {
+	n.suite.TestCases = append(n.suite.TestCases, tc)
+	if !start.IsZero() && (n.start.IsZero() || start.Before(n.start)) {
+		n.start = start
+	}
+}
+
+// caseProperties returns the properties for a test's case, or nil if there
+// aren't any.
+func caseProperties(result *runner.TestResult) *Properties {
+	var props []Property
+	add := func(name, value string) {
+		if value != "" {
+			props = append(props, Property{Name: name, Value: value})
+		}
+	}
+	add("tags", strings.Join(result.Tags, ","))
+	add("command", strings.Join(result.Command, " "))
+	add("skip.reason", result.SkipReason)
+	if result.NewTaint != 0 {
+		add("taint.new", result.NewTaint.String())
+	}
+	if len(props) == 0 {
+		return nil
+	}
+	return &Properties{Properties: props}
+}
+
+// Options control what goes in a report.
+type Options struct {
+	// Where the tests ran.
+	Host runner.Host
+	// The most of each log to include, see LogOutput. 0 means no limit.
+	MaxLogBytes int64
+}
+
+// GenerateReport writes a JUnit XML report of results to path. The report only
+// depends on its inputs (and the logs), so the same results always produce the
+// same bytes.
+func GenerateReport(results []*runner.TestResult, path string, opts Options) error {
+	host := opts.Host
+	b := &reportBuilder{host: host, suites: make(map[string]*suiteNode)}
+	for _, result := range results {
+		parent, testName := b.parentSuite(result.TestID)
+		className := parent.suite.Name
 
 		duration := result.EndTime.Sub(result.StartTime)
 		testCase := TestCase{
-			Name:      testName,
-			ClassName: suiteName,
-			Time:      fmt.Sprintf("%.3f", duration.Seconds()),
+			Name:       testName,
+			ClassName:  className,
+			Time:       formatDuration(duration),
+			Timestamp:  formatTimestamp(result.StartTime),
+			Hostname:   host.Hostname,
+			Properties: caseProperties(result),
+			SystemErr:  sanitizeString(formatKernelLog(result.KernelLog)),
+			duration:   duration,
+		}
+
+		// The last attempt's log, which for a retried test is the only one
+		// that isn't in a rerun.
+		logFile := result.LogFile
+		if logFile == "" && len(result.Attempts) > 0 {
+			logFile = result.Attempts[len(result.Attempts)-1].LogFile
 		}
+		log, err := openLog(logFile, opts.MaxLogBytes)
+		if err != nil && result.Result != runner.TestCrashed {
+			return fmt.Errorf("reading log file for %s: %w", result.TestID, err)
+		}
+		// For a crashed test, this is whatever made it to disk before the
+		// crash. It's not an error if nothing did.
+		testCase.SystemOut = log
 
+		// The end of the log also goes in the body of failures and errors.
+		var tail string
 		switch result.Result {
-		case runner.TestFailed:
-			suite.Failures++
-			logContent, err := getLogContent(result.LogFile)
-			if err != nil {
-				return fmt.Errorf("reading log file for failed test %s: %w", result.TestID, err)
+		case runner.TestFailed, runner.TestError, runner.TestTimeout, runner.TestCrashed:
+			if log != nil {
+				if tail, err = readLogTail(log.path, opts.MaxLogBytes); err != nil {
+					return fmt.Errorf("reading log file for %s: %w", result.TestID, err)
+				}
 			}
-			testCase.Failure = &Failure{
-				Message: "Test failed",
-				Content: logContent,
+		}
+
+		switch result.Result {
+		case runner.TestFailed:
+			testCase.Failure = &Failure{Message: "Test failed", Content: tail}
+			if result.Err != nil {
+				testCase.Failure.Message += fmt.Sprintf(": %v", result.Err)
 			}
 		case runner.TestError:
-			suite.Errors++
-			logContent, err := getLogContent(result.LogFile)
-			if err != nil {
-				return fmt.Errorf("reading log file for errored test %s: %w", result.TestID, err)
+			testCase.Error = &Error{Message: fmt.Sprintf("Test execution failed: %v", result.Err), Content: tail}
+		case runner.TestTimeout:
+			// Timeout isn't set when it's an exit code that means timeout.
+			testCase.Error = &Error{Message: "Test timed out", Content: tail}
+			if result.Timeout > 0 {
+				testCase.Error.Message += fmt.Sprintf(" after %v", result.Timeout)
+			}
+			if result.Err != nil {
+				testCase.Error.Message += fmt.Sprintf(": %v", result.Err)
 			}
-			testCase.Error = &Error{
-				Message: fmt.Sprintf("Test execution failed: %v", result.Err),
-				Content: logContent,
+		case runner.TestKernelError:
+			var splats []string
+			for _, splat := range result.Splats {
+				splats = append(splats, splat.String())
+			}
+			testCase.Failure = &Failure{
+				Message: "Kernel error: " + result.KernelErrorTitle(),
+				Content: sanitizeString(strings.Join(splats, "\n\n")),
 			}
+		case runner.TestFlaky:
+			// Counts as a pass, the failures are in FlakyFailures.
 		case runner.TestSkipped:
-			suite.Skipped++
-			testCase.Skipped = &Skipped{Message: "Test skipped"}
+			testCase.Skipped = &Skipped{Message: "Test skipped: " + result.SkipReason}
 		case runner.TestDropped:
-			suite.Skipped++
 			testCase.Skipped = &Skipped{Message: "Test dropped"}
+		case runner.TestCrashed:
+			testCase.Error = &Error{Message: fmt.Sprintf("Test crashed: %v", result.Err), Content: tail}
 		}
-		suite.TestCases = append(suite.TestCases, testCase)
-	}
+		if err := addReruns(&testCase, result, opts.MaxLogBytes); err != nil {
+			return fmt.Errorf("reading logs for retried test %s: %w", result.TestID, err)
+		}
+		parent.addCase(testCase, result.StartTime)
 
-	var testSuites []TestSuite
-	for _, suite := range suites {
-		var suiteDuration time.Duration
-		for _, tc := range suite.TestCases {
-			parsedTime, _ := time.ParseDuration(tc.Time + "s")
-			suiteDuration += parsedTime
+		if subtests := reportedSubtests(result.Subtests); subtests != nil {
+			node := b.suiteNamed(result.TestID)
+			node.subtests = true
+			addSubtests(node, result, "", subtests)
 		}
-		suite.Time = fmt.Sprintf("%.3f", suiteDuration.Seconds())
-		testSuites = append(testSuites, *suite)
 	}
 
-	report := TestSuites{
-		Suites: testSuites,
+	report := TestSuites{}
+	var names []string
+	for name := range b.suites {
+		names = append(names, name)
 	}
+	sort.Strings(names)
+	var duration time.Duration
+	for _, name := range names {
+		node := b.suites[name]
+		node.finish()
+		report.Suites = append(report.Suites, node.suite)
+		if node.subtests {
+			// The test they're in is already counted.
+			continue
+		}
+		report.Tests += node.suite.Tests
+		report.Failures += node.suite.Failures
+		report.Errors += node.suite.Errors
+		report.Skipped += node.suite.Skipped
+		duration += node.duration
+	}
+	report.Time = formatDuration(duration)
 
 	file, err := os.Create(path)
 	if err != nil {
@@ -142,25 +368,92 @@ func GenerateReport(results []*runner.TestResult, path string) error {
 	if err := encoder.Encode(report); err != nil {
 		return fmt.Errorf("encoding JUnit XML: %w", err)
 	}
+	if _, err := file.WriteString("\n"); err != nil {
+		return fmt.Errorf("writing JUnit XML: %w", err)
+	}
 
 	return nil
 }
 
-func splitTestID(testID string) (string, string) {
-	parts := strings.Split(testID, ".")
-	if len(parts) > 1 {
-		return strings.Join(parts[:len(parts)-1], "."), parts[len(parts)-1]
+// addReruns records the attempts before the last one, for retried tests. The
+// last attempt is already reported as the test's overall result, with its log
+// in the test case's SystemOut.
+func addReruns(testCase *TestCase, result *runner.TestResult, maxLogBytes int64) error {
+	if len(result.Attempts) < 2 {
+		return nil
 	}
-	return testID, testID
+	for i, attempt := range result.Attempts[:len(result.Attempts)-1] {
+		log, err := openLog(attempt.LogFile, maxLogBytes)
+		if err != nil {
+			return err
+		}
+		rerun := Rerun{
+			Message:   fmt.Sprintf("Attempt %d: %s", i+1, attempt.Result.Name()),
+			SystemOut: log,
+		}
+		if attempt.Err != nil {
+			rerun.Message += fmt.Sprintf(": %v", attempt.Err)
+		}
+		if result.Result == runner.TestFlaky {
+			testCase.FlakyFailures = append(testCase.FlakyFailures, rerun)
+		} else {
+			testCase.RerunFailures = append(testCase.RerunFailures, rerun)
+		}
+	}
+	return nil
 }
 
-func getLogContent(logFile string) (string, error) {
-	if logFile == "" {
-		return "", nil
+func formatKernelLog(records []kmsg.Record) string {
+	var lines []string
+	for _, record := range records {
+		lines = append(lines, record.String())
 	}
-	content, err := os.ReadFile(logFile)
-	if err != nil {
-		return "", err
+	return strings.Join(lines, "\n")
+}
+
+// reportedSubtests returns the subtests that are worth reporting as their own
+// test cases. When kselftests are run via run_kselftest.sh there's always a
+// single top-level result wrapping the test's actual KTAP, that isn't
+// interesting. And if there's just one subtest, it's the same as the test.
+func reportedSubtests(results []*ktap.Result) []*ktap.Result {
+	if len(results) == 1 && len(results[0].Subtests) > 0 {
+		results = results[0].Subtests
+	}
+	if len(ktap.Leaves(results)) < 2 {
+		return nil
+	}
+	return results
+}
+
+// addSubtests adds a test case to the suite for each subtest parsed from the
+// test's KTAP. The suite is named after the test, and so is the class name. If
+// the KTAP was nested, the names of the parent results are joined up with
+// " / ".
+func addSubtests(node *suiteNode, result *runner.TestResult, prefix string, results []*ktap.Result) {
+	for _, r := range results {
+		name := prefix + r.Name
+		if len(r.Subtests) > 0 {
+			addSubtests(node, result, name+" / ", r.Subtests)
+			continue
+		}
+		testCase := TestCase{
+			Name:      name,
+			ClassName: result.TestID,
+			Time:      formatDuration(0),
+			Timestamp: formatTimestamp(result.StartTime),
+			Hostname:  node.suite.Hostname,
+		}
+		switch r.Status {
+		case ktap.Fail:
+			testCase.Failure = &Failure{
+				Message: "Subtest failed",
+				Content: sanitizeString(strings.Join(r.Diagnostics, "\n")),
+			}
+		case ktap.Skip:
+			testCase.Skipped = &Skipped{Message: "Subtest skipped: " + r.Reason}
+		case ktap.Todo:
+			testCase.Skipped = &Skipped{Message: "Subtest TODO: " + r.Reason}
+		}
+		node.addCase(testCase, result.StartTime)
 	}
-	return string(content), nil
 }
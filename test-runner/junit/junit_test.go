@@ -8,6 +8,10 @@ import (
 	"testing"
 	"time"
 
+	"github.com/google/go-cmp/cmp"
+
+	"test-runner/kmsg"
+	"test-runner/ktap"
 	"test-runner/runner"
 )
 
@@ -30,6 +34,9 @@ func TestGenerateJUnitReport(t *testing.T) {
 			EndTime:   time.Now().Add(2 * time.Second),
 			LogFile:   createTempLogFile(t, "failure log"),
 			Err:       fmt.Errorf("exit status 1"),
+			KernelLog: []kmsg.Record{
+				{Priority: 4, Seq: 10, Timestamp: 1500 * time.Millisecond, Message: "kernel says hi"},
+			},
 		},
 		{
 			TestID:    "suite2.test1",
@@ -45,9 +52,60 @@ func TestGenerateJUnitReport(t *testing.T) {
 			LogFile:   createTempLogFile(t, "error log"),
 			Err:       fmt.Errorf("some error"),
 		},
+		{
+			TestID:    "suite2.test3",
+			Result:    runner.TestTimeout,
+			StartTime: time.Now(),
+			EndTime:   time.Now().Add(3 * time.Second),
+			LogFile:   createTempLogFile(t, "timeout log"),
+			Err:       fmt.Errorf("terminated with SIGTERM"),
+			Timeout:   3 * time.Second,
+		},
+		{
+			TestID:    "suite2.test4",
+			Result:    runner.TestTimeout,
+			StartTime: time.Now(),
+			EndTime:   time.Now(),
+			Err:       fmt.Errorf("exit status 124"),
+		},
+		{
+			TestID:    "suite3.kernel_error",
+			Result:    runner.TestKernelError,
+			StartTime: time.Now(),
+			EndTime:   time.Now().Add(1 * time.Second),
+			Splats: []kmsg.Splat{{
+				Kind:  "KASAN",
+				Title: "BUG: KASAN: use-after-free in foo",
+				Records: []kmsg.Record{
+					{Message: "BUG: KASAN: use-after-free in foo"},
+					{Message: "Read of size 8"},
+				},
+			}},
+		},
+		{
+			TestID:    "suite3.flaky",
+			Result:    runner.TestFlaky,
+			StartTime: time.Now(),
+			EndTime:   time.Now().Add(2 * time.Second),
+			Attempts: []*runner.Attempt{
+				{Result: runner.TestFailed, LogFile: createTempLogFile(t, "first attempt log"), Err: fmt.Errorf("exit status 1")},
+				{Result: runner.TestPassed, LogFile: createTempLogFile(t, "second attempt log")},
+			},
+		},
+		{
+			TestID:    "suite3.broken",
+			Result:    runner.TestFailed,
+			StartTime: time.Now(),
+			EndTime:   time.Now().Add(2 * time.Second),
+			LogFile:   createTempLogFile(t, "last attempt log"),
+			Attempts: []*runner.Attempt{
+				{Result: runner.TestFailed, LogFile: createTempLogFile(t, "earlier attempt log")},
+				{Result: runner.TestFailed},
+			},
+		},
 	}
 
-	err := GenerateReport(results, reportPath)
+	err := GenerateReport(results, reportPath, Options{})
 	if err != nil {
 		t.Fatalf("GenerateJUnitReport() failed: %v", err)
 	}
@@ -71,7 +129,7 @@ func TestGenerateJUnitReport(t *testing.T) {
 	if !strings.Contains(report, `failures="1"`) {
 		t.Error("report does not contain correct failure count")
 	}
-	if !strings.Contains(report, `errors="1"`) {
+	if !strings.Contains(report, `errors="3"`) {
 		t.Error("report does not contain correct error count")
 	}
 	if !strings.Contains(report, `skipped="1"`) {
@@ -83,6 +141,13 @@ func TestGenerateJUnitReport(t *testing.T) {
 	if !strings.Contains(report, `name="test2"`) {
 		t.Error("report does not contain test2")
 	}
+	if !strings.Contains(report, "<system-err>[    1.500000] kernel says hi</system-err>") {
+		t.Error("report does not contain kernel log")
+	}
+	if !strings.Contains(report, `message="Kernel error: BUG: KASAN: use-after-free in foo"`) ||
+		!strings.Contains(report, "[    0.000000] Read of size 8") {
+		t.Error("report does not contain kernel error")
+	}
 	if !strings.Contains(report, "<failure") {
 		t.Error("report does not contain failure tag")
 	}
@@ -92,12 +157,72 @@ func TestGenerateJUnitReport(t *testing.T) {
 	if !strings.Contains(report, "<skipped") {
 		t.Error("report does not contain skipped tag")
 	}
-	if !strings.Contains(report, "failure log") {
+	if !strings.Contains(report, `<failure message="Test failed: exit status 1"><![CDATA[failure log]]></failure>`) {
 		t.Error("report does not contain failure log content")
 	}
-	if !strings.Contains(report, "error log") {
+	if !strings.Contains(report, `<error message="Test execution failed: some error"><![CDATA[error log]]></error>`) {
 		t.Error("report does not contain error log content")
 	}
+	if !strings.Contains(report, `message="Test timed out after 3s: terminated with SIGTERM"`) {
+		t.Error("report does not contain timeout message")
+	}
+	if !strings.Contains(report, `message="Test timed out: exit status 124"`) {
+		t.Error("report does not contain message for timeout exit code")
+	}
+	if !strings.Contains(report, "timeout log") {
+		t.Error("report does not contain timeout log content")
+	}
+	if !strings.Contains(report, `<flakyFailure message="Attempt 1: FAIL: exit status 1">`) || !strings.Contains(report, "first attempt log") {
+		t.Error("report does not contain flaky failure with log")
+	}
+	if !strings.Contains(report, "second attempt log") {
+		t.Error("report does not contain log from passing attempt")
+	}
+	if !strings.Contains(report, "<rerunFailure") || !strings.Contains(report, "earlier attempt log") {
+		t.Error("report does not contain rerun failure with log")
+	}
+}
+
+// Results read back from JSON can be kernel errors without any splats.
+func TestGenerateReportKernelErrorWithoutSplats(t *testing.T) {
+	reportPath := filepath.Join(t.TempDir(), "report.xml")
+	results := []*runner.TestResult{{
+		TestID:    "suite.kernel_error",
+		Result:    runner.TestKernelError,
+		StartTime: time.Now(),
+		EndTime:   time.Now(),
+	}}
+	if err := GenerateReport(results, reportPath, Options{}); err != nil {
+		t.Fatalf("GenerateReport() failed: %v", err)
+	}
+	reportBytes, err := os.ReadFile(reportPath)
+	if err != nil {
+		t.Fatalf("failed to read report file: %v", err)
+	}
+	if want := `message="Kernel error: no splat recorded"`; !strings.Contains(string(reportBytes), want) {
+		t.Errorf("report does not contain %q:\n%s", want, reportBytes)
+	}
+}
+
+func TestGenerateReportFailureLogTail(t *testing.T) {
+	reportPath := filepath.Join(t.TempDir(), "report.xml")
+	results := []*runner.TestResult{{
+		TestID:    "suite.fail",
+		Result:    runner.TestFailed,
+		StartTime: time.Now(),
+		EndTime:   time.Now(),
+		LogFile:   createTempLogFile(t, "setting up\nit broke\n"),
+	}}
+	if err := GenerateReport(results, reportPath, Options{MaxLogBytes: 9}); err != nil {
+		t.Fatalf("GenerateReport() failed: %v", err)
+	}
+	reportBytes, err := os.ReadFile(reportPath)
+	if err != nil {
+		t.Fatalf("failed to read report file: %v", err)
+	}
+	if want := "<![CDATA[[... 11 bytes truncated ...]\nit broke\n]]>"; !strings.Contains(string(reportBytes), want) {
+		t.Errorf("report does not contain %q:\n%s", want, reportBytes)
+	}
 }
 
 func createTempLogFile(t *testing.T, content string) string {
@@ -114,7 +239,7 @@ func createTempLogFile(t *testing.T, content string) string {
 	return tmpFile.Name()
 }
 
-func TestSplitTestID(t *testing.T) {
+func TestParentSuite(t *testing.T) {
 	testCases := []struct {
 		name      string
 		testID    string
@@ -133,6 +258,18 @@ func TestSplitTestID(t *testing.T) {
 			wantSuite: "suite.subsuite",
 			wantTest:  "test",
 		},
+		{
+			name:      "dot in name",
+			testID:    `kselftests.mm.ksft_gup_test\.sh`,
+			wantSuite: "kselftests.mm",
+			wantTest:  "ksft_gup_test.sh",
+		},
+		{
+			name:      "dot in suite name",
+			testID:    `a\.b.test`,
+			wantSuite: `a\.b`,
+			wantTest:  "test",
+		},
 		{
 			name:      "no suite",
 			testID:    "test",
@@ -143,13 +280,151 @@ func TestSplitTestID(t *testing.T) {
 
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
-			gotSuite, gotTest := splitTestID(tc.testID)
-			if gotSuite != tc.wantSuite {
-				t.Errorf("splitTestID() gotSuite = %v, want %v", gotSuite, tc.wantSuite)
-			}
+			b := &reportBuilder{suites: make(map[string]*suiteNode)}
+			node, gotTest := b.parentSuite(tc.testID)
 			if gotTest != tc.wantTest {
-				t.Errorf("splitTestID() gotTest = %v, want %v", gotTest, tc.wantTest)
+				t.Errorf("parentSuite() gotTest = %v, want %v", gotTest, tc.wantTest)
+			}
+			if node.suite.Name != tc.wantSuite {
+				t.Errorf("parentSuite() got suite %v, want %v", node.suite.Name, tc.wantSuite)
+			}
+			// Only the test's own suite gets created, not its ancestors.
+			if len(b.suites) != 1 || b.suites[tc.wantSuite] != node {
+				t.Errorf("parentSuite() created suites %v, want just %v", b.suites, tc.wantSuite)
 			}
 		})
 	}
 }
+
+func TestGenerateReportDeterministic(t *testing.T) {
+	dir := t.TempDir()
+	logFile := filepath.Join(dir, "a.log")
+	if err := os.WriteFile(logFile, []byte("hello\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Date(2025, 1, 2, 3, 4, 5, 0, time.FixedZone("somewhere", 3600))
+	results := []*runner.TestResult{
+		{
+			TestID:    "top.sub.a",
+			Result:    runner.TestPassed,
+			StartTime: start.Add(time.Second),
+			EndTime:   start.Add(2 * time.Second),
+			LogFile:   logFile,
+			Tags:      []string{"slow", "mm"},
+			Command:   []string{"run_kselftest.sh", "-t", "mm:a"},
+		},
+		{
+			TestID:    "top.b",
+			Result:    runner.TestFailed,
+			StartTime: start,
+			EndTime:   start.Add(500 * time.Millisecond),
+		},
+		{
+			TestID:     "top.sub.c",
+			Result:     runner.TestSkipped,
+			StartTime:  start.Add(3 * time.Second),
+			EndTime:    start.Add(3 * time.Second),
+			SkipReason: "[slow]",
+		},
+	}
+	host := runner.Host{Hostname: "testvm", KernelRelease: "6.12.0"}
+
+	want := `<?xml version="1.0" encoding="UTF-8"?>
+<testsuites tests="3" failures="1" errors="0" skipped="1" time="1.500">
+  <testsuite name="top" tests="1" failures="1" errors="0" skipped="0" time="0.500" timestamp="2025-01-02T02:04:05" hostname="testvm">
+    <properties>
+      <property name="kernel.release" value="6.12.0"></property>
+    </properties>
+    <testcase name="b" classname="top" time="0.500" timestamp="2025-01-02T02:04:05" hostname="testvm">
+      <failure message="Test failed"></failure>
+    </testcase>
+  </testsuite>
+  <testsuite name="top.sub" tests="2" failures="0" errors="0" skipped="1" time="1.000" timestamp="2025-01-02T02:04:06" hostname="testvm">
+    <properties>
+      <property name="kernel.release" value="6.12.0"></property>
+    </properties>
+    <testcase name="a" classname="top.sub" time="1.000" timestamp="2025-01-02T02:04:06" hostname="testvm">
+      <properties>
+        <property name="tags" value="slow,mm"></property>
+        <property name="command" value="run_kselftest.sh -t mm:a"></property>
+      </properties>
+      <system-out>hello
+</system-out>
+    </testcase>
+    <testcase name="c" classname="top.sub" time="0.000" timestamp="2025-01-02T02:04:08" hostname="testvm">
+      <properties>
+        <property name="skip.reason" value="[slow]"></property>
+      </properties>
+      <skipped message="Test skipped: [slow]"></skipped>
+    </testcase>
+  </testsuite>
+</testsuites>
+`
+	// The order of the results shouldn't matter.
+	for i, order := range [][]int{{0, 1, 2}, {2, 1, 0}, {1, 2, 0}} {
+		var ordered []*runner.TestResult
+		for _, j := range order {
+			ordered = append(ordered, results[j])
+		}
+		path := filepath.Join(dir, fmt.Sprintf("report%d.xml", i))
+		if err := GenerateReport(ordered, path, Options{Host: host}); err != nil {
+			t.Fatalf("GenerateReport() failed: %v", err)
+		}
+		got, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if diff := cmp.Diff(want, string(got)); diff != "" {
+			t.Errorf("report mismatch for order %v (-want +got):\n%s", order, diff)
+		}
+	}
+}
+
+func TestGenerateReportSubtests(t *testing.T) {
+	reportPath := filepath.Join(t.TempDir(), "report.xml")
+
+	results := []*runner.TestResult{
+		{
+			TestID:    "kselftests.mm",
+			Result:    runner.TestFailed,
+			StartTime: time.Now(),
+			EndTime:   time.Now().Add(1 * time.Second),
+			Subtests: []*ktap.Result{
+				{Number: 1, Name: "selftests: mm: run_vmtests.sh", Status: ktap.Fail, Subtests: []*ktap.Result{
+					{Number: 1, Name: "hugepage-mmap", Status: ktap.Pass},
+					{Number: 2, Name: "hugepage-shm", Status: ktap.Fail, Diagnostics: []string{"shmget failed", "raw\x00output"}},
+					{Number: 3, Name: "gup", Status: ktap.Fail, Subtests: []*ktap.Result{
+						{Number: 1, Name: "read", Status: ktap.Skip, Reason: "no hugepages"},
+					}},
+				}},
+			},
+		},
+	}
+
+	if err := GenerateReport(results, reportPath, Options{}); err != nil {
+		t.Fatalf("GenerateReport() failed: %v", err)
+	}
+	reportBytes, err := os.ReadFile(reportPath)
+	if err != nil {
+		t.Fatalf("failed to read report file: %v", err)
+	}
+	report := string(reportBytes)
+
+	for _, want := range []string{
+		// The subtests aren't counted on top of the test.
+		`<testsuites tests="1" failures="1" errors="0" skipped="0"`,
+		`<testsuite name="kselftests.mm" tests="3" failures="1" errors="0" skipped="1"`,
+		`<testcase name="hugepage-mmap" classname="kselftests.mm"`,
+		`<testcase name="hugepage-shm" classname="kselftests.mm"`,
+		"shmget failed\nraw\\x00output",
+		`<testcase name="gup / read" classname="kselftests.mm"`,
+		"Subtest skipped: no hugepages",
+	} {
+		if !strings.Contains(report, want) {
+			t.Errorf("report does not contain %q:\n%s", want, report)
+		}
+	}
+	if strings.Contains(report, "run_vmtests.sh") {
+		t.Errorf("report contains the kselftest wrapper result:\n%s", report)
+	}
+}
@@ -0,0 +1,183 @@
+package junit
+
+import (
+	"bufio"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"unicode/utf8"
+)
+
+// DefaultMaxLogBytes is how much of each log goes in the report by default.
+const DefaultMaxLogBytes = 1024 * 1024
+
+// logChunkSize is how much of a log gets buffered up at a time while it's
+// being written into the report.
+const logChunkSize = 64 * 1024
+
+// LogOutput is a test log in the report. The file is only read while the report
+// is being written, a chunk at a time, so that big logs don't have to fit in
+// memory. If the log is longer than maxBytes, only the head and the tail are
+// included, with a marker saying how much was cut out of the middle.
+type LogOutput struct {
+	path     string
+	maxBytes int64
+}
+
+// openLog returns the log output for a file. It's nil if path is empty. The
+// file has to exist, but it's not kept open.
+func openLog(path string, maxBytes int64) (*LogOutput, error) {
+	if path == "" {
+		return nil, nil
+	}
+	if _, err := os.Stat(path); err != nil {
+		return nil, err
+	}
+	return &LogOutput{path: path, maxBytes: maxBytes}, nil
+}
+
+// readLogTail returns the end of a log, sanitized for the report: the last
+// maxBytes of it, with a marker saying how much was cut off, or all of it if
+// maxBytes is 0. This is for the body of failures and errors, which is what
+// tools like dorny/test-reporter show, and the end is where the failure is.
+func readLogTail(path string, maxBytes int64) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	if size := info.Size(); maxBytes > 0 && size > maxBytes {
+		fmt.Fprintf(&b, "[... %d bytes truncated ...]\n", size-maxBytes)
+		if _, err := f.Seek(size-maxBytes, io.SeekStart); err != nil {
+			return "", err
+		}
+	}
+	if err := sanitize(&b, f); err != nil {
+		return "", fmt.Errorf("reading %s: %w", path, err)
+	}
+	return b.String(), nil
+}
+
+func (l *LogOutput) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	f, err := os.Open(l.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	if err := e.EncodeToken(start); err != nil {
+		return err
+	}
+	w := &charDataWriter{e: e}
+	size := info.Size()
+	if l.maxBytes <= 0 || size <= l.maxBytes {
+		err = sanitize(w, f)
+	} else {
+		head := l.maxBytes / 2
+		tail := l.maxBytes - head
+		err = sanitize(w, io.LimitReader(f, head))
+		if err == nil {
+			fmt.Fprintf(w, "\n[... %d bytes truncated ...]\n", size-head-tail)
+			_, err = f.Seek(size-tail, io.SeekStart)
+		}
+		if err == nil {
+			err = sanitize(w, f)
+		}
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err != nil {
+		return fmt.Errorf("reading %s: %w", l.path, err)
+	}
+	return e.EncodeToken(start.End())
+}
+
+// charDataWriter buffers up text and writes it to an encoder as character
+// data, which the encoder escapes.
+type charDataWriter struct {
+	e   *xml.Encoder
+	buf []byte
+}
+
+func (w *charDataWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	if len(w.buf) >= logChunkSize {
+		if err := w.Flush(); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+func (w *charDataWriter) Flush() error {
+	if len(w.buf) == 0 {
+		return nil
+	}
+	err := w.e.EncodeToken(xml.CharData(w.buf))
+	w.buf = w.buf[:0]
+	return err
+}
+
+// sanitize copies text from r to w, making it safe for XML 1.0. Characters
+// that XML doesn't allow at all (even as character references), like NUL and
+// most other control characters, and bytes that aren't valid UTF-8, are
+// escaped as \xNN, the same way the kernel escapes them in its log. The
+// non-characters U+FFFE and U+FFFF become \ufffe and \uffff. Backslash
+// isn't escaped, so this isn't reversible, it's just for humans to read.
+func sanitize(w io.Writer, r io.Reader) error {
+	br := bufio.NewReader(r)
+	bw := bufio.NewWriter(w)
+	for {
+		c, size, err := br.ReadRune()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		switch {
+		case c == utf8.RuneError && size == 1:
+			// Not valid UTF-8. ReadRune only consumed a single byte.
+			br.UnreadRune()
+			b, _ := br.ReadByte()
+			fmt.Fprintf(bw, `\x%02x`, b)
+		case !isXMLChar(c) && c < 0x100:
+			fmt.Fprintf(bw, `\x%02x`, c)
+		case !isXMLChar(c):
+			// U+FFFE and U+FFFF.
+			fmt.Fprintf(bw, `\u%04x`, c)
+		default:
+			bw.WriteRune(c)
+		}
+	}
+	return bw.Flush()
+}
+
+// sanitizeString is sanitize for strings that are already in memory.
+func sanitizeString(s string) string {
+	var b strings.Builder
+	sanitize(&b, strings.NewReader(s))
+	return b.String()
+}
+
+// isXMLChar reports whether c is in the Char production of the XML 1.0 spec.
+// The ones that aren't, apart from surrogates (which utf8 doesn't decode) and
+// U+FFFE/U+FFFF, are C0 control characters.
+func isXMLChar(c rune) bool {
+	return c == '\t' || c == '\n' || c == '\r' ||
+		c >= 0x20 && c <= 0xD7FF ||
+		c >= 0xE000 && c <= 0xFFFD ||
+		c >= 0x10000 && c <= 0x10FFFF
+}
@@ -0,0 +1,164 @@
+package junit
+
+import (
+	"encoding/xml"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+
+	"test-runner/kmsg"
+	"test-runner/runner"
+)
+
+func TestSanitize(t *testing.T) {
+	testCases := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{
+			name: "plain",
+			in:   "hello\tworld\r\n",
+			want: "hello\tworld\r\n",
+		},
+		{
+			name: "control characters",
+			in:   "a\x00b\x1b[31mred\x7f",
+			want: `a\x00b\x1b[31mred` + "\x7f",
+		},
+		{
+			name: "invalid UTF-8",
+			in:   "caf\xc3 \xff\xfe ok",
+			want: `caf\xc3 \xff\xfe ok`,
+		},
+		{
+			name: "unicode",
+			in:   "✔️ \U0001F525",
+			want: "✔️ \U0001F525",
+		},
+		{
+			name: "non-characters",
+			in:   "\uffff\ufffe\ufffd",
+			want: `\uffff\ufffe` + "\ufffd",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if diff := cmp.Diff(tc.want, sanitizeString(tc.in)); diff != "" {
+				t.Errorf("sanitizeString() mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+// systemOut generates a report for a single test with a log containing
+// content, and returns what ended up in the log in the report.
+func systemOut(t *testing.T, content string, maxBytes int64) string {
+	t.Helper()
+	dir := t.TempDir()
+	logFile := filepath.Join(dir, "test.log")
+	if err := os.WriteFile(logFile, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	reportPath := filepath.Join(dir, "report.xml")
+	results := []*runner.TestResult{{
+		TestID:    "suite.test",
+		Result:    runner.TestPassed,
+		StartTime: time.Now(),
+		EndTime:   time.Now(),
+		LogFile:   logFile,
+	}}
+	if err := GenerateReport(results, reportPath, Options{MaxLogBytes: maxBytes}); err != nil {
+		t.Fatalf("GenerateReport() failed: %v", err)
+	}
+	data, err := os.ReadFile(reportPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var report struct {
+		SystemOut string `xml:"testsuite>testcase>system-out"`
+	}
+	if err := xml.Unmarshal(data, &report); err != nil {
+		t.Fatalf("report isn't valid XML: %v\n%s", err, data)
+	}
+	return report.SystemOut
+}
+
+func TestLogOutput(t *testing.T) {
+	testCases := []struct {
+		name     string
+		content  string
+		maxBytes int64
+		want     string
+	}{
+		{
+			name:    "escaping",
+			content: "<tag> & ]]> \x00\x01\n",
+			want:    `<tag> & ]]> \x00\x01` + "\n",
+		},
+		{
+			name:     "under limit",
+			content:  "0123456789",
+			maxBytes: 10,
+			want:     "0123456789",
+		},
+		{
+			name:     "truncated",
+			content:  "head" + strings.Repeat("x", 100) + "tail",
+			maxBytes: 8,
+			want:     "head\n[... 100 bytes truncated ...]\ntail",
+		},
+		{
+			name:     "no limit",
+			content:  strings.Repeat("y", 3*logChunkSize),
+			maxBytes: 0,
+			want:     strings.Repeat("y", 3*logChunkSize),
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got := systemOut(t, tc.content, tc.maxBytes)
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("system-out mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestFailureContentCDATA(t *testing.T) {
+	dir := t.TempDir()
+	reportPath := filepath.Join(dir, "report.xml")
+	results := []*runner.TestResult{{
+		TestID:    "suite.test",
+		Result:    runner.TestKernelError,
+		StartTime: time.Now(),
+		EndTime:   time.Now(),
+		Splats: []kmsg.Splat{{
+			Kind:    "WARNING",
+			Title:   "WARNING: at foo",
+			Records: []kmsg.Record{{Message: "x[0]]>1 \x02"}},
+		}},
+	}}
+	if err := GenerateReport(results, reportPath, Options{}); err != nil {
+		t.Fatalf("GenerateReport() failed: %v", err)
+	}
+	data, err := os.ReadFile(reportPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var report struct {
+		Failure string `xml:"testsuite>testcase>failure"`
+	}
+	if err := xml.Unmarshal(data, &report); err != nil {
+		t.Fatalf("report isn't valid XML: %v\n%s", err, data)
+	}
+	if !strings.Contains(report.Failure, `x[0]]>1 \x02`) {
+		t.Errorf("failure content not preserved, got %q", report.Failure)
+	}
+}
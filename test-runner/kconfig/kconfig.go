@@ -0,0 +1,165 @@
+// Package kconfig reads the running kernel's build configuration and checks
+// tests' requirements against it.
+package kconfig
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Config maps option names, without the CONFIG_ prefix, to their values. Options
+// that aren't set aren't in the map. String values have their quotes removed.
+type Config map[string]string
+
+// Parse reads a config in the format of a kernel .config file.
+func Parse(r io.Reader) (Config, error) {
+	config := make(Config)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, value, ok := strings.Cut(line, "=")
+		if !ok || !strings.HasPrefix(name, "CONFIG_") {
+			return nil, fmt.Errorf("can't parse kernel config line %q", line)
+		}
+		if unquoted, err := strconv.Unquote(value); err == nil {
+			value = unquoted
+		}
+		config[strings.TrimPrefix(name, "CONFIG_")] = value
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// Read reads a config from path, which can be gzipped like /proc/config.gz.
+func Read(path string) (Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var r io.Reader = bytes.NewReader(data)
+	if bytes.HasPrefix(data, []byte{0x1f, 0x8b}) {
+		if r, err = gzip.NewReader(r); err != nil {
+			return nil, fmt.Errorf("decompressing %s: %w", path, err)
+		}
+	}
+	config, err := Parse(r)
+	if err != nil {
+		return nil, fmt.Errorf("reading %s: %w", path, err)
+	}
+	return config, nil
+}
+
+// DefaultPaths are where the config of a kernel with the given release
+// (uname -r) might be, in the order they should be tried.
+func DefaultPaths(release string) []string {
+	return []string{"/proc/config.gz", "/boot/config-" + release}
+}
+
+// Find reads the config from the first of the paths that exists, and returns
+// which one it was.
+func Find(paths []string) (Config, string, error) {
+	for _, path := range paths {
+		config, err := Read(path)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		return config, path, err
+	}
+	return nil, "", fmt.Errorf("kernel config not found in %s", strings.Join(paths, " or "))
+}
+
+// Requirement is a condition on a config option, written like "SCSI_DEBUG=m",
+// "TEST_VMALLOC=m|y" or "KVM" (which means y or m). A value of n means the
+// option isn't set, so "DEBUG_VM=n" means it mustn't be. The CONFIG_ prefix is
+// optional.
+type Requirement struct {
+	// Without the CONFIG_ prefix.
+	Option string
+	// The values that satisfy the requirement.
+	Values []string
+}
+
+var optionRegexp = regexp.MustCompile(`^[A-Za-z0-9_]+$`)
+
+// ParseRequirement parses a requirement like "TEST_VMALLOC=m|y".
+func ParseRequirement(s string) (Requirement, error) {
+	option, values, hasValues := strings.Cut(s, "=")
+	option = strings.TrimPrefix(option, "CONFIG_")
+	if !optionRegexp.MatchString(option) {
+		return Requirement{}, fmt.Errorf("invalid kconfig requirement %q, should be like \"OPTION=m|y\"", s)
+	}
+	req := Requirement{Option: option, Values: []string{"y", "m"}}
+	if hasValues {
+		req.Values = strings.Split(values, "|")
+		for _, value := range req.Values {
+			if value == "" {
+				return Requirement{}, fmt.Errorf("invalid kconfig requirement %q, empty value", s)
+			}
+		}
+	}
+	return req, nil
+}
+
+func (r Requirement) String() string {
+	return r.Option + "=" + strings.Join(r.Values, "|")
+}
+
+func (r *Requirement) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("kconfig requirement must be a string like \"TEST_VMALLOC=m|y\": %w", err)
+	}
+	parsed, err := ParseRequirement(s)
+	if err != nil {
+		return err
+	}
+	*r = parsed
+	return nil
+}
+
+func (r Requirement) MarshalJSON() ([]byte, error) {
+	return json.Marshal(r.String())
+}
+
+// Check returns why the config doesn't meet the requirement, like
+// "CONFIG_TEST_VMALLOC not set", or "" if it does.
+func (c Config) Check(r Requirement) string {
+	value, ok := c[r.Option]
+	if !ok {
+		value = "n"
+	}
+	for _, want := range r.Values {
+		if value == want {
+			return ""
+		}
+	}
+	if !ok {
+		return fmt.Sprintf("CONFIG_%s not set", r.Option)
+	}
+	return fmt.Sprintf("CONFIG_%s=%s, need %s", r.Option, value, strings.Join(r.Values, "|"))
+}
+
+// CheckAll returns the reasons for all the requirements that aren't met.
+func (c Config) CheckAll(reqs []Requirement) []string {
+	var unmet []string
+	for _, req := range reqs {
+		if reason := c.Check(req); reason != "" {
+			unmet = append(unmet, reason)
+		}
+	}
+	return unmet
+}
@@ -0,0 +1,100 @@
+package kconfig
+
+import (
+	"compress/gzip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+const testConfig = `#
+# Automatically generated file; DO NOT EDIT.
+#
+CONFIG_KVM=y
+CONFIG_SCSI_DEBUG=m
+# CONFIG_TEST_VMALLOC is not set
+CONFIG_LOCALVERSION="-test"
+CONFIG_NR_CPUS=64
+`
+
+func TestParse(t *testing.T) {
+	got, err := Parse(strings.NewReader(testConfig))
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	want := Config{"KVM": "y", "SCSI_DEBUG": "m", "LOCALVERSION": "-test", "NR_CPUS": "64"}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("Parse mismatch (-want +got):\n%s", diff)
+	}
+
+	if _, err := Parse(strings.NewReader("garbage\n")); err == nil {
+		t.Errorf("expected an error for a bad line")
+	}
+}
+
+func TestFind(t *testing.T) {
+	dir := t.TempDir()
+	gzPath := filepath.Join(dir, "config.gz")
+	f, err := os.Create(gzPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := gzip.NewWriter(f)
+	w.Write([]byte(testConfig))
+	w.Close()
+	f.Close()
+
+	config, path, err := Find([]string{filepath.Join(dir, "missing"), gzPath})
+	if err != nil {
+		t.Fatalf("Find failed: %v", err)
+	}
+	if path != gzPath || config["KVM"] != "y" {
+		t.Errorf("Find read %v from %s", config, path)
+	}
+
+	if _, _, err := Find([]string{filepath.Join(dir, "missing")}); err == nil {
+		t.Errorf("expected an error when there's no config")
+	}
+}
+
+func TestCheck(t *testing.T) {
+	config, err := Parse(strings.NewReader(testConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	testCases := []struct {
+		req  string
+		want string
+	}{
+		{req: "KVM", want: ""},
+		{req: "CONFIG_KVM=y", want: ""},
+		{req: "SCSI_DEBUG=m", want: ""},
+		{req: "SCSI_DEBUG=y", want: "CONFIG_SCSI_DEBUG=m, need y"},
+		{req: "TEST_VMALLOC=m|y", want: "CONFIG_TEST_VMALLOC not set"},
+		{req: "TEST_VMALLOC=n", want: ""},
+		{req: "KVM=n", want: "CONFIG_KVM=y, need n"},
+		{req: "NR_CPUS=64", want: ""},
+		{req: "LOCALVERSION=-test", want: ""},
+	}
+	for _, tc := range testCases {
+		req, err := ParseRequirement(tc.req)
+		if err != nil {
+			t.Errorf("ParseRequirement(%q) failed: %v", tc.req, err)
+			continue
+		}
+		if got := config.Check(req); got != tc.want {
+			t.Errorf("Check(%q) = %q, want %q", tc.req, got, tc.want)
+		}
+	}
+}
+
+func TestParseRequirementErrors(t *testing.T) {
+	for _, s := range []string{"", "FOO BAR", "FOO=", "FOO=m|"} {
+		if _, err := ParseRequirement(s); err == nil {
+			t.Errorf("ParseRequirement(%q) expected error", s)
+		}
+	}
+}
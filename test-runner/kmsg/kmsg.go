@@ -0,0 +1,170 @@
+// Package kmsg reads the kernel log from /dev/kmsg.
+//
+// Each read() from /dev/kmsg returns exactly one record, formatted as
+// "<prio>,<seq>,<timestamp_us>,<flags>;<message>\n", possibly followed by
+// continuation lines starting with a space, which carry key=value metadata.
+// See Documentation/ABI/testing/dev-kmsg in the kernel tree.
+package kmsg
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+type Record struct {
+	// The syslog priority, i.e. the log level in the bottom 3 bits and the
+	// facility above that.
+	Priority int
+	Seq      uint64
+	// Time since boot.
+	Timestamp time.Duration
+	Message   string
+}
+
+// Level returns the log level, e.g. 4 for KERN_WARNING.
+func (r Record) Level() int {
+	return r.Priority & 7
+}
+
+// String formats the record the same way as dmesg does.
+func (r Record) String() string {
+	return fmt.Sprintf("[%5d.%06d] %s",
+		r.Timestamp/time.Second, (r.Timestamp%time.Second)/time.Microsecond, r.Message)
+}
+
+// ParseRecord parses a single record, without the trailing newline.
+func ParseRecord(line string) (Record, error) {
+	prefix, message, ok := strings.Cut(line, ";")
+	if !ok {
+		return Record{}, fmt.Errorf("no ';' in kmsg record %q", line)
+	}
+	fields := strings.Split(prefix, ",")
+	if len(fields) < 3 {
+		return Record{}, fmt.Errorf("too few fields in kmsg record %q", line)
+	}
+	prio, err := strconv.Atoi(fields[0])
+	if err != nil {
+		return Record{}, fmt.Errorf("bad priority in kmsg record %q: %w", line, err)
+	}
+	seq, err := strconv.ParseUint(fields[1], 10, 64)
+	if err != nil {
+		return Record{}, fmt.Errorf("bad sequence number in kmsg record %q: %w", line, err)
+	}
+	usecs, err := strconv.ParseInt(fields[2], 10, 64)
+	if err != nil {
+		return Record{}, fmt.Errorf("bad timestamp in kmsg record %q: %w", line, err)
+	}
+	return Record{
+		Priority:  prio,
+		Seq:       seq,
+		Timestamp: time.Duration(usecs) * time.Microsecond,
+		Message:   unescape(message),
+	}, nil
+}
+
+// The kernel escapes non-printable characters (and backslash) as \xNN.
+func unescape(s string) string {
+	if !strings.Contains(s, `\x`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) && s[i+1] == 'x' {
+			if v, err := strconv.ParseUint(s[i+2:i+4], 16, 8); err == nil {
+				b.WriteByte(byte(v))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// Reader reads kernel log records that are logged after it's opened.
+//
+// This uses the raw file descriptor instead of an os.File, because os.File
+// would register the non-blocking FD with the Go runtime's poller and then
+// block in Read instead of returning EAGAIN.
+type Reader struct {
+	fd int
+	// Data that's been read but not parsed yet. With /dev/kmsg this is always
+	// empty between calls, since each read returns a whole record.
+	pending []byte
+	// Seq of the last record read, or 0 if there hasn't been one yet.
+	LastSeq uint64
+}
+
+// Open opens the kernel log and skips over everything that's already in it,
+// so that the Reader only returns records logged after this point. The path is
+// normally /dev/kmsg, but it can also be a regular file with one record per
+// line, which is handy for testing.
+func Open(path string) (*Reader, error) {
+	fd, err := syscall.Open(path, syscall.O_RDONLY|syscall.O_NONBLOCK|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: path, Err: err}
+	}
+	if _, err := syscall.Seek(fd, 0, io.SeekEnd); err != nil {
+		syscall.Close(fd)
+		return nil, fmt.Errorf("seeking to end of %s: %w", path, err)
+	}
+	return &Reader{fd: fd}, nil
+}
+
+// ReadAvailable returns all the records that have been logged since the last
+// call (or since Open), without blocking. If the kernel's ring buffer
+// overflowed so that some messages were lost, a placeholder record says so.
+func (r *Reader) ReadAvailable() ([]Record, error) {
+	var records []Record
+	// Records can be up to about 8KiB, if the buffer is smaller than the
+	// record, the read fails with EINVAL.
+	buf := make([]byte, 16*1024)
+	for {
+		n, err := syscall.Read(r.fd, buf)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err == syscall.EPIPE {
+			// The kernel overwrote records we hadn't read yet. The next read
+			// continues from the oldest one that's still there.
+			records = append(records, Record{Seq: r.LastSeq, Message: "[test-runner: kernel log messages were lost]"})
+			continue
+		}
+		if err == syscall.EAGAIN || (err == nil && n == 0) {
+			// No more records for now.
+			return records, nil
+		}
+		if err != nil {
+			return records, fmt.Errorf("reading kernel log: %w", err)
+		}
+		r.pending = append(r.pending, buf[:n]...)
+		for {
+			i := bytes.IndexByte(r.pending, '\n')
+			if i < 0 {
+				break
+			}
+			line := string(r.pending[:i])
+			r.pending = r.pending[i+1:]
+			if line == "" || line[0] == ' ' {
+				// Continuation line with metadata.
+				continue
+			}
+			record, err := ParseRecord(line)
+			if err != nil {
+				return records, err
+			}
+			r.LastSeq = record.Seq
+			records = append(records, record)
+		}
+	}
+}
+
+func (r *Reader) Close() error {
+	return syscall.Close(r.fd)
+}
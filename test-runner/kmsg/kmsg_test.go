@@ -0,0 +1,106 @@
+package kmsg
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestParseRecord(t *testing.T) {
+	testCases := []struct {
+		name    string
+		line    string
+		want    Record
+		wantErr bool
+	}{
+		{
+			name: "simple",
+			line: "6,339,5140900,-;NET: Registered protocol family 10",
+			want: Record{Priority: 6, Seq: 339, Timestamp: 5140900 * time.Microsecond, Message: "NET: Registered protocol family 10"},
+		},
+		{
+			name: "extra fields and escapes",
+			line: `4,1000,1234567,c,more;tab\x09here \x5c done`,
+			want: Record{Priority: 4, Seq: 1000, Timestamp: 1234567 * time.Microsecond, Message: "tab\there \\ done"},
+		},
+		{
+			name:    "no message",
+			line:    "6,339,5140900,-",
+			wantErr: true,
+		},
+		{
+			name:    "bad seq",
+			line:    "6,foo,5140900,-;hello",
+			wantErr: true,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := ParseRecord(tc.line)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("expected error, got %+v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("ParseRecord() mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestRecordString(t *testing.T) {
+	r := Record{Timestamp: 12345678 * time.Microsecond, Message: "hello"}
+	if got, want := r.String(), "[   12.345678] hello"; got != want {
+		t.Errorf("String() = %q, want %q", got, want)
+	}
+}
+
+func TestReader(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kmsg")
+	if err := os.WriteFile(path, []byte("6,1,100,-;before open\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := Open(path)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer r.Close()
+
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	f.WriteString("6,2,200,-;first\n SUBSYSTEM=foo\n4,3,300,-;sec")
+
+	records, err := r.ReadAvailable()
+	if err != nil {
+		t.Fatalf("ReadAvailable failed: %v", err)
+	}
+	want := []Record{{Priority: 6, Seq: 2, Timestamp: 200 * time.Microsecond, Message: "first"}}
+	if diff := cmp.Diff(want, records); diff != "" {
+		t.Errorf("first ReadAvailable() mismatch (-want +got):\n%s", diff)
+	}
+
+	f.WriteString("ond\n")
+	records, err = r.ReadAvailable()
+	if err != nil {
+		t.Fatalf("ReadAvailable failed: %v", err)
+	}
+	want = []Record{{Priority: 4, Seq: 3, Timestamp: 300 * time.Microsecond, Message: "second"}}
+	if diff := cmp.Diff(want, records); diff != "" {
+		t.Errorf("second ReadAvailable() mismatch (-want +got):\n%s", diff)
+	}
+	if r.LastSeq != 3 {
+		t.Errorf("LastSeq = %d, want 3", r.LastSeq)
+	}
+}
@@ -0,0 +1,105 @@
+package kmsg
+
+import (
+	"regexp"
+	"strings"
+)
+
+// Splat is a report of a kernel bug found in the log: a WARN, BUG, oops,
+// sanitizer report and so on.
+type Splat struct {
+	// Category of the report: "WARNING", "BUG", "Oops", "KASAN", "UBSAN",
+	// "lockdep" or "RCU stall".
+	Kind string
+	// The line that identified the report, e.g. "BUG: KASAN: slab-out-of-bounds
+	// in foo+0x12/0x34".
+	Title string
+	// The whole report, including the stack trace and so on.
+	Records []Record
+}
+
+// String returns the full report, formatted like dmesg.
+func (s Splat) String() string {
+	var lines []string
+	for _, r := range s.Records {
+		lines = append(lines, r.String())
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Order matters, the first match wins, so more specific patterns come first.
+var splatHeaders = []struct {
+	kind string
+	re   *regexp.Regexp
+}{
+	{"KASAN", regexp.MustCompile(`^BUG: KASAN: `)},
+	{"UBSAN", regexp.MustCompile(`^UBSAN: `)},
+	{"lockdep", regexp.MustCompile(`^WARNING: (possible circular locking dependency|possible recursive locking|inconsistent lock state|possible irq lock inversion|bad unlock balance|held lock freed|lock held when returning to user space|suspicious RCU usage|Nested lock was not taken)`)},
+	{"RCU stall", regexp.MustCompile(`^(rcu: )?INFO: rcu_\w+ (self-)?detected (expedited )?stalls?`)},
+	{"WARNING", regexp.MustCompile(`^WARNING: `)},
+	{"BUG", regexp.MustCompile(`^(BUG: |kernel BUG at )`)},
+	{"Oops", regexp.MustCompile(`^(Oops|Internal error: Oops|general protection fault|Unable to handle kernel )`)},
+}
+
+var (
+	// These come just before a header and are part of the same report.
+	preambleRe = regexp.MustCompile(`^(-+\[ cut here \]-+|=+)$`)
+	// These end a report, and are part of it.
+	endRe = regexp.MustCompile(`^(---\[ end trace [0-9a-f]+ \]---|---\[ end Kernel panic|=+$)`)
+)
+
+// Reports that don't have an end marker (and there are plenty of them) get cut
+// off after this many records.
+const maxSplatRecords = 200
+
+func splatKind(message string) string {
+	for _, h := range splatHeaders {
+		if h.re.MatchString(message) {
+			return h.kind
+		}
+	}
+	return ""
+}
+
+// FindSplats finds the kernel bug reports in a sequence of log records. Each
+// report extends from its header to an end marker, the next report's header,
+// or maxSplatRecords, whichever comes first.
+func FindSplats(records []Record) []Splat {
+	var splats []Splat
+	// Index after the end of the last splat, so they don't overlap.
+	prevEnd := 0
+	for i := 0; i < len(records); i++ {
+		kind := splatKind(records[i].Message)
+		if kind == "" {
+			continue
+		}
+		start := i
+		if start > prevEnd && preambleRe.MatchString(records[start-1].Message) {
+			start--
+		}
+		end := i + 1
+		for end < len(records) && end-start < maxSplatRecords {
+			msg := records[end].Message
+			// x86 reports a bad page fault as "BUG: ..." followed by "Oops: ...",
+			// that's all one report.
+			if k := splatKind(msg); k != "" && !(kind == "BUG" && k == "Oops") {
+				break
+			}
+			if preambleRe.MatchString(msg) && !endRe.MatchString(msg) {
+				break
+			}
+			end++
+			if endRe.MatchString(msg) {
+				break
+			}
+		}
+		splats = append(splats, Splat{
+			Kind:    kind,
+			Title:   records[i].Message,
+			Records: records[start:end],
+		})
+		i = end - 1
+		prevEnd = end
+	}
+	return splats
+}
@@ -0,0 +1,158 @@
+package kmsg
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func records(messages ...string) []Record {
+	var rs []Record
+	for i, m := range messages {
+		rs = append(rs, Record{Seq: uint64(i), Message: m})
+	}
+	return rs
+}
+
+func TestFindSplats(t *testing.T) {
+	type splat struct {
+		Kind     string
+		Title    string
+		Messages []string
+	}
+	testCases := []struct {
+		name string
+		log  []string
+		want []splat
+	}{
+		{
+			name: "nothing",
+			log:  []string{"hello", "world"},
+			want: nil,
+		},
+		{
+			name: "warning",
+			log: []string{
+				"unrelated",
+				"------------[ cut here ]------------",
+				"WARNING: CPU: 0 PID: 1 at mm/foo.c:12 foo+0x1/0x2",
+				"Call Trace:",
+				"---[ end trace 0000000000000000 ]---",
+				"unrelated again",
+			},
+			want: []splat{{
+				Kind:  "WARNING",
+				Title: "WARNING: CPU: 0 PID: 1 at mm/foo.c:12 foo+0x1/0x2",
+				Messages: []string{
+					"------------[ cut here ]------------",
+					"WARNING: CPU: 0 PID: 1 at mm/foo.c:12 foo+0x1/0x2",
+					"Call Trace:",
+					"---[ end trace 0000000000000000 ]---",
+				},
+			}},
+		},
+		{
+			name: "kasan",
+			log: []string{
+				"==================================================================",
+				"BUG: KASAN: slab-out-of-bounds in foo+0x12/0x34",
+				"Read of size 8",
+				"==================================================================",
+				"after",
+			},
+			want: []splat{{
+				Kind:  "KASAN",
+				Title: "BUG: KASAN: slab-out-of-bounds in foo+0x12/0x34",
+				Messages: []string{
+					"==================================================================",
+					"BUG: KASAN: slab-out-of-bounds in foo+0x12/0x34",
+					"Read of size 8",
+					"==================================================================",
+				},
+			}},
+		},
+		{
+			name: "null deref is one report",
+			log: []string{
+				"BUG: kernel NULL pointer dereference, address: 0000000000000000",
+				"#PF: supervisor write access in kernel mode",
+				"Oops: 0002 [#1] PREEMPT SMP",
+				"---[ end trace 0000000000000000 ]---",
+			},
+			want: []splat{{
+				Kind:  "BUG",
+				Title: "BUG: kernel NULL pointer dereference, address: 0000000000000000",
+				Messages: []string{
+					"BUG: kernel NULL pointer dereference, address: 0000000000000000",
+					"#PF: supervisor write access in kernel mode",
+					"Oops: 0002 [#1] PREEMPT SMP",
+					"---[ end trace 0000000000000000 ]---",
+				},
+			}},
+		},
+		{
+			name: "lockdep then rcu stall",
+			log: []string{
+				"WARNING: possible circular locking dependency detected",
+				"6.18.0 #1 Not tainted",
+				"rcu: INFO: rcu_preempt detected stalls on CPUs/tasks:",
+				"rcu: 	1-...!: (0 ticks this GP)",
+			},
+			want: []splat{
+				{
+					Kind:     "lockdep",
+					Title:    "WARNING: possible circular locking dependency detected",
+					Messages: []string{"WARNING: possible circular locking dependency detected", "6.18.0 #1 Not tainted"},
+				},
+				{
+					Kind:     "RCU stall",
+					Title:    "rcu: INFO: rcu_preempt detected stalls on CPUs/tasks:",
+					Messages: []string{"rcu: INFO: rcu_preempt detected stalls on CPUs/tasks:", "rcu: 	1-...!: (0 ticks this GP)"},
+				},
+			},
+		},
+		{
+			name: "ubsan",
+			log: []string{
+				"UBSAN: array-index-out-of-bounds in drivers/foo.c:42:7",
+				"index 8 is out of range for type 'int [8]'",
+			},
+			want: []splat{{
+				Kind:  "UBSAN",
+				Title: "UBSAN: array-index-out-of-bounds in drivers/foo.c:42:7",
+				Messages: []string{
+					"UBSAN: array-index-out-of-bounds in drivers/foo.c:42:7",
+					"index 8 is out of range for type 'int [8]'",
+				},
+			}},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var got []splat
+			for _, s := range FindSplats(records(tc.log...)) {
+				var messages []string
+				for _, r := range s.Records {
+					messages = append(messages, r.Message)
+				}
+				got = append(got, splat{Kind: s.Kind, Title: s.Title, Messages: messages})
+			}
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("FindSplats() mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestFindSplatsLimit(t *testing.T) {
+	log := []string{"WARNING: CPU: 0 PID: 1 at foo"}
+	for i := 0; i < 2*maxSplatRecords; i++ {
+		log = append(log, strings.Repeat("x", 10))
+	}
+	splats := FindSplats(records(log...))
+	if len(splats) != 1 || len(splats[0].Records) != maxSplatRecords {
+		t.Errorf("expected one splat with %d records, got %d splats", maxSplatRecords, len(splats))
+	}
+}
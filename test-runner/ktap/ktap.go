@@ -0,0 +1,267 @@
+// Package ktap parses KTAP (and the TAP 13 dialect that kselftest uses) out of
+// test output, to find out about the subtests inside a test.
+//
+// Nesting is supported in both the styles seen in the wild: KTAP's 4-space
+// indentation, and the "# " prefix that kselftest's runner.sh puts in front of
+// each test's output. A nested block only starts at a version or plan line, so
+// random output that happens to start with "# " isn't mistaken for nesting.
+package ktap
+
+import (
+	"bytes"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+type Status string
+
+const (
+	Pass Status = "ok"
+	Fail Status = "not ok"
+	// "ok" or "not ok" with a SKIP directive.
+	Skip Status = "skip"
+	// "not ok" with a TODO or XFAIL directive, i.e. an expected failure.
+	Todo Status = "todo"
+)
+
+// Keep memory bounded if a test spews loads of output.
+const (
+	maxDiagnostics = 200
+	// Lines longer than this are cut short.
+	maxLineLength = 4096
+)
+
+// Result is a single "ok"/"not ok" line, plus whatever was nested under it.
+type Result struct {
+	Number int
+	Name   string
+	Status Status
+	// Text after the SKIP/TODO directive, if there was one.
+	Reason string
+	// Diagnostic and other non-KTAP lines that preceded the result, with the
+	// "# " prefix removed. Only the last maxDiagnostics lines are kept.
+	Diagnostics []string
+	Subtests    []*Result
+}
+
+// Leaves returns the results that don't have subtests, i.e. the ones that
+// actually represent individual test cases, in order.
+func Leaves(results []*Result) []*Result {
+	var leaves []*Result
+	for _, r := range results {
+		if len(r.Subtests) == 0 {
+			leaves = append(leaves, r)
+		} else {
+			leaves = append(leaves, Leaves(r.Subtests)...)
+		}
+	}
+	return leaves
+}
+
+// CountFailed returns the number of leaf results that failed, and the total
+// number of leaf results.
+func CountFailed(results []*Result) (failed int, total int) {
+	for _, r := range Leaves(results) {
+		total++
+		if r.Status == Fail {
+			failed++
+		}
+	}
+	return failed, total
+}
+
+var (
+	versionRe = regexp.MustCompile(`^(KTAP|TAP) version \d+`)
+	planRe    = regexp.MustCompile(`^1\.\.\d+`)
+	resultRe  = regexp.MustCompile(`^(ok|not ok) (\d+)(?: -)? ?(.*)$`)
+)
+
+// splitDirective splits the description from a result line into the name and
+// the directive (SKIP, TODO, XFAIL) that comes after an unescaped #, if any.
+// Anything else after the # is a comment, which isn't part of the name.
+func splitDirective(desc string) (name string, directive string, reason string) {
+	for i := 0; i < len(desc); i++ {
+		if desc[i] != '#' || (i > 0 && desc[i-1] == '\\') {
+			continue
+		}
+		word, rest, _ := strings.Cut(strings.TrimSpace(desc[i+1:]), " ")
+		switch strings.ToUpper(word) {
+		case "SKIP", "TODO", "XFAIL":
+			return strings.TrimSpace(desc[:i]), strings.ToUpper(word), strings.TrimSpace(rest)
+		}
+		return strings.TrimSpace(desc[:i]), "", ""
+	}
+	return desc, "", ""
+}
+
+// block is a sequence of results at one level of nesting.
+type block struct {
+	results []*Result
+	// Lines since the last result at this level.
+	diagnostics []string
+}
+
+func (b *block) addDiagnostic(line string) {
+	b.diagnostics = append(b.diagnostics, line)
+	if len(b.diagnostics) > maxDiagnostics {
+		b.diagnostics = b.diagnostics[len(b.diagnostics)-maxDiagnostics:]
+	}
+}
+
+// Parser is an io.Writer that parses the KTAP written to it. Call Finish once
+// all the output has been written to get the results.
+type Parser struct {
+	// The line being written so far, up to maxLineLength.
+	partial []byte
+	// stack[0] is the top level, the last entry is the innermost nesting
+	// level that is currently open.
+	stack []*block
+}
+
+func NewParser() *Parser {
+	return &Parser{stack: []*block{{}}}
+}
+
+func (p *Parser) Write(b []byte) (int, error) {
+	n := len(b)
+	for {
+		i := bytes.IndexByte(b, '\n')
+		if i < 0 {
+			break
+		}
+		p.appendPartial(b[:i])
+		p.parseLine(string(p.partial))
+		p.partial = p.partial[:0]
+		b = b[i+1:]
+	}
+	p.appendPartial(b)
+	return n, nil
+}
+
+func (p *Parser) appendPartial(b []byte) {
+	room := maxLineLength - len(p.partial)
+	p.partial = append(p.partial, b[:min(len(b), room)]...)
+}
+
+// Finish returns the top-level results. Any results nested under a parent
+// that never got its own result line are reported at the top level.
+func (p *Parser) Finish() []*Result {
+	if len(p.partial) > 0 {
+		p.parseLine(string(p.partial))
+		p.partial = nil
+	}
+	for len(p.stack) > 1 {
+		inner := p.stack[len(p.stack)-1]
+		p.stack = p.stack[:len(p.stack)-1]
+		outer := p.stack[len(p.stack)-1]
+		outer.results = append(outer.results, inner.results...)
+	}
+	return p.stack[0].results
+}
+
+// stripNesting removes one level of nesting prefix, if present.
+func stripNesting(line string) (string, bool) {
+	if strings.HasPrefix(line, "    ") {
+		return line[4:], true
+	}
+	if strings.HasPrefix(line, "# ") {
+		return line[2:], true
+	}
+	if line == "#" {
+		return "", true
+	}
+	return line, false
+}
+
+func isStructural(line string) bool {
+	return versionRe.MatchString(line) || planRe.MatchString(line) || resultRe.MatchString(line)
+}
+
+func (p *Parser) parseLine(line string) {
+	line = strings.TrimRight(line, "\r")
+
+	// Strip prefixes for the levels that are already open.
+	depth := 0
+	rest := line
+	for depth < len(p.stack)-1 {
+		stripped, ok := stripNesting(rest)
+		if !ok {
+			break
+		}
+		rest = stripped
+		depth++
+	}
+	// A further level only opens at a version or plan line.
+	if depth == len(p.stack)-1 {
+		if stripped, ok := stripNesting(rest); ok && (versionRe.MatchString(stripped) || planRe.MatchString(stripped)) {
+			p.stack = append(p.stack, &block{})
+			rest = stripped
+			depth++
+		}
+	}
+
+	if !isStructural(rest) {
+		// Diagnostic or random output. Attribute it to the innermost open
+		// level, even if it's indented less, tests don't always prefix their
+		// output properly.
+		inner := p.stack[len(p.stack)-1]
+		if d, ok := strings.CutPrefix(rest, "# "); ok {
+			rest = d
+		}
+		inner.addDiagnostic(rest)
+		return
+	}
+
+	// Structural lines at a shallower depth close the deeper levels. If it's
+	// a result, the results from the level just below it are its subtests.
+	var subBlock *block
+	for len(p.stack)-1 > depth {
+		inner := p.stack[len(p.stack)-1]
+		p.stack = p.stack[:len(p.stack)-1]
+		if subBlock != nil {
+			// Parent never reported a result, flatten.
+			inner.results = append(inner.results, subBlock.results...)
+		}
+		subBlock = inner
+	}
+	cur := p.stack[depth]
+
+	m := resultRe.FindStringSubmatch(rest)
+	if m == nil {
+		// Version or plan line.
+		if subBlock != nil {
+			cur.results = append(cur.results, subBlock.results...)
+		}
+		return
+	}
+
+	number, _ := strconv.Atoi(m[2])
+	name, directive, reason := splitDirective(m[3])
+	result := &Result{
+		Number: number,
+		Name:   name,
+		Status: Pass,
+		Reason: reason,
+	}
+	if m[1] == "not ok" {
+		result.Status = Fail
+	}
+	switch directive {
+	case "SKIP":
+		result.Status = Skip
+	case "TODO", "XFAIL":
+		if result.Status == Fail {
+			result.Status = Todo
+		}
+	}
+	result.Diagnostics = cur.diagnostics
+	cur.diagnostics = nil
+	if subBlock != nil {
+		result.Subtests = subBlock.results
+		if len(subBlock.diagnostics) > 0 {
+			result.Diagnostics = append(result.Diagnostics, subBlock.diagnostics...)
+		}
+	}
+	cur.results = append(cur.results, result)
+}
@@ -0,0 +1,155 @@
+package ktap
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestParser(t *testing.T) {
+	testCases := []struct {
+		name   string
+		output string
+		want   []*Result
+	}{
+		{
+			name: "flat",
+			output: `KTAP version 1
+1..4
+ok 1 first
+not ok 2 - second
+ok 3 third # SKIP no hardware
+not ok 4 fourth # TODO not implemented
+`,
+			want: []*Result{
+				{Number: 1, Name: "first", Status: Pass},
+				{Number: 2, Name: "second", Status: Fail},
+				{Number: 3, Name: "third", Status: Skip, Reason: "no hardware"},
+				{Number: 4, Name: "fourth", Status: Todo, Reason: "not implemented"},
+			},
+		},
+		{
+			name: "diagnostics",
+			output: `TAP version 13
+1..2
+# RUN foo
+# OK foo
+ok 1 foo
+random output
+ok 2 bar \# not a directive
+`,
+			want: []*Result{
+				{Number: 1, Name: "foo", Status: Pass, Diagnostics: []string{"RUN foo", "OK foo"}},
+				{Number: 2, Name: `bar \# not a directive`, Status: Pass, Diagnostics: []string{"random output"}},
+			},
+		},
+		{
+			name: "indented nesting",
+			output: `KTAP version 1
+1..2
+    KTAP version 1
+    1..2
+    ok 1 sub1
+    not ok 2 sub2
+not ok 1 parent
+ok 2 other
+`,
+			want: []*Result{
+				{
+					Number: 1, Name: "parent", Status: Fail,
+					Subtests: []*Result{
+						{Number: 1, Name: "sub1", Status: Pass},
+						{Number: 2, Name: "sub2", Status: Fail},
+					},
+				},
+				{Number: 2, Name: "other", Status: Pass},
+			},
+		},
+		{
+			name: "kselftest runner nesting",
+			output: `TAP version 13
+1..1
+# timeout set to 45
+# selftests: mm: run_vmtests.sh
+# TAP version 13
+# 1..2
+# # running ./hugepage-mmap
+# ok 1 hugepage-mmap
+# not ok 2 hugepage-shm
+# # Totals: pass:1 fail:1 xfail:0 xpass:0 skip:0 error:0
+not ok 1 selftests: mm: run_vmtests.sh # exit=1
+`,
+			want: []*Result{
+				{
+					Number: 1, Name: "selftests: mm: run_vmtests.sh", Status: Fail,
+					Diagnostics: []string{
+						"timeout set to 45",
+						"selftests: mm: run_vmtests.sh",
+						"Totals: pass:1 fail:1 xfail:0 xpass:0 skip:0 error:0",
+					},
+					Subtests: []*Result{
+						{Number: 1, Name: "hugepage-mmap", Status: Pass, Diagnostics: []string{"running ./hugepage-mmap"}},
+						{Number: 2, Name: "hugepage-shm", Status: Fail},
+					},
+				},
+			},
+		},
+		{
+			name: "unterminated nesting",
+			output: `TAP version 13
+1..1
+# TAP version 13
+# 1..2
+# ok 1 sub1`,
+			want: []*Result{
+				{Number: 1, Name: "sub1", Status: Pass},
+			},
+		},
+		{
+			name:   "long line",
+			output: "ok 1 " + strings.Repeat("x", 2*maxLineLength) + "\nok 2 short\n",
+			want: []*Result{
+				{Number: 1, Name: strings.Repeat("x", maxLineLength-len("ok 1 ")), Status: Pass},
+				{Number: 2, Name: "short", Status: Pass},
+			},
+		},
+		{
+			name:   "not ktap",
+			output: "hello\nworld\n",
+			want:   nil,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			p := NewParser()
+			// Write in small chunks to check lines split across writes work.
+			for i := 0; i < len(tc.output); i += 7 {
+				end := min(i+7, len(tc.output))
+				if _, err := p.Write([]byte(tc.output[i:end])); err != nil {
+					t.Fatalf("Write failed: %v", err)
+				}
+			}
+			if diff := cmp.Diff(tc.want, p.Finish()); diff != "" {
+				t.Errorf("Parse mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestCountFailed(t *testing.T) {
+	results := []*Result{
+		{Status: Fail, Subtests: []*Result{
+			{Status: Pass},
+			{Status: Fail},
+			{Status: Skip},
+		}},
+		{Status: Fail},
+		{Status: Todo},
+	}
+	failed, total := CountFailed(results)
+	if failed != 2 || total != 5 {
+		t.Errorf("CountFailed() = %d, %d, want 2, 5", failed, total)
+	}
+}
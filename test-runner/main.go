@@ -9,11 +9,22 @@ import (
 	"os"
 	"path/filepath"
 	"sort"
+	"strconv"
 	"strings"
+	"time"
 
+	"test-runner/compare"
 	"test-runner/junit"
+	"test-runner/kconfig"
+	"test-runner/ktap"
+	"test-runner/merge"
 	"test-runner/runner"
 	"test-runner/search"
+	"test-runner/selector"
+	"test-runner/stream"
+	"test-runner/sysinfo"
+	"test-runner/tagexpr"
+	"test-runner/taint"
 	"test-runner/test_conf"
 )
 
@@ -31,22 +42,81 @@ func (s *stringSliceFlag) Set(value string) error {
 	return nil
 }
 
+// retryTagFlag implements flag.Value for collecting --retry-tag tag=N values.
+type retryTagFlag map[string]int
+
+func (r retryTagFlag) String() string {
+	var parts []string
+	for tag, n := range r {
+		parts = append(parts, fmt.Sprintf("%s=%d", tag, n))
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, ",")
+}
+
+func (r retryTagFlag) Set(value string) error {
+	tag, count, ok := strings.Cut(value, "=")
+	if !ok || tag == "" {
+		return fmt.Errorf("expected <tag>=<retries>, got %q", value)
+	}
+	n, err := strconv.Atoi(count)
+	if err != nil || n < 0 {
+		return fmt.Errorf("invalid retry count in %q", value)
+	}
+	r[tag] = n
+	return nil
+}
+
 var (
 	testConfigFile string
 	skipTagsFlag   stringSliceFlag
 	includeBadFlag stringSliceFlag
+	tagsFlag       string
+	excludeFlag    stringSliceFlag
+	testsFrom      string
+	profile        string
 	bailOnFailure  bool
 	logDir         string
 	junitXMLPath   string
+	junitMaxLog    int64 = junit.DefaultMaxLogBytes
+	resultsJSON    string
+	defaultTimeout time.Duration
+	jobs           = 1
+	retryTagsFlag  = retryTagFlag{}
+	kmsgPath       = "/dev/kmsg"
+	kernelErrors   = string(runner.KernelErrorsFail)
+	taintedPath    = taint.DefaultPath
+	onTaint        = string(runner.TaintMark)
+	taintLetters   = runner.DefaultTaintMask.String()
+	resultsStream  string
+	kconfigPath    = "auto"
+	sysinfoRoot    = "/"
 )
 
 func registerGlobalFlags(fs *flag.FlagSet) {
 	fs.StringVar(&testConfigFile, "test-config", testConfigFile, "Path to a JSON file with test definitions")
 	fs.Var(&skipTagsFlag, "skip-tag", "Skip tests with this tag (repeatable)")
 	fs.Var(&includeBadFlag, "include-bad", "Include tests with this bad tag (repeatable)")
+	fs.StringVar(&tagsFlag, "tags", tagsFlag, "Only run tests whose tags match this expression, like 'kvm && !slow'")
+	fs.StringVar(&profile, "profile", profile, "Only run the tests selected by this profile from the config")
+	fs.Var(&excludeFlag, "exclude", "Don't run the tests this selector matches, like a selector starting with ! (repeatable)")
+	fs.StringVar(&testsFrom, "tests-from", testsFrom, "Read more selectors from this file, one per line")
 	fs.BoolVar(&bailOnFailure, "bail-on-failure", bailOnFailure, "Stop running tests after the first failure")
 	fs.StringVar(&logDir, "log-dir", logDir, "Path to a directory to store test logs")
 	fs.StringVar(&junitXMLPath, "junit-xml", junitXMLPath, "Path to write a JUnit XML report")
+	fs.Int64Var(&junitMaxLog, "junit-max-log-bytes", junitMaxLog, "How much of each test log to put in the JUnit report, keeping the head and tail (0 means all of it)")
+	fs.StringVar(&resultsJSON, "results-json", resultsJSON, "Path to write the results as JSON, for scripts and 'test-runner report'")
+	fs.Var(retryTagsFlag, "retry-tag", "Retry failing tests with a tag, as <tag>=<retries> (repeatable)")
+	fs.StringVar(&kmsgPath, "kmsg", kmsgPath, "Where to capture the kernel log from, empty to disable")
+	fs.StringVar(&kernelErrors, "kernel-errors", kernelErrors, "What to do about kernel bug reports (WARN, KASAN, etc) during a test: fail, warn or ignore")
+	fs.StringVar(&taintedPath, "tainted", taintedPath, "Where to read the kernel taint flags from, empty to disable")
+	fs.StringVar(&onTaint, "on-taint", onTaint, "What to do when a test taints the kernel with one of --taint-letters: mark, fail or abort")
+	fs.StringVar(&taintLetters, "taint-letters", taintLetters, "Taint flags that trigger the --on-taint policy, as letters like in dmesg")
+	fs.StringVar(&resultsStream, "results-stream", resultsStream, "Send results as they happen to a 'test-runner listen', at unix:<path> or vsock:<cid>:<port>")
+	fs.IntVar(&jobs, "jobs", jobs, "Number of tests to run in parallel")
+	fs.DurationVar(&defaultTimeout, "default-timeout", defaultTimeout, "Timeout for tests that don't set one in the config (0 means none)")
+	fs.StringVar(&kconfigPath, "kconfig", kconfigPath, "Kernel config to check requires_kconfig against, 'auto' for /proc/config.gz or /boot/config-$(uname -r), empty to not check")
+	fs.StringVar(&sysinfoRoot, "sysinfo-root", sysinfoRoot, "Where to find the /proc and /sys that requires and conditional tags get checked against, empty to not check")
 }
 
 func parseKselftestList(filePath string) error {
@@ -67,14 +137,6 @@ func parseKselftestList(filePath string) error {
 		if !ok {
 			return fmt.Errorf("can't parse suite:name line from %s: %q", filePath, line)
 		}
-		// Hack: The test config is a flat array, with nesting denoted as
-		// suite.test.subtest or whatever. But, when exporting XML we want to
-		// actually expose the nesting structure. So '.' is actualylly a special
-		// character. So, just munge it away if it appears in the kselftest test
-		// name.
-		// The proper approach here would actually just be to have the TestConf
-		// have a proper recursive structure at runtime like the JSON has.
-		testName = strings.Replace(testName, ".", "_", -1)
 		if _, ok := tests[suiteName]; !ok {
 			tests[suiteName] = make(map[string]*test_conf.Test)
 		}
@@ -84,8 +146,9 @@ func parseKselftestList(filePath string) error {
 				suiteName, testName, suiteName, testName)
 		}
 		suite[testName] = &test_conf.Test{
-			IsTest:  true,
-			Command: []string{"run_kselftest.sh", "-t", line},
+			IsTest:    true,
+			Command:   []string{"run_kselftest.sh", "-t", line},
+			ExitCodes: test_conf.KselftestExitCodes,
 		}
 	}
 
@@ -101,11 +164,55 @@ func parseKselftestList(filePath string) error {
 	return nil
 }
 
+// mergeConfig prints the overlay config merged onto the base one. Overlay
+// nodes that don't match anything in the base are errors, or just warnings if
+// allowStale is set.
+func mergeConfig(basePath, overlayPath, baseKey string, allowStale bool) error {
+	base, err := test_conf.ReadConfigJSON(basePath)
+	if err != nil {
+		return err
+	}
+	if baseKey != "" {
+		base = test_conf.NestConfig(base, baseKey)
+	}
+	overlay, err := test_conf.ReadConfigJSON(overlayPath)
+	if err != nil {
+		return err
+	}
+	stale, err := test_conf.MergeConfigs(base, overlay)
+	if err != nil {
+		return fmt.Errorf("merging %s onto %s: %w", overlayPath, basePath, err)
+	}
+	for _, node := range stale {
+		fmt.Fprintf(os.Stderr, "Warning: %s: %v\n", overlayPath, node)
+	}
+	if len(stale) != 0 && !allowStale {
+		return fmt.Errorf("%d nodes in %s don't match anything in %s", len(stale), overlayPath, basePath)
+	}
+
+	out, err := json.MarshalIndent(base, "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshaling to json: %w", err)
+	}
+	fmt.Println(string(out))
+	return nil
+}
+
 func doRun(testIdentifiers []string) error {
 	if testConfigFile == "" {
 		return fmt.Errorf("--test-config flag is required")
 	}
 
+	if testsFrom != "" {
+		fromFile, err := selector.ReadFile(testsFrom)
+		if err != nil {
+			return fmt.Errorf("reading --tests-from: %w", err)
+		}
+		testIdentifiers = append(testIdentifiers, fromFile...)
+	}
+	for _, pattern := range excludeFlag {
+		testIdentifiers = append(testIdentifiers, "!"+pattern)
+	}
 	if len(testIdentifiers) == 0 {
 		return fmt.Errorf("at least one test identifier is required")
 	}
@@ -115,6 +222,110 @@ func doRun(testIdentifiers []string) error {
 		return fmt.Errorf("parsing test config: %v", err)
 	}
 
+	var selectors []*selector.Selector
+	for _, pattern := range testIdentifiers {
+		sel, err := selector.Parse(pattern)
+		if err != nil {
+			return err
+		}
+		selectors = append(selectors, sel)
+	}
+	var keys []string
+	for k := range conf.Tests {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	selected := selector.Select(selectors, keys)
+	for _, sel := range selected.Unmatched {
+		if sel.Exclude {
+			fmt.Fprintf(os.Stderr, "Warning: exclusion %s doesn't match any tests\n", sel)
+			continue
+		}
+		errMsg := fmt.Sprintf("no tests match pattern: %s", sel)
+		if bestMatch, ok := search.FindClosestTest(sel.String(), keys); ok {
+			errMsg += fmt.Sprintf("\nDid you mean '%s'?", bestMatch)
+		}
+		return fmt.Errorf(errMsg)
+	}
+	if len(selected.TestIDs) == 0 {
+		return fmt.Errorf("all the tests are excluded")
+	}
+	requestedTests := make(map[string]test_conf.Test)
+	for _, testID := range selected.TestIDs {
+		requestedTests[testID] = conf.Tests[testID]
+	}
+
+	opts, err := runOptions(conf)
+	if err != nil {
+		return err
+	}
+	opts.RequestedTests = requestedTests
+	if logDir != "" {
+		if err := os.MkdirAll(logDir, 0755); err != nil {
+			return fmt.Errorf("creating log directory: %w", err)
+		}
+		var testIDs []string
+		for testID := range requestedTests {
+			testIDs = append(testIDs, testID)
+		}
+		journal, err := runner.CreateJournal(filepath.Join(logDir, runner.JournalFileName), testIDs)
+		if err != nil {
+			return err
+		}
+		defer journal.Close()
+		opts.Journal = journal
+	}
+	if resultsStream != "" {
+		var testIDs []string
+		for testID := range requestedTests {
+			testIDs = append(testIDs, testID)
+		}
+		streamJournal, err := runner.DialStream(resultsStream, testIDs)
+		if err != nil {
+			return err
+		}
+		defer streamJournal.Close()
+		opts.Stream = streamJournal
+	}
+
+	runResults, testErr := runner.RunTests(opts)
+	if err := runEnded(opts); err != nil && testErr == nil {
+		testErr = err
+	}
+	return reportResults(runResults, runner.CurrentHost(), testErr)
+}
+
+func runEnded(opts *runner.RunOptions) error {
+	for _, j := range []*runner.Journal{opts.Journal, opts.Stream} {
+		if j == nil {
+			continue
+		}
+		if err := j.RunEnded(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runOptions turns the flags into RunOptions, except for the tests to run.
+func runOptions(conf *test_conf.TestConf) (*runner.RunOptions, error) {
+	kernelErrorPolicy := runner.KernelErrorPolicy(kernelErrors)
+	switch kernelErrorPolicy {
+	case runner.KernelErrorsFail, runner.KernelErrorsWarn, runner.KernelErrorsIgnore:
+	default:
+		return nil, fmt.Errorf("invalid --kernel-errors %q, must be fail, warn or ignore", kernelErrors)
+	}
+	taintPolicy := runner.TaintPolicy(onTaint)
+	switch taintPolicy {
+	case runner.TaintMark, runner.TaintFail, runner.TaintAbort:
+	default:
+		return nil, fmt.Errorf("invalid --on-taint %q, must be mark, fail or abort", onTaint)
+	}
+	taintMask, err := taint.FromLetters(taintLetters)
+	if err != nil {
+		return nil, fmt.Errorf("invalid --taint-letters: %w", err)
+	}
+
 	skipTags := make(map[string]bool)
 	for _, tag := range skipTagsFlag {
 		skipTags[tag] = true
@@ -127,47 +338,123 @@ func doRun(testIdentifiers []string) error {
 	for _, tag := range conf.BadTags {
 		badTags[tag] = true
 	}
-
-	requestedTests := make(map[string]test_conf.Test)
-	for _, pattern := range testIdentifiers {
-		matched := false
-		for testID, test := range conf.Tests {
-			match, err := filepath.Match(pattern, testID)
-			if err != nil {
-				return fmt.Errorf("invalid glob pattern %s: %v", pattern, err)
-			}
-			if match {
-				matched = true
-				requestedTests[testID] = test
-			}
-		}
-		if !matched {
-			errMsg := fmt.Sprintf("no tests match pattern: %s", pattern)
-			var keys []string
-			for k := range conf.Tests {
-				keys = append(keys, k)
-			}
-			if bestMatch, ok := search.FindClosestTest(pattern, keys); ok {
-				errMsg += fmt.Sprintf("\nDid you mean '%s'?", bestMatch)
-			}
-			return fmt.Errorf(errMsg)
-		}
+	tags, err := tagFilter(conf)
+	if err != nil {
+		return nil, err
+	}
+	kconfigs, info, err := loadRequirementInfo(conf)
+	if err != nil {
+		return nil, err
 	}
 
-	runResults, testErr := runner.RunTests(&runner.RunOptions{
-		RequestedTests: requestedTests,
+	return &runner.RunOptions{
+		Tags:           tags,
 		SkipTags:       skipTags,
 		IncludeBad:     includeBad,
 		BadTags:        badTags,
 		LogDir:         logDir,
 		BailOnFailure:  bailOnFailure,
-	})
+		DefaultTimeout: defaultTimeout,
+		Jobs:           jobs,
+		RetryTags:      retryTagsFlag,
+		ExitCodes:      conf.ExitCodes,
+		KmsgPath:       kmsgPath,
+		KernelErrors:   kernelErrorPolicy,
+		TaintedPath:    taintedPath,
+		OnTaint:        taintPolicy,
+		TaintMask:      &taintMask,
+		Kconfig:        kconfigs,
+		SysInfo:        info,
+	}, nil
+}
+
+// tagFilter returns the tag expression from --tags and --profile, they both
+// have to match.
+func tagFilter(conf *test_conf.TestConf) (*tagexpr.Expr, error) {
+	var tags *tagexpr.Expr
+	if tagsFlag != "" {
+		var err error
+		if tags, err = tagexpr.Parse(tagsFlag); err != nil {
+			return nil, fmt.Errorf("invalid --tags: %w", err)
+		}
+	}
+	if profile == "" {
+		return tags, nil
+	}
+	p, ok := conf.Profiles[profile]
+	if !ok {
+		if len(conf.Profiles) == 0 {
+			return nil, fmt.Errorf("no profile %q, the test config doesn't have any", profile)
+		}
+		var names []string
+		for name := range conf.Profiles {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("no profile %q in the test config, it has: %s", profile, strings.Join(names, ", "))
+	}
+	return tagexpr.And(tags, p.Tags), nil
+}
 
+// loadKconfig reads the kernel config for --kconfig. It's nil if that's empty.
+func loadKconfig() (kconfig.Config, error) {
+	if kconfigPath == "" {
+		return nil, nil
+	}
+	paths := []string{kconfigPath}
+	if kconfigPath == "auto" {
+		paths = kconfig.DefaultPaths(runner.CurrentHost().KernelRelease)
+	}
+	config, _, err := kconfig.Find(paths)
+	return config, err
+}
+
+// loadRequirementInfo reads what the tests' requirements get checked against.
+// It's only an error if --kconfig names a file that can't be read. Otherwise,
+// whatever can't be read just doesn't get checked, with a warning if any tests
+// need it. Plenty of kernels don't have their config around, for example.
+func loadRequirementInfo(conf *test_conf.TestConf) (kconfig.Config, *sysinfo.Info, error) {
+	kconfigs, err := loadKconfig()
+	if err != nil {
+		if kconfigPath != "auto" {
+			return nil, nil, fmt.Errorf("reading --kconfig: %w", err)
+		}
+		if anyTest(conf, func(test test_conf.Test) bool { return len(test.RequiresKconfig) != 0 }) {
+			fmt.Fprintf(os.Stderr, "Warning: not checking requires_kconfig: %v\n", err)
+		}
+	}
+	if sysinfoRoot == "" {
+		return kconfigs, nil, nil
+	}
+	info, err := sysinfo.Read(sysinfoRoot)
+	if err != nil && anyTest(conf, func(test test_conf.Test) bool { return test.Requires != nil || len(test.ConditionalTags) != 0 }) {
+		fmt.Fprintf(os.Stderr, "Warning: not checking requires or conditional tags: %v\n", err)
+	}
+	return kconfigs, info, nil
+}
+
+func anyTest(conf *test_conf.TestConf, pred func(test_conf.Test) bool) bool {
+	for _, test := range conf.Tests {
+		if pred(test) {
+			return true
+		}
+	}
+	return false
+}
+
+// reportResults writes the JUnit report if requested, prints the summary, and
+// returns the error for the overall run. host is where the tests ran.
+func reportResults(runResults []*runner.TestResult, host runner.Host, testErr error) error {
 	if junitXMLPath != "" {
-		if err := junit.GenerateReport(runResults, junitXMLPath); err != nil {
+		if err := junit.GenerateReport(runResults, junitXMLPath, junit.Options{Host: host, MaxLogBytes: junitMaxLog}); err != nil {
 			return fmt.Errorf("generating JUnit report: %w", err)
 		}
 	}
+	if resultsJSON != "" {
+		if err := runner.WriteResultsJSON(runResults, host, resultsJSON); err != nil {
+			return err
+		}
+	}
 
 	fmt.Println("\n=== Test Results Summary ===")
 	passedCount := 0
@@ -175,9 +462,34 @@ func doRun(testIdentifiers []string) error {
 	errorCount := 0
 	droppedCount := 0
 	skippedCount := 0
+	timeoutCount := 0
+	flakyCount := 0
+	kernelErrorCount := 0
+	crashedCount := 0
 	for _, result := range runResults {
-		if result.Result == runner.TestSkipped {
-			fmt.Printf("%-60s %s %s\n", result.TestID, result.Result, result.SkipReason)
+		var details []string
+		switch result.Result {
+		case runner.TestSkipped:
+			details = append(details, result.SkipReason)
+		case runner.TestTimeout:
+			// Zero if the test reported the timeout itself via its exit code.
+			if result.Timeout != 0 {
+				details = append(details, fmt.Sprintf("after %v", result.Timeout))
+			}
+		case runner.TestKernelError:
+			details = append(details, result.KernelErrorTitle())
+		}
+		if failed, total := ktap.CountFailed(result.Subtests); failed > 0 && total > 1 {
+			details = append(details, fmt.Sprintf("%d/%d subtests failed", failed, total))
+		}
+		if result.NewTaint != 0 {
+			details = append(details, fmt.Sprintf("tainted: %s", result.NewTaint))
+		}
+		if len(result.Attempts) > 1 {
+			details = append(details, fmt.Sprintf("(%d attempts)", len(result.Attempts)))
+		}
+		if len(details) > 0 {
+			fmt.Printf("%-60s %s %s\n", result.TestID, result.Result, strings.Join(details, " "))
 		} else {
 			fmt.Printf("%-60s %s\n", result.TestID, result.Result)
 		}
@@ -193,34 +505,298 @@ func doRun(testIdentifiers []string) error {
 			droppedCount++
 		case runner.TestSkipped:
 			skippedCount++
+		case runner.TestTimeout:
+			timeoutCount++
+		case runner.TestFlaky:
+			flakyCount++
+		case runner.TestKernelError:
+			kernelErrorCount++
+		case runner.TestCrashed:
+			crashedCount++
 		}
 	}
-	fmt.Printf("\nTotal: %d, Passed: %d, Failed: %d, Error: %d, Skipped: %d, Dropped: %d\n",
+	fmt.Printf("\nTotal: %d, Passed: %d, Failed: %d, Error: %d, Skipped: %d, Dropped: %d",
 		len(runResults), passedCount, failedCount, errorCount, skippedCount, droppedCount)
+	// Only mention the rarer outcomes when they actually happened.
+	if timeoutCount != 0 {
+		fmt.Printf(", Timed out: %d", timeoutCount)
+	}
+	if flakyCount != 0 {
+		fmt.Printf(", Flaky: %d", flakyCount)
+	}
+	if kernelErrorCount != 0 {
+		fmt.Printf(", Kernel errors: %d", kernelErrorCount)
+	}
+	if crashedCount != 0 {
+		fmt.Printf(", Crashed: %d", crashedCount)
+	}
+	fmt.Println()
 
 	if testErr != nil {
 		return testErr
 	}
-	if failedCount != 0 {
+	if failedCount != 0 || timeoutCount != 0 || kernelErrorCount != 0 || crashedCount != 0 {
 		return ErrTestFailed
 	}
-	if passedCount == 0 {
+	if passedCount == 0 && flakyCount == 0 {
 		return fmt.Errorf("didn't run any tests")
 	}
 	return nil
 }
 
+// doResume carries on with a run that was interrupted, probably by a kernel
+// crash. The tests that were running get reported as crashed, and the ones
+// that hadn't started yet get run now.
+func doResume(journalPath string) error {
+	if journalPath == "" {
+		return fmt.Errorf("--journal flag is required")
+	}
+	if testConfigFile == "" {
+		return fmt.Errorf("--test-config flag is required")
+	}
+	conf, err := test_conf.Parse(testConfigFile)
+	if err != nil {
+		return fmt.Errorf("parsing test config: %v", err)
+	}
+	state, err := runner.ReadJournal(journalPath)
+	if err != nil {
+		return fmt.Errorf("reading journal: %w", err)
+	}
+
+	requestedTests := make(map[string]test_conf.Test)
+	for _, testID := range state.NotStarted {
+		test, ok := conf.Tests[testID]
+		if !ok {
+			return fmt.Errorf("test %s from the journal isn't in the test config", testID)
+		}
+		requestedTests[testID] = test
+	}
+
+	if logDir == "" {
+		logDir = filepath.Dir(journalPath)
+	}
+	opts, err := runOptions(conf)
+	if err != nil {
+		return err
+	}
+	opts.RequestedTests = requestedTests
+	journal, err := runner.AppendJournal(journalPath)
+	if err != nil {
+		return err
+	}
+	defer journal.Close()
+	opts.Journal = journal
+	if resultsStream != "" {
+		streamJournal, err := runner.DialStream(resultsStream, state.Tests)
+		if err != nil {
+			return err
+		}
+		defer streamJournal.Close()
+		opts.Stream = streamJournal
+		// The listener needs to hear about the whole run.
+		for _, result := range state.Results {
+			if err := streamJournal.TestEnded(result); err != nil {
+				return err
+			}
+		}
+	}
+	// Everything from here on goes to the journal and the stream, if any.
+	record := func(result *runner.TestResult) error {
+		if test, ok := conf.Tests[result.TestID]; ok {
+			result.Tags = test.ResolveTags(opts.SysInfo)
+			result.Command = test.FullCommand()
+		}
+		for _, j := range []*runner.Journal{opts.Journal, opts.Stream} {
+			if j == nil {
+				continue
+			}
+			if err := j.TestEnded(result); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	results := state.Results
+	for _, testID := range state.InProgress {
+		fmt.Printf("Test %s was running when the kernel crashed\n", testID)
+		result := state.CrashedResult(testID)
+		if err := record(result); err != nil {
+			return err
+		}
+		results = append(results, result)
+	}
+	if opts.BailOnFailure && len(state.InProgress) != 0 {
+		// A crash counts as a failure, so this is like bailing out of the
+		// original run.
+		fmt.Println("Not running remaining tests because of --bail-on-failure")
+		opts.RequestedTests = nil
+		now := time.Now()
+		for _, testID := range state.NotStarted {
+			result := &runner.TestResult{TestID: testID, Result: runner.TestDropped, StartTime: now, EndTime: now}
+			if err := record(result); err != nil {
+				return err
+			}
+			results = append(results, result)
+		}
+	}
+
+	var testErr error
+	if len(opts.RequestedTests) != 0 {
+		var newResults []*runner.TestResult
+		newResults, testErr = runner.RunTests(opts)
+		results = append(results, newResults...)
+	}
+	if err := runEnded(opts); err != nil && testErr == nil {
+		testErr = err
+	}
+	sort.Slice(results, func(i, j int) bool { return results[i].TestID < results[j].TestID })
+	return reportResults(results, runner.CurrentHost(), testErr)
+}
+
+// doReport reports the results from a journal without running anything, for
+// a run that isn't going to be resumed. This doesn't need the test config so
+// it can be used on the host side of a VM.
+func doReport(journalPath string, resultsPaths []string) error {
+	if journalPath != "" {
+		if len(resultsPaths) != 0 {
+			return fmt.Errorf("can't report from a journal and a results file at once")
+		}
+		state, err := runner.ReadJournal(journalPath)
+		if err != nil {
+			return fmt.Errorf("reading journal: %w", err)
+		}
+		return reportResults(journalResults(state), state.Host, nil)
+	}
+	if len(resultsPaths) != 1 {
+		return fmt.Errorf("usage: test-runner report [--journal <file> | <results.json>]")
+	}
+	results, host, err := runner.ReadResultsJSON(resultsPaths[0])
+	if err != nil {
+		return err
+	}
+	return reportResults(results, host, nil)
+}
+
+// journalResults returns the results for a run that isn't going to continue.
+func journalResults(state *runner.JournalState) []*runner.TestResult {
+	results := append(state.Results, state.CrashedResults()...)
+	sort.Slice(results, func(i, j int) bool { return results[i].TestID < results[j].TestID })
+	return results
+}
+
+// doListen waits for a run to connect with --results-stream, shows its
+// progress, and then reports the results like the run itself would. If the
+// connection drops before the end of the run, the tests that were running are
+// reported as crashed. With --log-dir, the tests' output is saved there, since
+// the run's own logs are on the other end.
+func doListen(addr string) error {
+	listener, err := stream.Listen(addr)
+	if err != nil {
+		return fmt.Errorf("listening for results stream: %w", err)
+	}
+	defer listener.Close()
+	conn, err := listener.Accept()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	state, err := runner.ReadStream(conn, os.Stdout, logDir)
+	if err != nil {
+		return err
+	}
+	if !state.Finished {
+		fmt.Println("Results stream ended before the end of the run")
+	}
+	return reportResults(journalResults(state), state.Host, nil)
+}
+
+// doCompare compares two runs and prints the differences. Only new failures
+// count as an error.
+func doCompare(baselinePath, candidatePath, jsonPath string) error {
+	baseline, err := compare.Load(baselinePath)
+	if err != nil {
+		return fmt.Errorf("loading baseline: %w", err)
+	}
+	candidate, err := compare.Load(candidatePath)
+	if err != nil {
+		return fmt.Errorf("loading candidate: %w", err)
+	}
+	diffs := compare.Compare(baseline, candidate)
+
+	byChange := make(map[compare.Change][]compare.TestDiff)
+	for _, d := range diffs {
+		byChange[d.Change] = append(byChange[d.Change], d)
+	}
+	fmt.Printf("=== Comparing %s -> %s ===\n", baselinePath, candidatePath)
+	var counts []string
+	for _, change := range compare.Changes {
+		counts = append(counts, fmt.Sprintf("%s: %d", change.Title(), len(byChange[change])))
+		// Listing all the tests that didn't change would just be noise.
+		if change == compare.Unchanged || len(byChange[change]) == 0 {
+			continue
+		}
+		fmt.Printf("\n%s (%d):\n", change.Title(), len(byChange[change]))
+		for _, d := range byChange[change] {
+			var before, after string
+			if d.Baseline != nil {
+				before = d.Baseline.Status
+			}
+			if d.Candidate != nil {
+				after = d.Candidate.Status
+			}
+			fmt.Printf("  %-60s %s -> %s\n", d.TestID, before, after)
+		}
+	}
+	fmt.Printf("\n%s\n", strings.Join(counts, ", "))
+
+	if jsonPath != "" {
+		countMap := make(map[compare.Change]int)
+		for _, change := range compare.Changes {
+			countMap[change] = len(byChange[change])
+		}
+		data, err := json.MarshalIndent(struct {
+			Baseline  string                 `json:"baseline"`
+			Candidate string                 `json:"candidate"`
+			Counts    map[compare.Change]int `json:"counts"`
+			Tests     []compare.TestDiff     `json:"tests"`
+		}{baselinePath, candidatePath, countMap, diffs}, "", "  ")
+		if err != nil {
+			return fmt.Errorf("encoding comparison: %w", err)
+		}
+		if err := os.WriteFile(jsonPath, append(data, '\n'), 0644); err != nil {
+			return fmt.Errorf("writing comparison: %w", err)
+		}
+	}
+
+	if compare.Regressions(diffs) != 0 {
+		return ErrTestFailed
+	}
+	return nil
+}
+
 func doMain() error {
 	registerGlobalFlags(flag.CommandLine)
 	flag.Usage = func() {
-		fmt.Println("usage: test-runner [--test-config <file>] [--skip-tag <tag>] [--bail-on-failure] [--log-dir <path>] [--junit-xml <path>] [run] <test-id-glob>...")
+		fmt.Println("usage: test-runner [--test-config <file>] [--skip-tag <tag>] [--tags <expr>] [--profile <name>] [--exclude <selector>] [--tests-from <file>] [--bail-on-failure] [--log-dir <path>] [--junit-xml <path>] [--default-timeout <duration>] [--jobs <n>] [run] <selector>...")
 		fmt.Println("       test-runner parse-kselftest-list <file>")
-		fmt.Println("       test-runner list --test-config <file>")
+		fmt.Println("       test-runner list --test-config <file> [--unsupported] [--kconfig <path>]")
+		fmt.Println("       test-runner validate --test-config <file>")
+		fmt.Println("       test-runner merge-config [--base-key <path>] [--allow-stale] <base> <overlay>")
+		fmt.Println("       test-runner resume --journal <file> --test-config <file> [--junit-xml <path>]")
+		fmt.Println("       test-runner report [--junit-xml <path>] [--results-json <path>] --journal <file> | <results.json>")
+		fmt.Println("       test-runner listen [--junit-xml <path>] <address>")
+		fmt.Println("       test-runner compare [--json <path>] <baseline> <candidate>")
+		fmt.Println("       test-runner merge [--junit-xml <path>] [--json <path>] <label>:<file>...")
 		flag.PrintDefaults()
 	}
 	flag.Parse()
 
 	args := flag.Args()
+	if len(args) == 0 && (testsFrom != "" || len(excludeFlag) != 0) {
+		// The selectors are all in the flags.
+		return doRun(nil)
+	}
 	if len(args) == 0 {
 		flag.Usage()
 		return fmt.Errorf("no args provided")
@@ -235,8 +811,10 @@ func doMain() error {
 		}
 		return parseKselftestList(args[1])
 	case "list":
+		var unsupported bool
 		listCmd := flag.NewFlagSet("list", flag.ExitOnError)
 		registerGlobalFlags(listCmd)
+		listCmd.BoolVar(&unsupported, "unsupported", false, "Only list the tests whose requirements (requires_kconfig and requires) this machine doesn't meet, and why")
 		if err := listCmd.Parse(args[1:]); err != nil {
 			return err
 		}
@@ -247,15 +825,56 @@ func doMain() error {
 		if err != nil {
 			return fmt.Errorf("parsing test config: %v", err)
 		}
+		var kconfigs kconfig.Config
+		var info *sysinfo.Info
+		if unsupported {
+			if kconfigs, info, err = loadRequirementInfo(conf); err != nil {
+				return err
+			}
+		}
 		var keys []string
 		for k := range conf.Tests {
 			keys = append(keys, k)
 		}
 		sort.Strings(keys)
 		for _, k := range keys {
-			fmt.Println(k)
+			if !unsupported {
+				fmt.Println(k)
+				continue
+			}
+			if unmet := runner.UnmetRequirements(conf.Tests[k], kconfigs, info); len(unmet) != 0 {
+				fmt.Printf("%s: %s\n", k, strings.Join(unmet, ", "))
+			}
+		}
+		return nil
+	case "validate":
+		validateCmd := flag.NewFlagSet("validate", flag.ExitOnError)
+		validateCmd.StringVar(&testConfigFile, "test-config", testConfigFile, "Path to a JSON file with test definitions")
+		if err := validateCmd.Parse(args[1:]); err != nil {
+			return err
+		}
+		if testConfigFile == "" || validateCmd.NArg() != 0 {
+			return fmt.Errorf("usage: test-runner validate --test-config <file>")
+		}
+		conf, err := test_conf.Parse(testConfigFile)
+		if err != nil {
+			return err
 		}
+		fmt.Printf("%s: OK, %d tests\n", testConfigFile, len(conf.Tests))
 		return nil
+	case "merge-config":
+		var baseKey string
+		var allowStale bool
+		mergeConfigCmd := flag.NewFlagSet("merge-config", flag.ExitOnError)
+		mergeConfigCmd.StringVar(&baseKey, "base-key", "", "Dotted path to put the base config under before merging, e.g. kselftests")
+		mergeConfigCmd.BoolVar(&allowStale, "allow-stale", false, "Only warn about overlay nodes that don't match anything in the base")
+		if err := mergeConfigCmd.Parse(args[1:]); err != nil {
+			return err
+		}
+		if mergeConfigCmd.NArg() != 2 {
+			return fmt.Errorf("usage: test-runner merge-config [--base-key <path>] [--allow-stale] <base> <overlay>")
+		}
+		return mergeConfig(mergeConfigCmd.Arg(0), mergeConfigCmd.Arg(1), baseKey, allowStale)
 	case "run":
 		runCmd := flag.NewFlagSet("run", flag.ExitOnError)
 		registerGlobalFlags(runCmd)
@@ -263,6 +882,55 @@ func doMain() error {
 			return err
 		}
 		return doRun(runCmd.Args())
+	case "resume", "report":
+		var journalPath string
+		cmd := flag.NewFlagSet(subcmd, flag.ExitOnError)
+		registerGlobalFlags(cmd)
+		cmd.StringVar(&journalPath, "journal", "", "Path to the journal of the interrupted run")
+		if err := cmd.Parse(args[1:]); err != nil {
+			return err
+		}
+		if subcmd == "report" {
+			return doReport(journalPath, cmd.Args())
+		}
+		if cmd.NArg() != 0 {
+			return fmt.Errorf("resume doesn't take test identifiers, it uses the ones from the journal")
+		}
+		return doResume(journalPath)
+	case "compare":
+		var jsonPath string
+		compareCmd := flag.NewFlagSet("compare", flag.ExitOnError)
+		compareCmd.StringVar(&jsonPath, "json", "", "Path to write the comparison as JSON")
+		if err := compareCmd.Parse(args[1:]); err != nil {
+			return err
+		}
+		if compareCmd.NArg() != 2 {
+			return fmt.Errorf("usage: test-runner compare [--json <path>] <baseline> <candidate>")
+		}
+		return doCompare(compareCmd.Arg(0), compareCmd.Arg(1), jsonPath)
+	case "merge":
+		var jsonPath string
+		mergeCmd := flag.NewFlagSet("merge", flag.ExitOnError)
+		mergeCmd.StringVar(&junitXMLPath, "junit-xml", junitXMLPath, "Path to write the merged JUnit XML report")
+		mergeCmd.Int64Var(&junitMaxLog, "junit-max-log-bytes", junitMaxLog, "How much of each test log to put in the JUnit report, for inputs that are JSON results")
+		mergeCmd.StringVar(&jsonPath, "json", "", "Path to write the merged results as JSON")
+		if err := mergeCmd.Parse(args[1:]); err != nil {
+			return err
+		}
+		if mergeCmd.NArg() == 0 {
+			return fmt.Errorf("usage: test-runner merge [--junit-xml <path>] [--json <path>] <label>:<file>...")
+		}
+		return doMerge(mergeCmd.Args(), jsonPath)
+	case "listen":
+		listenCmd := flag.NewFlagSet("listen", flag.ExitOnError)
+		registerGlobalFlags(listenCmd)
+		if err := listenCmd.Parse(args[1:]); err != nil {
+			return err
+		}
+		if listenCmd.NArg() != 1 {
+			return fmt.Errorf("usage: test-runner listen [--junit-xml <path>] <address>")
+		}
+		return doListen(listenCmd.Arg(0))
 	case "help", "-h", "--help":
 		flag.Usage()
 		return nil
@@ -273,6 +941,33 @@ func doMain() error {
 	}
 }
 
+// doMerge prints a table of the results from several configurations, and
+// optionally writes them as a JUnit report and as JSON.
+func doMerge(args []string, jsonPath string) error {
+	var inputs []merge.Input
+	for _, arg := range args {
+		inputs = append(inputs, merge.ParseInput(arg))
+	}
+	matrix, err := merge.Load(inputs)
+	if err != nil {
+		return err
+	}
+	if err := matrix.WriteTable(os.Stdout); err != nil {
+		return err
+	}
+	if jsonPath != "" {
+		if err := matrix.WriteJSON(jsonPath); err != nil {
+			return err
+		}
+	}
+	if junitXMLPath != "" {
+		if err := merge.WriteJUnit(inputs, junitXMLPath, junit.Options{MaxLogBytes: junitMaxLog}); err != nil {
+			return fmt.Errorf("writing merged JUnit report: %w", err)
+		}
+	}
+	return nil
+}
+
 func main() {
 	err := doMain()
 	if errors.Is(err, ErrTestFailed) {
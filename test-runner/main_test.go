@@ -1,21 +1,33 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
+	"fmt"
 	"log"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/google/go-cmp/cmp"
+
+	"test-runner/runner"
+	"test-runner/test_conf"
 )
 
 var testBinaryPath = "./test-runner-test-binary"
 
+// hermeticFlags stop the test binary from looking at the host's kernel log,
+// taint flags, kernel config and /proc, so the results don't depend on it.
+var hermeticFlags = []string{"--kmsg=", "--tainted=", "--kconfig=", "--sysinfo-root="}
+
 func TestParseKselftestList(t *testing.T) {
 	kselftestList := `kvm:guest_memfd_test
-futex:functional`
+futex:functional
+mm:ksft_gup_test.sh`
 	expectedJSON := `{
   "futex": {
     "functional": {
@@ -24,7 +36,23 @@ futex:functional`
         "run_kselftest.sh",
         "-t",
         "futex:functional"
-      ]
+      ],
+      "exit_codes": {
+        "4": "skip"
+      }
+    }
+  },
+  "mm": {
+    "ksft_gup_test.sh": {
+      "__is_test": true,
+      "command": [
+        "run_kselftest.sh",
+        "-t",
+        "mm:ksft_gup_test.sh"
+      ],
+      "exit_codes": {
+        "4": "skip"
+      }
     }
   },
   "kvm": {
@@ -34,7 +62,10 @@ futex:functional`
         "run_kselftest.sh",
         "-t",
         "kvm:guest_memfd_test"
-      ]
+      ],
+      "exit_codes": {
+        "4": "skip"
+      }
     }
   }
 }`
@@ -80,7 +111,13 @@ func TestMainFunc(t *testing.T) {
 		testIdentifiers  string
 		skipTags         []string
 		includeBad       []string
+		tags             string
+		profile          string
+		exclude          []string
+		testsFrom        string // Written to a file for --tests-from.
 		bailOnFailure    bool
+		defaultTimeout   string
+		retryTags        []string
 		expectedOutput   string
 		expectedExitCode int
 	}{
@@ -209,6 +246,95 @@ world
 foo.bar                                                      PASS ✔️
 foo.baz                                                      PASS ✔️
 
+Total: 2, Passed: 2, Failed: 0, Error: 0, Skipped: 0, Dropped: 0
+`,
+			expectedExitCode: 0,
+		},
+		{
+			name: "glob doesn't cross dots",
+			jsonContent: `{
+				"foo": {
+					"bar": {
+						"__is_test": true,
+						"command": ["echo", "hello"]
+					},
+					"sub": {
+						"baz": {
+							"__is_test": true,
+							"command": ["echo", "world"]
+						}
+					}
+				}
+			}`,
+			testIdentifiers: "foo.*",
+			expectedOutput: `hello
+
+=== Test Results Summary ===
+foo.bar                                                      PASS ✔️
+
+Total: 1, Passed: 1, Failed: 0, Error: 0, Skipped: 0, Dropped: 0
+`,
+			expectedExitCode: 0,
+		},
+		{
+			name: "exclusions",
+			jsonContent: `{
+				"foo": {
+					"bar": {
+						"__is_test": true,
+						"command": ["echo", "hello"]
+					},
+					"sub": {
+						"baz": {
+							"__is_test": true,
+							"command": ["echo", "world"]
+						},
+						"qux": {
+							"__is_test": true,
+							"command": ["echo", "test"]
+						}
+					}
+				}
+			}`,
+			testIdentifiers: "foo.** !re:.*qux",
+			exclude:         []string{"foo.bar", "foo.nonexistent"},
+			expectedOutput: `Warning: exclusion !foo.nonexistent doesn't match any tests
+world
+
+=== Test Results Summary ===
+foo.sub.baz                                                  PASS ✔️
+
+Total: 1, Passed: 1, Failed: 0, Error: 0, Skipped: 0, Dropped: 0
+`,
+			expectedExitCode: 0,
+		},
+		{
+			name: "tests from file",
+			jsonContent: `{
+				"foo": {
+					"bar": {
+						"__is_test": true,
+						"command": ["echo", "hello"]
+					},
+					"baz": {
+						"__is_test": true,
+						"command": ["echo", "world"]
+					},
+					"qux": {
+						"__is_test": true,
+						"command": ["echo", "test"]
+					}
+				}
+			}`,
+			testIdentifiers: "foo.bar",
+			testsFrom:       "# Curated\nfoo.*\n\n!foo.baz\n",
+			expectedOutput: `hello
+test
+
+=== Test Results Summary ===
+foo.bar                                                      PASS ✔️
+foo.qux                                                      PASS ✔️
+
 Total: 2, Passed: 2, Failed: 0, Error: 0, Skipped: 0, Dropped: 0
 `,
 			expectedExitCode: 0,
@@ -382,6 +508,214 @@ Total: 2, Passed: 2, Failed: 0, Error: 0, Skipped: 0, Dropped: 0
 `,
 			expectedExitCode: 0,
 		},
+		{
+			name: "tag expression",
+			jsonContent: `{
+				"bad_tags": ["bad"],
+				"foo": {
+					"bar": {
+						"__is_test": true,
+						"command": ["echo", "hello"],
+						"tags": ["mm", "slow"]
+					},
+					"baz": {
+						"__is_test": true,
+						"command": ["echo", "world"],
+						"tags": ["mm"]
+					},
+					"qux": {
+						"__is_test": true,
+						"command": ["echo", "test"]
+					},
+					"quux": {
+						"__is_test": true,
+						"command": ["echo", "broken"],
+						"tags": ["mm", "bad"]
+					}
+				}
+			}`,
+			testIdentifiers: "foo.*",
+			tags:            "mm && !slow",
+			expectedOutput: `world
+
+=== Test Results Summary ===
+foo.bar                                                      SKIP 🫥 [slow]
+foo.baz                                                      PASS ✔️
+foo.quux                                                     SKIP 🫥 [bad]
+foo.qux                                                      SKIP 🫥 [!mm]
+
+Total: 4, Passed: 1, Failed: 0, Error: 0, Skipped: 3, Dropped: 0
+`,
+			expectedExitCode: 0,
+		},
+		{
+			name: "profile",
+			jsonContent: `{
+				"profiles": {
+					"quick": {"tags": "!(slow || flaky)"}
+				},
+				"foo": {
+					"bar": {
+						"__is_test": true,
+						"command": ["echo", "hello"],
+						"tags": ["slow", "flaky"]
+					},
+					"baz": {
+						"__is_test": true,
+						"command": ["echo", "world"],
+						"tags": ["kvm"]
+					}
+				}
+			}`,
+			testIdentifiers: "foo.*",
+			tags:            "kvm || slow",
+			profile:         "quick",
+			expectedOutput: `world
+
+=== Test Results Summary ===
+foo.bar                                                      SKIP 🫥 [slow,flaky]
+foo.baz                                                      PASS ✔️
+
+Total: 2, Passed: 1, Failed: 0, Error: 0, Skipped: 1, Dropped: 0
+`,
+			expectedExitCode: 0,
+		},
+		{
+			name: "unknown profile",
+			jsonContent: `{
+				"profiles": {"quick": {}, "nightly": {}},
+				"foo": {"__is_test": true, "command": ["true"]}
+			}`,
+			testIdentifiers:  "foo",
+			profile:          "fast",
+			expectedOutput:   "Error: no profile \"fast\" in the test config, it has: nightly, quick\n",
+			expectedExitCode: 127,
+		},
+		{
+			name: "invalid tag expression",
+			jsonContent: `{
+				"foo": {"__is_test": true, "command": ["true"]}
+			}`,
+			testIdentifiers:  "foo",
+			tags:             "kvm && (slow",
+			expectedOutput:   "Error: invalid --tags: invalid tag expression \"kvm && (slow\": missing )\n",
+			expectedExitCode: 127,
+		},
+		{
+			name: "timeout",
+			jsonContent: `{
+				"foo": {
+					"bar": {
+						"__is_test": true,
+						"command": ["sleep", "100"]
+					},
+					"baz": {
+						"__is_test": true,
+						"command": ["sleep", "100"],
+						"timeout": "200ms"
+					}
+				}
+			}`,
+			testIdentifiers: "foo.*",
+			defaultTimeout:  "100ms",
+			expectedOutput: `Test foo.bar timed out after 100ms
+Test foo.baz timed out after 200ms
+
+=== Test Results Summary ===
+foo.bar                                                      TIMEOUT ⏰ after 100ms
+foo.baz                                                      TIMEOUT ⏰ after 200ms
+
+Total: 2, Passed: 0, Failed: 0, Error: 0, Skipped: 0, Dropped: 0, Timed out: 2
+`,
+			expectedExitCode: 1,
+		},
+		{
+			name: "retry tag",
+			jsonContent: `{
+				"foo": {
+					"bar": {
+						"__is_test": true,
+						"command": ["sh", "-c", "echo attempt; exit 1"],
+						"tags": ["flaky"]
+					},
+					"baz": {
+						"__is_test": true,
+						"command": ["sh", "-c", "exit 1"],
+						"tags": ["other"]
+					}
+				}
+			}`,
+			testIdentifiers: "foo.*",
+			retryTags:       []string{"flaky=2"},
+			expectedOutput: `attempt
+Retrying foo.bar (attempt 2/3)
+attempt
+Retrying foo.bar (attempt 3/3)
+attempt
+
+=== Test Results Summary ===
+foo.bar                                                      FAIL ❌ (3 attempts)
+foo.baz                                                      FAIL ❌
+
+Total: 2, Passed: 0, Failed: 2, Error: 0, Skipped: 0, Dropped: 0
+`,
+			expectedExitCode: 1,
+		},
+		{
+			name: "ktap subtests",
+			jsonContent: `{
+				"foo": {
+					"bar": {
+						"__is_test": true,
+						"command": ["sh", "-c", "printf 'TAP version 13\\n1..3\\nok 1 a\\nnot ok 2 b\\nok 3 c\\n'; exit 1"]
+					}
+				}
+			}`,
+			testIdentifiers: "foo.bar",
+			expectedOutput: `TAP version 13
+1..3
+ok 1 a
+not ok 2 b
+ok 3 c
+
+=== Test Results Summary ===
+foo.bar                                                      FAIL ❌ 1/3 subtests failed
+
+Total: 1, Passed: 0, Failed: 1, Error: 0, Skipped: 0, Dropped: 0
+`,
+			expectedExitCode: 1,
+		},
+		{
+			name: "exit codes",
+			jsonContent: `{
+				"exit_codes": {"4": "skip", "3": "pass"},
+				"foo": {
+					"bar": {
+						"__is_test": true,
+						"command": ["sh", "-c", "exit 4"]
+					},
+					"baz": {
+						"__is_test": true,
+						"command": ["sh", "-c", "exit 3"]
+					},
+					"qux": {
+						"__is_test": true,
+						"command": ["sh", "-c", "exit 3"],
+						"exit_codes": {"3": "timeout"}
+					}
+				}
+			}`,
+			testIdentifiers: "foo.*",
+			expectedOutput: `
+=== Test Results Summary ===
+foo.bar                                                      SKIP 🫥 test reported skip (exit code 4)
+foo.baz                                                      PASS ✔️
+foo.qux                                                      TIMEOUT ⏰
+
+Total: 3, Passed: 1, Failed: 0, Error: 0, Skipped: 1, Dropped: 0, Timed out: 1
+`,
+			expectedExitCode: 1,
+		},
 	}
 
 	for _, tc := range testCases {
@@ -399,16 +733,38 @@ Total: 2, Passed: 2, Failed: 0, Error: 0, Skipped: 0, Dropped: 0
 				t.Fatal(err)
 			}
 
-			args := []string{"--test-config", tmpfile.Name()}
+			args := append([]string{"--test-config", tmpfile.Name()}, hermeticFlags...)
 			if tc.bailOnFailure {
 				args = append(args, "--bail-on-failure")
 			}
+			for _, rt := range tc.retryTags {
+				args = append(args, "--retry-tag", rt)
+			}
+			if tc.defaultTimeout != "" {
+				args = append(args, "--default-timeout", tc.defaultTimeout)
+			}
 			for _, tag := range tc.skipTags {
 				args = append(args, "--skip-tag", tag)
 			}
 			for _, tag := range tc.includeBad {
 				args = append(args, "--include-bad", tag)
 			}
+			if tc.tags != "" {
+				args = append(args, "--tags", tc.tags)
+			}
+			if tc.profile != "" {
+				args = append(args, "--profile", tc.profile)
+			}
+			for _, pattern := range tc.exclude {
+				args = append(args, "--exclude", pattern)
+			}
+			if tc.testsFrom != "" {
+				testsFromPath := filepath.Join(t.TempDir(), "tests.txt")
+				if err := os.WriteFile(testsFromPath, []byte(tc.testsFrom), 0644); err != nil {
+					t.Fatal(err)
+				}
+				args = append(args, "--tests-from", testsFromPath)
+			}
 			args = append(args, strings.Fields(tc.testIdentifiers)...)
 			cmd := exec.Command(testBinaryPath, args...)
 			output, err := cmd.CombinedOutput()
@@ -438,6 +794,564 @@ Total: 2, Passed: 2, Failed: 0, Error: 0, Skipped: 0, Dropped: 0
 	}
 }
 
+func TestResume(t *testing.T) {
+	tmpDir := t.TempDir()
+	configPath := filepath.Join(tmpDir, "config.json")
+	config := `{
+		"suite": {
+			"a": {"__is_test": true, "command": ["true"]},
+			"b": {"__is_test": true, "command": ["true"]},
+			"c": {"__is_test": true, "command": ["true"]}
+		}
+	}`
+	if err := os.WriteFile(configPath, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Fake a run where the kernel crashed while suite.b was running.
+	journalPath := filepath.Join(tmpDir, runner.JournalFileName)
+	journal, err := runner.CreateJournal(journalPath, []string{"suite.a", "suite.b", "suite.c"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := journal.TestEnded(&runner.TestResult{TestID: "suite.a", Result: runner.TestPassed}); err != nil {
+		t.Fatal(err)
+	}
+	if err := journal.TestStarted("suite.b", ""); err != nil {
+		t.Fatal(err)
+	}
+	journal.Close()
+
+	cmd := exec.Command(testBinaryPath, "report", "--journal", journalPath)
+	output, err := cmd.CombinedOutput()
+	if exitErr, ok := err.(*exec.ExitError); !ok || exitErr.ExitCode() != 1 {
+		t.Errorf("expected report to exit with code 1, got %v", err)
+	}
+	if !strings.Contains(string(output), "Total: 3, Passed: 1, Failed: 0, Error: 0, Skipped: 0, Dropped: 1, Crashed: 1") {
+		t.Errorf("unexpected report output:\n%s", output)
+	}
+
+	junitPath := filepath.Join(tmpDir, "junit.xml")
+	cmd = exec.Command(testBinaryPath, append([]string{"resume", "--journal", journalPath,
+		"--test-config", configPath, "--junit-xml", junitPath}, hermeticFlags...)...)
+	output, err = cmd.CombinedOutput()
+	if exitErr, ok := err.(*exec.ExitError); !ok || exitErr.ExitCode() != 1 {
+		t.Errorf("expected resume to exit with code 1, got %v", err)
+	}
+	if !strings.Contains(string(output), "Total: 3, Passed: 2, Failed: 0, Error: 0, Skipped: 0, Dropped: 0, Crashed: 1") {
+		t.Errorf("unexpected resume output:\n%s", output)
+	}
+	if _, err := os.Stat(junitPath); err != nil {
+		t.Errorf("JUnit report not written: %v", err)
+	}
+
+	// The journal now records the whole run.
+	state, err := runner.ReadJournal(journalPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(state.Results) != 3 || len(state.InProgress) != 0 || len(state.NotStarted) != 0 {
+		t.Errorf("unexpected journal state after resume: %+v", state)
+	}
+}
+
+// Tests run in their own process groups, so they don't get the terminal's
+// Ctrl-C unless the runner forwards it.
+func TestInterrupt(t *testing.T) {
+	tmpDir := t.TempDir()
+	readyPath := filepath.Join(tmpDir, "ready")
+	gotPath := filepath.Join(tmpDir, "got")
+	configPath := filepath.Join(tmpDir, "config.json")
+	script := fmt.Sprintf("trap 'echo INT > %s; exit 1' INT; touch %s; for i in $(seq 1000); do sleep 0.01; done", gotPath, readyPath)
+	config := fmt.Sprintf(`{"suite": {"wait": {"__is_test": true, "command": ["bash", "-c", %q]}}}`, script)
+	if err := os.WriteFile(configPath, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cmd := exec.Command(testBinaryPath, append(hermeticFlags, "--test-config", configPath, "suite.wait")...)
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer cmd.Process.Kill()
+	for i := 0; ; i++ {
+		if _, err := os.Stat(readyPath); err == nil {
+			break
+		}
+		if i == 100 {
+			t.Fatalf("test didn't start")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	cmd.Process.Signal(os.Interrupt)
+	if err := cmd.Wait(); err == nil {
+		t.Errorf("expected the runner to die from SIGINT")
+	}
+	for i := 0; ; i++ {
+		if _, err := os.Stat(gotPath); err == nil {
+			break
+		}
+		if i == 100 {
+			t.Fatalf("test didn't get SIGINT")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestResultsStream(t *testing.T) {
+	tmpDir := t.TempDir()
+	configPath := filepath.Join(tmpDir, "config.json")
+	config := `{
+		"suite": {
+			"fail": {"__is_test": true, "command": ["bash", "-c", "echo oh no; exit 1"]},
+			"pass": {"__is_test": true, "command": ["bash", "-c", "echo hello from the test"]}
+		}
+	}`
+	if err := os.WriteFile(configPath, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	socketPath := filepath.Join(tmpDir, "sock")
+	junitPath := filepath.Join(tmpDir, "junit.xml")
+	resultsPath := filepath.Join(tmpDir, "results.json")
+	listenLogDir := filepath.Join(tmpDir, "listener-logs")
+	guestLogDir := filepath.Join(tmpDir, "guest-logs")
+
+	listenCmd := exec.Command(testBinaryPath, "listen", "--junit-xml", junitPath, "--results-json", resultsPath,
+		"--log-dir", listenLogDir, "unix:"+socketPath)
+	var listenOutput bytes.Buffer
+	listenCmd.Stdout = &listenOutput
+	listenCmd.Stderr = &listenOutput
+	if err := listenCmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer listenCmd.Process.Kill()
+	for i := 0; ; i++ {
+		if _, err := os.Stat(socketPath); err == nil {
+			break
+		}
+		if i == 100 {
+			t.Fatalf("listener didn't create socket")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	// The run's logs are on its side, which the listener usually can't see.
+	runCmd := exec.Command(testBinaryPath, append(hermeticFlags, "--test-config", configPath,
+		"--log-dir", guestLogDir, "--results-stream", "unix:"+socketPath, "suite.*")...)
+	if output, err := runCmd.CombinedOutput(); err == nil {
+		t.Errorf("expected run to fail, output:\n%s", output)
+	}
+
+	err := listenCmd.Wait()
+	if exitErr, ok := err.(*exec.ExitError); !ok || exitErr.ExitCode() != 1 {
+		t.Errorf("expected listen to exit with code 1, got %v", err)
+	}
+	output := listenOutput.String()
+	for _, want := range []string{
+		"hello from the test",
+		"oh no",
+		"Total: 2, Passed: 1, Failed: 1, Error: 0, Skipped: 0, Dropped: 0",
+	} {
+		if !strings.Contains(output, want) {
+			t.Errorf("listen output doesn't contain %q:\n%s", want, output)
+		}
+	}
+	junit, err := os.ReadFile(junitPath)
+	if err != nil {
+		t.Fatalf("JUnit report not written: %v", err)
+	}
+	if !strings.Contains(string(junit), "<system-out>hello from the test") {
+		t.Errorf("JUnit report doesn't have the streamed output:\n%s", junit)
+	}
+	results, _, err := runner.ReadResultsJSON(resultsPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range results {
+		if want := filepath.Join(listenLogDir, "suite", r.TestID[len("suite."):]+".log"); r.LogFile != want {
+			t.Errorf("log for %s is %q, want %q", r.TestID, r.LogFile, want)
+		}
+	}
+
+	// The saved results can be reported on later, without the run's logs.
+	if err := os.RemoveAll(guestLogDir); err != nil {
+		t.Fatal(err)
+	}
+	reportCmd := exec.Command(testBinaryPath, "report", "--junit-xml", filepath.Join(tmpDir, "report.xml"), resultsPath)
+	if output, err := reportCmd.CombinedOutput(); err != nil {
+		if exitErr, ok := err.(*exec.ExitError); !ok || exitErr.ExitCode() != 1 {
+			t.Errorf("report failed: %v\n%s", err, output)
+		}
+	}
+}
+
+func TestReport(t *testing.T) {
+	tmpDir := t.TempDir()
+	configPath := filepath.Join(tmpDir, "config.json")
+	config := `{
+		"suite": {
+			"fail": {"__is_test": true, "command": ["false"], "tags": ["broken"]},
+			"pass": {"__is_test": true, "command": ["true"]}
+		}
+	}`
+	if err := os.WriteFile(configPath, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	resultsPath := filepath.Join(tmpDir, "results.json")
+	runCmd := exec.Command(testBinaryPath, append(hermeticFlags, "--test-config", configPath, "--results-json", resultsPath, "suite.*")...)
+	runOutput, err := runCmd.CombinedOutput()
+	if err == nil {
+		t.Errorf("expected run to fail")
+	}
+
+	var results struct {
+		Results []struct {
+			TestID  string   `json:"test_id"`
+			Status  string   `json:"status"`
+			Tags    []string `json:"tags"`
+			Command []string `json:"command"`
+		} `json:"results"`
+	}
+	data, err := os.ReadFile(resultsPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(data, &results); err != nil {
+		t.Fatal(err)
+	}
+	if len(results.Results) != 2 || results.Results[0].TestID != "suite.fail" || results.Results[0].Status != "FAIL" ||
+		results.Results[0].Tags[0] != "broken" || results.Results[0].Command[0] != "false" {
+		t.Errorf("unexpected results file:\n%s", data)
+	}
+
+	junitPath := filepath.Join(tmpDir, "junit.xml")
+	reportCmd := exec.Command(testBinaryPath, "report", "--junit-xml", junitPath, resultsPath)
+	reportOutput, err := reportCmd.CombinedOutput()
+	if exitErr, ok := err.(*exec.ExitError); !ok || exitErr.ExitCode() != 1 {
+		t.Errorf("expected report to exit with code 1, got %v", err)
+	}
+	// The summary should be the same as the original run's.
+	_, wantSummary, _ := strings.Cut(string(runOutput), "=== Test Results Summary ===")
+	_, gotSummary, _ := strings.Cut(string(reportOutput), "=== Test Results Summary ===")
+	if diff := cmp.Diff(wantSummary, gotSummary); diff != "" {
+		t.Errorf("summary mismatch (-want +got):\n%s", diff)
+	}
+	if _, err := os.Stat(junitPath); err != nil {
+		t.Errorf("JUnit report not written: %v", err)
+	}
+}
+
+func TestReportKernelErrorWithoutSplats(t *testing.T) {
+	resultsPath := filepath.Join(t.TempDir(), "results.json")
+	results := `{
+		"version": 1,
+		"results": [{"test_id": "suite.oops", "status": "KERNEL_ERROR"}]
+	}`
+	if err := os.WriteFile(resultsPath, []byte(results), 0644); err != nil {
+		t.Fatal(err)
+	}
+	output, err := exec.Command(testBinaryPath, "report", resultsPath).CombinedOutput()
+	if exitErr, ok := err.(*exec.ExitError); !ok || exitErr.ExitCode() != 1 {
+		t.Errorf("expected report to exit with code 1, got %v:\n%s", err, output)
+	}
+	if !strings.Contains(string(output), "no splat recorded") {
+		t.Errorf("summary doesn't describe the kernel error:\n%s", output)
+	}
+}
+
+func TestCompare(t *testing.T) {
+	tmpDir := t.TempDir()
+	now := time.Now()
+	write := func(name string, results map[string]runner.TestStatus) string {
+		var testResults []*runner.TestResult
+		for id, status := range results {
+			testResults = append(testResults, &runner.TestResult{TestID: id, Result: status, StartTime: now, EndTime: now})
+		}
+		path := filepath.Join(tmpDir, name)
+		if err := runner.WriteResultsJSON(testResults, runner.Host{}, path); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	baseline := write("baseline.json", map[string]runner.TestStatus{
+		"suite.a": runner.TestPassed,
+		"suite.b": runner.TestFailed,
+	})
+	candidate := write("candidate.json", map[string]runner.TestStatus{
+		"suite.a": runner.TestTimeout,
+		"suite.b": runner.TestPassed,
+	})
+	jsonPath := filepath.Join(tmpDir, "comparison.json")
+
+	cmd := exec.Command(testBinaryPath, "compare", "--json", jsonPath, baseline, candidate)
+	output, err := cmd.CombinedOutput()
+	if exitErr, ok := err.(*exec.ExitError); !ok || exitErr.ExitCode() != 1 {
+		t.Errorf("expected compare to exit with code 1, got %v", err)
+	}
+	wantOutput := "=== Comparing " + baseline + " -> " + candidate + " ===\n" +
+		"\nNew failures (1):\n" +
+		fmt.Sprintf("  %-60s PASS -> TIMEOUT\n", "suite.a") +
+		"\nFixed (1):\n" +
+		fmt.Sprintf("  %-60s FAIL -> PASS\n", "suite.b") +
+		"\nNew failures: 1, Fixed: 1, Still failing: 0, Newly skipped: 0, Added: 0, Removed: 0, Unchanged: 0\n"
+	if diff := cmp.Diff(wantOutput, string(output)); diff != "" {
+		t.Errorf("output mismatch (-want +got):\n%s", diff)
+	}
+	data, err := os.ReadFile(jsonPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), `"new_failure": 1`) {
+		t.Errorf("unexpected JSON comparison:\n%s", data)
+	}
+
+	// Failures alone aren't regressions.
+	cmd = exec.Command(testBinaryPath, "compare", baseline, baseline)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		t.Errorf("expected no error comparing a run with itself, got %v:\n%s", err, output)
+	}
+}
+
+func TestMerge(t *testing.T) {
+	tmpDir := t.TempDir()
+	now := time.Now()
+	write := func(name string, results map[string]runner.TestStatus) string {
+		var testResults []*runner.TestResult
+		for id, status := range results {
+			testResults = append(testResults, &runner.TestResult{TestID: id, Result: status, StartTime: now, EndTime: now})
+		}
+		path := filepath.Join(tmpDir, name)
+		if err := runner.WriteResultsJSON(testResults, runner.Host{}, path); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	x86 := write("x86.json", map[string]runner.TestStatus{
+		"suite.a": runner.TestPassed,
+		"suite.b": runner.TestFailed,
+	})
+	i686 := write("i686.json", map[string]runner.TestStatus{
+		"suite.a": runner.TestSkipped,
+	})
+	junitPath := filepath.Join(tmpDir, "merged.xml")
+	jsonPath := filepath.Join(tmpDir, "merged.json")
+
+	cmd := exec.Command(testBinaryPath, "merge", "--junit-xml", junitPath, "--json", jsonPath,
+		"x86_64:"+x86, "i686/asi=on:"+i686)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("merge failed: %v\n%s", err, output)
+	}
+	wantOutput := "TEST     x86_64  i686/asi=on\n" +
+		"suite.a  PASS    SKIP\n" +
+		"suite.b  FAIL    -\n"
+	if diff := cmp.Diff(wantOutput, string(output)); diff != "" {
+		t.Errorf("output mismatch (-want +got):\n%s", diff)
+	}
+	data, err := os.ReadFile(jsonPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), `"configurations": [
+    "x86_64",
+    "i686/asi=on"
+  ]`) {
+		t.Errorf("unexpected JSON:\n%s", data)
+	}
+	data, err = os.ReadFile(junitPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), `<testcase name="a" classname="i686/asi=on.suite"`) {
+		t.Errorf("unexpected JUnit:\n%s", data)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tmpDir := t.TempDir()
+	good := filepath.Join(tmpDir, "good.json")
+	if err := os.WriteFile(good, []byte(`{"foo": {"bar": {"__is_test": true, "command": ["true"]}}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	bad := filepath.Join(tmpDir, "bad.json")
+	if err := os.WriteFile(bad, []byte(`{"foo": {"bar": ["flaky"]}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	output, err := exec.Command(testBinaryPath, "validate", "--test-config", good).CombinedOutput()
+	if err != nil {
+		t.Errorf("validate failed for a good config: %v\n%s", err, output)
+	}
+	if diff := cmp.Diff(good+": OK, 1 tests\n", string(output)); diff != "" {
+		t.Errorf("output mismatch (-want +got):\n%s", diff)
+	}
+
+	output, err = exec.Command(testBinaryPath, "validate", "--test-config", bad).CombinedOutput()
+	if exitErr, ok := err.(*exec.ExitError); !ok || exitErr.ExitCode() != 127 {
+		t.Errorf("expected validate to exit with code 127 for a bad config, got %v", err)
+	}
+	if !strings.Contains(string(output), ".foo.bar: tests and suites must be objects, this looks like a list of tags") {
+		t.Errorf("unexpected output:\n%s", output)
+	}
+}
+
+func TestRequirements(t *testing.T) {
+	tmpDir := t.TempDir()
+	configPath := filepath.Join(tmpDir, "config.json")
+	if err := os.WriteFile(configPath, []byte(`{
+		"mm": {
+			"requires_kconfig": ["MMU"],
+			"vmalloc": {"__is_test": true, "command": ["true"], "requires_kconfig": ["TEST_VMALLOC=m|y"]},
+			"gup": {"__is_test": true, "command": ["true"]},
+			"huge": {"__is_test": true, "command": ["true"], "requires": {"min_cpus": 1000000}}
+		}
+	}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	kconfigPath := filepath.Join(tmpDir, "kconfig")
+	if err := os.WriteFile(kconfigPath, []byte("CONFIG_MMU=y\n# CONFIG_TEST_VMALLOC is not set\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// A machine with two CPUs.
+	sysinfoRoot := filepath.Join(tmpDir, "root")
+	if err := os.MkdirAll(filepath.Join(sysinfoRoot, "proc"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range map[string]string{
+		"cpuinfo": "processor\t: 0\nflags\t\t: fpu\n\nprocessor\t: 1\nflags\t\t: fpu\n",
+		"meminfo": "MemTotal:        8388608 kB\n",
+		"cmdline": "console=ttyS0\n",
+	} {
+		if err := os.WriteFile(filepath.Join(sysinfoRoot, "proc", name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	flags := append(hermeticFlags, "--test-config", configPath, "--kconfig", kconfigPath, "--sysinfo-root", sysinfoRoot)
+
+	output, err := exec.Command(testBinaryPath, append(append([]string{"list"}, flags...), "--unsupported")...).CombinedOutput()
+	if err != nil {
+		t.Fatalf("list failed: %v\n%s", err, output)
+	}
+	if want := "mm.huge: needs 1000000 CPUs, have 2\nmm.vmalloc: CONFIG_TEST_VMALLOC not set\n"; string(output) != want {
+		t.Errorf("unexpected list output:\n%s", output)
+	}
+
+	resultsPath := filepath.Join(tmpDir, "results.json")
+	output, err = exec.Command(testBinaryPath, append(flags, "--results-json", resultsPath, "mm.*")...).CombinedOutput()
+	if err != nil {
+		t.Fatalf("run failed: %v\n%s", err, output)
+	}
+	results, _, err := runner.ReadResultsJSON(resultsPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string]string)
+	for _, r := range results {
+		got[r.TestID] = r.Result.Name() + " " + strings.Split(r.SkipReason, ",")[0]
+	}
+	want := map[string]string{
+		"mm.gup":     "PASS ",
+		"mm.huge":    "SKIP needs 1000000 CPUs",
+		"mm.vmalloc": "SKIP CONFIG_TEST_VMALLOC not set",
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("results mismatch (-want +got):\n%s", diff)
+	}
+
+	output, err = exec.Command(testBinaryPath, append(hermeticFlags, "--test-config", configPath, "--kconfig", filepath.Join(tmpDir, "missing"), "mm.*")...).CombinedOutput()
+	if exitErr, ok := err.(*exec.ExitError); !ok || exitErr.ExitCode() != 127 {
+		t.Errorf("expected a missing --kconfig to be an error, got %v\n%s", err, output)
+	}
+}
+
+func TestMergeConfig(t *testing.T) {
+	tmpDir := t.TempDir()
+	base := filepath.Join(tmpDir, "base.json")
+	if err := os.WriteFile(base, []byte(`{"kvm": {"msrs_test": {"__is_test": true, "command": ["msrs_test"]}}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	good := filepath.Join(tmpDir, "good.json")
+	if err := os.WriteFile(good, []byte(`{"kselftests": {"kvm": {"msrs_test": {"tags": ["flaky"]}}}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	stale := filepath.Join(tmpDir, "stale.json")
+	if err := os.WriteFile(stale, []byte(`{"kselftests": {"kvm": {"msr_test": {"tags": ["flaky"]}}}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cmd := exec.Command(testBinaryPath, "merge-config", "--base-key", "kselftests", base, good)
+	output, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("merge-config failed: %v", err)
+	}
+	merged := filepath.Join(tmpDir, "merged.json")
+	if err := os.WriteFile(merged, output, 0644); err != nil {
+		t.Fatal(err)
+	}
+	conf, err := test_conf.Parse(merged)
+	if err != nil {
+		t.Fatalf("merged config is invalid: %v\n%s", err, output)
+	}
+	if diff := cmp.Diff([]string{"flaky"}, conf.Tests["kselftests.kvm.msrs_test"].Tags); diff != "" {
+		t.Errorf("tags mismatch (-want +got):\n%s", diff)
+	}
+
+	var stderr bytes.Buffer
+	cmd = exec.Command(testBinaryPath, "merge-config", "--base-key", "kselftests", base, stale)
+	cmd.Stderr = &stderr
+	_, err = cmd.Output()
+	if exitErr, ok := err.(*exec.ExitError); !ok || exitErr.ExitCode() != 127 {
+		t.Errorf("expected merge-config to exit with code 127 for a stale overlay, got %v", err)
+	}
+	want := "kselftests.kvm.msr_test doesn't match any test or suite in the base config (did you mean kselftests.kvm.msrs_test?)"
+	if !strings.Contains(stderr.String(), want) {
+		t.Errorf("expected warning %q, got:\n%s", want, stderr.String())
+	}
+
+	cmd = exec.Command(testBinaryPath, "merge-config", "--allow-stale", "--base-key", "kselftests", base, stale)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		t.Errorf("expected --allow-stale to succeed, got %v:\n%s", err, output)
+	}
+}
+
+func TestDottedNames(t *testing.T) {
+	tmpDir := t.TempDir()
+	configPath := filepath.Join(tmpDir, "config.json")
+	if err := os.WriteFile(configPath, []byte(`{
+		"mm": {
+			"ksft_gup_test.sh": {
+				"__is_test": true,
+				"command": ["echo", "gup"]
+			}
+		}
+	}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	logDir := filepath.Join(tmpDir, "logs")
+	junitPath := filepath.Join(tmpDir, "junit.xml")
+
+	// Without escaping the dot, it's a different test.
+	cmd := exec.Command(testBinaryPath, append(hermeticFlags, "--test-config", configPath, "mm.ksft_gup_test.sh")...)
+	output, _ := cmd.CombinedOutput()
+	if !strings.Contains(string(output), `Did you mean 'mm.ksft_gup_test\.sh'?`) {
+		t.Errorf("expected a suggestion with the escaped ID, got:\n%s", output)
+	}
+
+	cmd = exec.Command(testBinaryPath, append(hermeticFlags, "--test-config", configPath, "--log-dir", logDir, "--junit-xml", junitPath, `mm.ksft_gup_test\.sh`)...)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("run failed: %v\n%s", err, output)
+	}
+	if _, err := os.Stat(filepath.Join(logDir, "mm", "ksft_gup_test.sh.log")); err != nil {
+		t.Errorf("log not where expected: %v", err)
+	}
+	report, err := os.ReadFile(junitPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(report), `<testcase name="ksft_gup_test.sh" classname="mm"`) {
+		t.Errorf("unexpected JUnit report:\n%s", report)
+	}
+}
+
 func TestMain(m *testing.M) {
 	log.Println("Building the test binary...")
 
@@ -0,0 +1,340 @@
+// Package merge combines the results of several runs of the same tests in
+// different configurations, like on different architectures or with different
+// kernel command lines, into a single report.
+package merge
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"test-runner/compare"
+	"test-runner/junit"
+	"test-runner/runner"
+	"test-runner/test_conf"
+)
+
+// Input is the results of one configuration.
+type Input struct {
+	// Namespaces the results in the merged report, e.g. "x86_64/asi=on".
+	Label string
+	// A JUnit report or a --results-json file.
+	Path string
+}
+
+// ParseInput parses an input given on the command line as <label>:<path>. If
+// there's no label, the path is used as the label.
+func ParseInput(s string) Input {
+	label, path, ok := strings.Cut(s, ":")
+	if !ok || label == "" {
+		return Input{Label: s, Path: s}
+	}
+	return Input{Label: label, Path: path}
+}
+
+// Row is one test's results in each configuration. Configurations that don't
+// have the test are missing from Results.
+type Row struct {
+	TestID  string                    `json:"test_id"`
+	Results map[string]compare.Result `json:"results"`
+}
+
+// Matrix is every test's status in every configuration.
+type Matrix struct {
+	// In the order they were given.
+	Labels []string `json:"configurations"`
+	// Sorted by test ID.
+	Tests []Row `json:"tests"`
+}
+
+// Load reads the inputs into a matrix.
+func Load(inputs []Input) (*Matrix, error) {
+	m := &Matrix{}
+	rows := make(map[string]*Row)
+	seen := make(map[string]bool)
+	for _, input := range inputs {
+		if seen[input.Label] {
+			return nil, fmt.Errorf("label %q used more than once", input.Label)
+		}
+		seen[input.Label] = true
+		m.Labels = append(m.Labels, input.Label)
+
+		results, err := compare.Load(input.Path)
+		if err != nil {
+			return nil, fmt.Errorf("loading %s: %w", input.Label, err)
+		}
+		for testID, result := range results {
+			row := rows[testID]
+			if row == nil {
+				row = &Row{TestID: testID, Results: make(map[string]compare.Result)}
+				rows[testID] = row
+			}
+			row.Results[input.Label] = result
+		}
+	}
+	for _, row := range rows {
+		m.Tests = append(m.Tests, *row)
+	}
+	sort.Slice(m.Tests, func(i, j int) bool { return m.Tests[i].TestID < m.Tests[j].TestID })
+	return m, nil
+}
+
+// WriteTable writes the matrix as plain text, one row per test and one column
+// per configuration. Tests that a configuration doesn't have are shown as "-".
+func (m *Matrix) WriteTable(w io.Writer) error {
+	header := append([]string{"TEST"}, m.Labels...)
+	table := [][]string{header}
+	for _, row := range m.Tests {
+		line := []string{row.TestID}
+		for _, label := range m.Labels {
+			status := "-"
+			if result, ok := row.Results[label]; ok {
+				status = result.Status
+			}
+			line = append(line, status)
+		}
+		table = append(table, line)
+	}
+
+	widths := make([]int, len(header))
+	for _, line := range table {
+		for i, cell := range line {
+			widths[i] = max(widths[i], len(cell))
+		}
+	}
+	for _, line := range table {
+		var b strings.Builder
+		for i, cell := range line {
+			if i == len(line)-1 {
+				b.WriteString(cell)
+				break
+			}
+			fmt.Fprintf(&b, "%-*s  ", widths[i], cell)
+		}
+		if _, err := fmt.Fprintln(w, b.String()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WriteJSON writes the matrix as JSON to path.
+func (m *Matrix) WriteJSON(path string) error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return fmt.Errorf("encoding merged results: %w", err)
+	}
+	if err := os.WriteFile(path, append(data, '\n'), 0644); err != nil {
+		return fmt.Errorf("writing merged results: %w", err)
+	}
+	return nil
+}
+
+// node is any XML element. The JUnit reports get merged as generic XML, so
+// that everything in them (logs, properties, things other tools added) is
+// kept.
+type node struct {
+	XMLName  xml.Name
+	Attrs    []xml.Attr `xml:",any,attr"`
+	Content  string     `xml:",chardata"`
+	Children []*node    `xml:",any"`
+}
+
+func (n *node) attr(name string) string {
+	for _, a := range n.Attrs {
+		if a.Name.Local == name {
+			return a.Value
+		}
+	}
+	return ""
+}
+
+func (n *node) setAttr(name, value string) {
+	for i, a := range n.Attrs {
+		if a.Name.Local == name {
+			n.Attrs[i].Value = value
+			return
+		}
+	}
+	n.Attrs = append(n.Attrs, xml.Attr{Name: xml.Name{Local: name}, Value: value})
+}
+
+// totals are the counts that go on testsuite and testsuites elements.
+type totals struct {
+	tests, failures, errors, skipped int
+	time                             float64
+}
+
+func (t *totals) add(n *node) {
+	atoi := func(s string) int {
+		i, _ := strconv.Atoi(s)
+		return i
+	}
+	t.tests += atoi(n.attr("tests"))
+	t.failures += atoi(n.attr("failures"))
+	t.errors += atoi(n.attr("errors"))
+	t.skipped += atoi(n.attr("skipped"))
+	f, _ := strconv.ParseFloat(n.attr("time"), 64)
+	t.time += f
+}
+
+func (t *totals) attrs() []xml.Attr {
+	attr := func(name, value string) xml.Attr {
+		return xml.Attr{Name: xml.Name{Local: name}, Value: value}
+	}
+	return []xml.Attr{
+		attr("tests", strconv.Itoa(t.tests)),
+		attr("failures", strconv.Itoa(t.failures)),
+		attr("errors", strconv.Itoa(t.errors)),
+		attr("skipped", strconv.Itoa(t.skipped)),
+		attr("time", fmt.Sprintf("%.3f", t.time)),
+	}
+}
+
+// readJUnit returns the suites from an input, and their totals. A
+// --results-json file gets turned into a JUnit report first. If the report has
+// totals at the top, those are used, since adding up the suites would count
+// the subtests in this tool's reports on top of their tests.
+func readJUnit(input Input, opts junit.Options) ([]*node, totals, error) {
+	var t totals
+	data, err := os.ReadFile(input.Path)
+	if err != nil {
+		return nil, t, err
+	}
+	if !bytes.HasPrefix(bytes.TrimSpace(data), []byte("<")) {
+		if data, err = resultsToJUnit(input.Path, opts); err != nil {
+			return nil, t, err
+		}
+	}
+	var root node
+	if err := xml.Unmarshal(data, &root); err != nil {
+		return nil, t, fmt.Errorf("parsing JUnit report %s: %w", input.Path, err)
+	}
+	switch root.XMLName.Local {
+	case "testsuite":
+		t.add(&root)
+		return []*node{&root}, t, nil
+	case "testsuites":
+		var suites []*node
+		for _, child := range root.Children {
+			if child.XMLName.Local == "testsuite" {
+				suites = append(suites, child)
+			}
+		}
+		if root.attr("tests") != "" {
+			t.add(&root)
+		} else {
+			for _, suite := range suites {
+				t.add(suite)
+			}
+		}
+		return suites, t, nil
+	}
+	return nil, t, fmt.Errorf("%s isn't a JUnit report, root element is %q", input.Path, root.XMLName.Local)
+}
+
+func resultsToJUnit(path string, opts junit.Options) ([]byte, error) {
+	results, host, err := runner.ReadResultsJSON(path)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.CreateTemp("", "junit-*.xml")
+	if err != nil {
+		return nil, err
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+	opts.Host = host
+	if err := junit.GenerateReport(results, f.Name(), opts); err != nil {
+		return nil, err
+	}
+	return os.ReadFile(f.Name())
+}
+
+// addLabel puts label in front of the names of the suites and the class names
+// of the test cases under n, so that the same test in different
+// configurations doesn't look like the same thing to whatever reads the
+// report. The label has to be escaped already, see test_conf.EscapeName.
+func addLabel(n *node, label string) {
+	switch n.XMLName.Local {
+	case "testsuite":
+		n.setAttr("name", label+"."+n.attr("name"))
+	case "testcase":
+		// A test at the top level is its own class, see junit.GenerateReport.
+		className := n.attr("classname")
+		if className == "" || className == test_conf.EscapeName(n.attr("name")) {
+			n.setAttr("classname", label)
+		} else {
+			n.setAttr("classname", label+"."+className)
+		}
+	}
+	for _, child := range n.Children {
+		addLabel(child, label)
+	}
+}
+
+// dropIndentation removes the whitespace between elements, the encoder adds
+// its own.
+func dropIndentation(n *node) {
+	if len(n.Children) > 0 && strings.TrimSpace(n.Content) == "" {
+		n.Content = ""
+	}
+	for _, child := range n.Children {
+		dropIndentation(child)
+	}
+}
+
+// WriteJUnit writes a JUnit report with a top-level suite for each input,
+// named after its label, containing the input's suites. opts are used for
+// inputs that are --results-json files, except for the host which comes from
+// the file.
+func WriteJUnit(inputs []Input, path string, opts junit.Options) error {
+	var all totals
+	var suites []*node
+	for _, input := range inputs {
+		children, t, err := readJUnit(input, opts)
+		if err != nil {
+			return err
+		}
+		for _, child := range children {
+			addLabel(child, test_conf.EscapeName(input.Label))
+			dropIndentation(child)
+		}
+		suite := &node{
+			XMLName:  xml.Name{Local: "testsuite"},
+			Attrs:    append([]xml.Attr{{Name: xml.Name{Local: "name"}, Value: input.Label}}, t.attrs()...),
+			Children: children,
+		}
+		all.add(suite)
+		suites = append(suites, suite)
+	}
+	root := &node{
+		XMLName:  xml.Name{Local: "testsuites"},
+		Attrs:    all.attrs(),
+		Children: suites,
+	}
+
+	file, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("creating JUnit XML file: %w", err)
+	}
+	defer file.Close()
+	if _, err := file.WriteString(xml.Header); err != nil {
+		return fmt.Errorf("writing XML header: %w", err)
+	}
+	encoder := xml.NewEncoder(file)
+	encoder.Indent("", "  ")
+	if err := encoder.Encode(root); err != nil {
+		return fmt.Errorf("encoding JUnit XML: %w", err)
+	}
+	if _, err := file.WriteString("\n"); err != nil {
+		return fmt.Errorf("writing JUnit XML: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,140 @@
+package merge
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+
+	"test-runner/compare"
+	"test-runner/junit"
+	"test-runner/runner"
+)
+
+func TestParseInput(t *testing.T) {
+	testCases := []struct {
+		in   string
+		want Input
+	}{
+		{in: "x86_64/asi=on:out/junit.xml", want: Input{Label: "x86_64/asi=on", Path: "out/junit.xml"}},
+		{in: "out/junit.xml", want: Input{Label: "out/junit.xml", Path: "out/junit.xml"}},
+		{in: ":out/junit.xml", want: Input{Label: ":out/junit.xml", Path: ":out/junit.xml"}},
+	}
+	for _, tc := range testCases {
+		if diff := cmp.Diff(tc.want, ParseInput(tc.in)); diff != "" {
+			t.Errorf("ParseInput(%q) mismatch (-want +got):\n%s", tc.in, diff)
+		}
+	}
+}
+
+// writeInputs writes a JUnit report and a results file, for two different
+// configurations.
+func writeInputs(t *testing.T) []Input {
+	t.Helper()
+	dir := t.TempDir()
+	now := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	logFile := filepath.Join(dir, "fail.log")
+	if err := os.WriteFile(logFile, []byte("it broke"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	junitPath := filepath.Join(dir, "junit.xml")
+	if err := junit.GenerateReport([]*runner.TestResult{
+		{TestID: "mm.a", Result: runner.TestPassed, StartTime: now, EndTime: now.Add(time.Second)},
+		{TestID: "mm.b", Result: runner.TestFailed, StartTime: now, EndTime: now.Add(time.Second), LogFile: logFile},
+		{TestID: "top", Result: runner.TestSkipped, StartTime: now, EndTime: now},
+	}, junitPath, junit.Options{}); err != nil {
+		t.Fatal(err)
+	}
+
+	resultsPath := filepath.Join(dir, "results.json")
+	if err := runner.WriteResultsJSON([]*runner.TestResult{
+		{TestID: "mm.a", Result: runner.TestTimeout, StartTime: now, EndTime: now.Add(2 * time.Second)},
+		{TestID: "mm.b", Result: runner.TestPassed, StartTime: now, EndTime: now.Add(time.Second)},
+		{TestID: "mm.c", Result: runner.TestPassed, StartTime: now, EndTime: now},
+	}, runner.Host{Hostname: "vm"}, resultsPath); err != nil {
+		t.Fatal(err)
+	}
+	return []Input{
+		{Label: "x86_64", Path: junitPath},
+		{Label: "i686/asi=on", Path: resultsPath},
+	}
+}
+
+func TestMatrix(t *testing.T) {
+	m, err := Load(writeInputs(t))
+	if err != nil {
+		t.Fatalf("Load() failed: %v", err)
+	}
+
+	var buf bytes.Buffer
+	if err := m.WriteTable(&buf); err != nil {
+		t.Fatal(err)
+	}
+	want := strings.Join([]string{
+		"TEST  x86_64  i686/asi=on",
+		"mm.a  PASS    TIMEOUT",
+		"mm.b  FAIL    PASS",
+		"mm.c  -       PASS",
+		"top   SKIP    -",
+		"",
+	}, "\n")
+	if diff := cmp.Diff(want, buf.String()); diff != "" {
+		t.Errorf("table mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestLoadDuplicateLabel(t *testing.T) {
+	inputs := writeInputs(t)
+	inputs[1].Label = inputs[0].Label
+	if _, err := Load(inputs); err == nil {
+		t.Errorf("expected an error for a duplicate label")
+	}
+}
+
+func TestWriteJUnit(t *testing.T) {
+	inputs := writeInputs(t)
+	path := filepath.Join(t.TempDir(), "merged.xml")
+	if err := WriteJUnit(inputs, path, junit.Options{}); err != nil {
+		t.Fatalf("WriteJUnit() failed: %v", err)
+	}
+
+	got, err := compare.Load(path)
+	if err != nil {
+		t.Fatalf("merged report can't be loaded: %v", err)
+	}
+	pass := compare.Result{Outcome: compare.Pass, Status: "PASS"}
+	want := map[string]compare.Result{
+		"x86_64.mm.a":      pass,
+		"x86_64.mm.b":      {Outcome: compare.Fail, Status: "FAIL"},
+		"x86_64.top":       {Outcome: compare.Skip, Status: "SKIP"},
+		"i686/asi=on.mm.a": {Outcome: compare.Fail, Status: "ERROR"},
+		"i686/asi=on.mm.b": pass,
+		"i686/asi=on.mm.c": pass,
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("merged results mismatch (-want +got):\n%s", diff)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	report := string(data)
+	for _, s := range []string{
+		`<testsuites tests="6" failures="1" errors="1" skipped="1" time="5.000">`,
+		`<testsuite name="x86_64" tests="3" failures="1" errors="0" skipped="1" time="2.000">`,
+		`<testsuite name="x86_64.mm"`,
+		`<testcase name="b" classname="x86_64.mm"`,
+		`<system-out>it broke</system-out>`,
+		`hostname="vm"`,
+	} {
+		if !strings.Contains(report, s) {
+			t.Errorf("merged report doesn't contain %s:\n%s", s, report)
+		}
+	}
+}
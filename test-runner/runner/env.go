@@ -0,0 +1,117 @@
+package runner
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"test-runner/test_conf"
+)
+
+// testDirs are the directories that the runner makes for each test. They're
+// shared by all the test's attempts.
+type testDirs struct {
+	// TEST_TMPDIR, deleted after the test.
+	tmp string
+	// TEST_ARTIFACT_DIR. Next to the test's log if there's a log dir,
+	// otherwise inside tmp.
+	artifacts string
+}
+
+// makeTestDirs creates the directories for a test.
+func makeTestDirs(testID, logDir string) (*testDirs, error) {
+	tmp, err := os.MkdirTemp("", "test-runner-*")
+	if err != nil {
+		return nil, fmt.Errorf("creating temporary directory for test %s: %w", testID, err)
+	}
+	dirs := &testDirs{tmp: tmp, artifacts: filepath.Join(tmp, "artifacts")}
+	if logDir != "" {
+		dirs.artifacts = attemptLogPath(logDir, testID, 1, ".artifacts")
+	}
+	if err := os.MkdirAll(dirs.artifacts, 0755); err != nil {
+		os.RemoveAll(tmp)
+		return nil, fmt.Errorf("creating artifact directory for test %s: %w", testID, err)
+	}
+	return dirs, nil
+}
+
+// cleanup deletes the temporary directory, and the artifact directory if the
+// test didn't put anything in it. It returns the artifact directory if it was
+// kept.
+func (d *testDirs) cleanup() (string, error) {
+	// Remove only deletes empty directories.
+	artifacts := d.artifacts
+	if os.Remove(artifacts) == nil {
+		artifacts = ""
+	}
+	if err := os.RemoveAll(d.tmp); err != nil {
+		return artifacts, fmt.Errorf("deleting temporary directory: %w", err)
+	}
+	// Anything left in here was in tmp.
+	if _, err := os.Stat(artifacts); err != nil {
+		artifacts = ""
+	}
+	return artifacts, nil
+}
+
+// commandEnv returns the environment and working directory for a test's
+// command. On top of the runner's own environment, tests get:
+//
+//   - TEST_ID: the test's ID.
+//   - TEST_LOG_DIR: the runner's log dir, if it has one.
+//   - TEST_ARTIFACT_DIR: a directory for the test to leave files in, see
+//     testDirs.
+//   - TEST_TMPDIR: a scratch directory that gets deleted after the test.
+//
+// And then test.Env. References like ${VAR} in test.Env and test.Cwd get
+// expanded from the runner's environment and the variables above, $$ is a
+// literal $.
+func commandEnv(testID string, test test_conf.Test, logDir string, dirs *testDirs) ([]string, string) {
+	standard := map[string]string{
+		"TEST_ID":           testID,
+		"TEST_ARTIFACT_DIR": absOrSame(dirs.artifacts),
+		"TEST_TMPDIR":       dirs.tmp,
+	}
+	if logDir != "" {
+		standard["TEST_LOG_DIR"] = absOrSame(logDir)
+	}
+	expand := func(s string) string {
+		return os.Expand(s, func(name string) string {
+			if name == "$" {
+				return "$"
+			}
+			if value, ok := standard[name]; ok {
+				return value
+			}
+			return os.Getenv(name)
+		})
+	}
+
+	env := os.Environ()
+	for _, key := range sortedMapKeys(standard) {
+		env = append(env, key+"="+standard[key])
+	}
+	for _, key := range sortedMapKeys(test.Env) {
+		env = append(env, key+"="+expand(test.Env[key]))
+	}
+	return env, expand(test.Cwd)
+}
+
+// absOrSame returns path as an absolute path, since the test might run in a
+// different directory, or just path if that doesn't work.
+func absOrSame(path string) string {
+	if abs, err := filepath.Abs(path); err == nil {
+		return abs
+	}
+	return path
+}
+
+func sortedMapKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,24 @@
+package runner
+
+import (
+	"os"
+
+	"test-runner/sysinfo"
+)
+
+// Host describes the machine that tests ran on. This gets recorded along with
+// the results, since the report might be generated somewhere else.
+type Host struct {
+	Hostname string `json:"hostname,omitempty"`
+	// Like uname -r.
+	KernelRelease string `json:"kernel_release,omitempty"`
+}
+
+// CurrentHost describes the machine we're running on. Anything that can't be
+// found out is left empty.
+func CurrentHost() Host {
+	var host Host
+	host.Hostname, _ = os.Hostname()
+	_, host.KernelRelease, _ = sysinfo.Uname()
+	return host
+}
@@ -0,0 +1,459 @@
+package runner
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"test-runner/stream"
+)
+
+// JournalFileName is the name of the journal in the log directory.
+const JournalFileName = "journal.jsonl"
+
+// How long a write to a results stream can take before the stream is given up
+// on. A variable for testing.
+var streamWriteTimeout = 10 * time.Second
+
+// Journal records progress through a run, one JSON object per line, synced to
+// disk as soon as it's written. If the kernel crashes part way through a run,
+// the journal says what happened up to that point, see ReadJournal.
+//
+// Paths to logs are recorded relative to the journal's directory, so that the
+// journal can still be read when that directory is mounted somewhere else,
+// like on the host side of a VM.
+//
+// A Journal can also send the same entries over a socket instead, see
+// DialStream.
+type Journal struct {
+	w io.WriteCloser
+	// Only set for files, streams don't need syncing.
+	f *os.File
+	// Empty for streams, their paths are left as they are.
+	dir string
+	// Whether this is a results stream, which also gets the tests' output,
+	// see DialStream.
+	stream bool
+	// Set when a stream fails, after which nothing more is sent to it.
+	broken bool
+	// Test output gets written from several goroutines.
+	mu sync.Mutex
+}
+
+type journalEvent string
+
+const (
+	eventRunStart  journalEvent = "run_start"
+	eventTestStart journalEvent = "test_start"
+	eventTestEnd   journalEvent = "test_end"
+	eventRunEnd    journalEvent = "run_end"
+	// Only sent to results streams.
+	eventOutput journalEvent = "output"
+)
+
+type journalEntry struct {
+	Event journalEvent `json:"event"`
+	Time  time.Time    `json:"time"`
+	// For run_start, every test in the run, including the ones that won't
+	// actually run because they're skipped.
+	Tests []string `json:"tests,omitempty"`
+	// For run_start, where the tests are running.
+	Host   *Host  `json:"host,omitempty"`
+	TestID string `json:"test_id,omitempty"`
+	// For test_start, where the log of the first attempt is going.
+	LogFile string `json:"log_file,omitempty"`
+	// For test_end.
+	Result *resultRecord `json:"result,omitempty"`
+	// For output, a chunk of the test's output.
+	Data string `json:"data,omitempty"`
+}
+
+// CreateJournal creates a new journal at path, replacing any existing one, and
+// records the start of a run of the given tests.
+func CreateJournal(path string, tests []string) (*Journal, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("creating journal: %w", err)
+	}
+	j := &Journal{w: f, f: f, dir: filepath.Dir(path)}
+	// Make sure the file itself survives a crash, not just its contents.
+	if err := syncDir(j.dir); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if err := j.runStarted(tests); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return j, nil
+}
+
+func (j *Journal) runStarted(tests []string) error {
+	sorted := append([]string(nil), tests...)
+	sort.Strings(sorted)
+	host := CurrentHost()
+	return j.write(&journalEntry{Event: eventRunStart, Time: time.Now(), Tests: sorted, Host: &host})
+}
+
+// AppendJournal opens an existing journal to carry on recording a run. If the
+// last entry was only partly written, it gets dropped.
+func AppendJournal(path string) (*Journal, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("opening journal: %w", err)
+	}
+	if i := bytes.LastIndexByte(data, '\n'); i+1 != len(data) {
+		if err := os.Truncate(path, int64(i+1)); err != nil {
+			return nil, fmt.Errorf("truncating journal: %w", err)
+		}
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		return nil, fmt.Errorf("opening journal: %w", err)
+	}
+	return &Journal{w: f, f: f, dir: filepath.Dir(path)}, nil
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return fmt.Errorf("syncing journal directory: %w", err)
+	}
+	defer d.Close()
+	if err := d.Sync(); err != nil {
+		return fmt.Errorf("syncing journal directory: %w", err)
+	}
+	return nil
+}
+
+func (j *Journal) write(entry *journalEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("encoding journal entry: %w", err)
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.broken {
+		return nil
+	}
+	if conn, ok := j.w.(stream.Conn); ok {
+		conn.SetWriteDeadline(time.Now().Add(streamWriteTimeout))
+	}
+	if _, err := j.w.Write(append(data, '\n')); err != nil {
+		if j.stream {
+			// The listener going away shouldn't fail the run, the local
+			// journal and results still have everything.
+			fmt.Printf("Warning: results stream failed, not sending any more results: %v\n", err)
+			j.broken = true
+			return nil
+		}
+		return fmt.Errorf("writing journal: %w", err)
+	}
+	if j.f != nil {
+		if err := j.f.Sync(); err != nil {
+			return fmt.Errorf("syncing journal: %w", err)
+		}
+	}
+	return nil
+}
+
+// TestStarted records that a test is about to run, logging to logFile (which
+// can be empty).
+func (j *Journal) TestStarted(testID string, logFile string) error {
+	entry := &journalEntry{
+		Event:   eventTestStart,
+		Time:    time.Now(),
+		TestID:  testID,
+		LogFile: j.relPath(logFile),
+	}
+	if j.stream {
+		entry.LogFile = ""
+	}
+	return j.write(entry)
+}
+
+// TestEnded records a test's result.
+func (j *Journal) TestEnded(result *TestResult) error {
+	record := encodeResult(result, j.dir)
+	if j.stream {
+		record.dropPaths()
+	}
+	return j.write(&journalEntry{
+		Event:  eventTestEnd,
+		Time:   time.Now(),
+		TestID: result.TestID,
+		Result: record,
+	})
+}
+
+// DialStream connects to a results stream listener (see stream.Listen) and
+// records the start of a run of the given tests. A results stream is like a
+// journal but it also gets the output of the tests, so that the listener can
+// show progress. It doesn't have any paths to files, since they're on this
+// machine and the listener is usually somewhere else: the listener gets the
+// output instead. Once it's connected, failures to send just get a warning.
+func DialStream(addr string, tests []string) (*Journal, error) {
+	conn, err := stream.Dial(addr)
+	if err != nil {
+		return nil, fmt.Errorf("connecting results stream: %w", err)
+	}
+	j := &Journal{w: conn, stream: true}
+	if err := j.runStarted(tests); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return j, nil
+}
+
+// RunEnded records that the run finished. This isn't needed for resuming, it's
+// just so that readers can tell a finished run from one that died.
+func (j *Journal) RunEnded() error {
+	return j.write(&journalEntry{Event: eventRunEnd, Time: time.Now()})
+}
+
+// outputWriter returns a writer for a test's output, or nil if this journal
+// doesn't record output.
+func (j *Journal) outputWriter(testID string) io.Writer {
+	if !j.stream {
+		return nil
+	}
+	return &journalOutput{j: j, testID: testID}
+}
+
+type journalOutput struct {
+	j      *Journal
+	testID string
+}
+
+// Write never fails, so that a broken stream doesn't break the test. A stalled
+// one only holds the test up until the write deadline, see streamWriteTimeout.
+func (o *journalOutput) Write(data []byte) (int, error) {
+	o.j.write(&journalEntry{Event: eventOutput, Time: time.Now(), TestID: o.testID, Data: string(data)})
+	return len(data), nil
+}
+
+func (j *Journal) Close() error {
+	return j.w.Close()
+}
+
+// relPath makes a log path relative to the journal, if it's inside the
+// journal's directory.
+func (j *Journal) relPath(path string) string {
+	return relPath(j.dir, path)
+}
+
+// JournalState is what a journal says about a run.
+type JournalState struct {
+	// Every test in the run, sorted.
+	Tests []string
+	// Results of the tests that finished, in the order they finished.
+	Results []*TestResult
+	// Tests that started but never finished. If the run isn't still going,
+	// these were probably running when the kernel crashed.
+	InProgress []string
+	// Tests that never started.
+	NotStarted []string
+	// Whether the end of the run was recorded.
+	Finished bool
+	// Where the tests ran.
+	Host Host
+
+	// From the test_start entries.
+	starts map[string]*journalEntry
+	dir    string
+}
+
+// ReadJournal reads the journal at path. A truncated last line is ignored,
+// since that's what a crash in the middle of writing an entry would leave.
+// Results are rebuilt as much as possible. Errors only have their messages
+// left, and log paths are resolved relative to where the journal is now.
+func ReadJournal(path string) (*JournalState, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("opening journal: %w", err)
+	}
+	defer f.Close()
+	return readJournal(f, path, filepath.Dir(path), nil)
+}
+
+// ReadStream reads a results stream (see DialStream) until the other end
+// closes it, and then returns the state of the run like ReadJournal. As the
+// events come in, the test output and results get written to console. If
+// logDir isn't empty, each test's output is saved there too, laid out like the
+// run's own --log-dir, and that's what the results' LogFile points to. All the
+// attempts at a retried test go in the same log. Any other paths in the stream
+// are ignored, they'd be on the machine the tests ran on.
+func ReadStream(r io.Reader, console io.Writer, logDir string) (*JournalState, error) {
+	logs := make(map[string]*os.File)
+	defer func() {
+		for _, f := range logs {
+			f.Close()
+		}
+	}()
+	var logErr error
+	saveOutput := func(testID, data string) {
+		f := logs[testID]
+		if f == nil && logErr == nil {
+			path := attemptLogPath(logDir, testID, 1, ".log")
+			if logErr = os.MkdirAll(filepath.Dir(path), 0755); logErr != nil {
+				return
+			}
+			if f, logErr = os.Create(path); logErr != nil {
+				return
+			}
+			logs[testID] = f
+		}
+		if f != nil && logErr == nil {
+			_, logErr = io.WriteString(f, data)
+		}
+	}
+	state, err := readJournal(r, "results stream", "", func(entry *journalEntry) {
+		switch entry.Event {
+		case eventOutput:
+			io.WriteString(console, entry.Data)
+			if logDir != "" {
+				saveOutput(entry.TestID, entry.Data)
+			}
+		case eventTestEnd:
+			fmt.Fprintf(console, "%-60s %s\n", entry.TestID, entry.Result.Status)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if logErr != nil {
+		return nil, fmt.Errorf("saving test output: %w", logErr)
+	}
+	logFile := func(testID string) string {
+		if f := logs[testID]; f != nil {
+			return f.Name()
+		}
+		return ""
+	}
+	for _, result := range state.Results {
+		result.LogFile, result.KernelLogFile, result.ArtifactDir = logFile(result.TestID), "", ""
+		for _, a := range result.Attempts {
+			a.LogFile, a.KernelLogFile = "", ""
+		}
+	}
+	for testID, start := range state.starts {
+		start.LogFile = logFile(testID)
+	}
+	return state, nil
+}
+
+// readJournal reads journal entries from r, which is called name in errors.
+// Relative log paths are resolved against dir. If onEntry isn't nil it's
+// called for each entry as it's read.
+func readJournal(r io.Reader, name string, dir string, onEntry func(*journalEntry)) (*JournalState, error) {
+	state := &JournalState{starts: make(map[string]*journalEntry), dir: dir}
+	ended := make(map[string]bool)
+	var inProgress []string
+	scanner := bufio.NewScanner(r)
+	// Entries with kernel logs in them can get big.
+	scanner.Buffer(nil, 64*1024*1024)
+	var badLine error
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		if badLine != nil {
+			// Only the last line is allowed to be broken.
+			return nil, badLine
+		}
+		var entry journalEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			badLine = fmt.Errorf("%s:%d: %w", name, lineNum, err)
+			continue
+		}
+		switch entry.Event {
+		case eventRunStart:
+			if state.Tests != nil {
+				return nil, fmt.Errorf("%s:%d: more than one run", name, lineNum)
+			}
+			state.Tests = entry.Tests
+			if entry.Host != nil {
+				state.Host = *entry.Host
+			}
+		case eventTestStart:
+			state.starts[entry.TestID] = &entry
+			inProgress = append(inProgress, entry.TestID)
+		case eventTestEnd:
+			if entry.Result == nil {
+				return nil, fmt.Errorf("%s:%d: test_end without result", name, lineNum)
+			}
+			ended[entry.TestID] = true
+			state.Results = append(state.Results, decodeResult(entry.TestID, entry.Result, dir))
+		case eventOutput:
+		case eventRunEnd:
+			state.Finished = true
+		default:
+			return nil, fmt.Errorf("%s:%d: unknown event %q", name, lineNum, entry.Event)
+		}
+		if onEntry != nil {
+			onEntry(&entry)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("reading %s: %w", name, err)
+	}
+	if state.Tests == nil {
+		return nil, fmt.Errorf("%s doesn't record the start of a run", name)
+	}
+
+	for _, testID := range inProgress {
+		if !ended[testID] {
+			state.InProgress = append(state.InProgress, testID)
+		}
+	}
+	for _, testID := range state.Tests {
+		if state.starts[testID] == nil && !ended[testID] {
+			state.NotStarted = append(state.NotStarted, testID)
+		}
+	}
+	return state, nil
+}
+
+// CrashedResults returns TestCrashed results for the tests that were in
+// progress, and TestDropped results for the ones that never started. This is
+// for reporting a run that isn't going to be resumed.
+func (s *JournalState) CrashedResults() []*TestResult {
+	var results []*TestResult
+	now := time.Now()
+	for _, testID := range s.InProgress {
+		results = append(results, s.CrashedResult(testID))
+	}
+	for _, testID := range s.NotStarted {
+		results = append(results, &TestResult{
+			TestID:    testID,
+			Result:    TestDropped,
+			StartTime: now,
+			EndTime:   now,
+		})
+	}
+	return results
+}
+
+// CrashedResult returns a TestCrashed result for a test that was in progress
+// when the kernel went away. There's no way to know how long it ran for, so
+// the end time is the same as the start time.
+func (s *JournalState) CrashedResult(testID string) *TestResult {
+	result := &TestResult{
+		TestID: testID,
+		Result: TestCrashed,
+		Err:    errors.New("test was running when the kernel crashed or rebooted"),
+	}
+	if start := s.starts[testID]; start != nil {
+		result.StartTime = start.Time
+		result.LogFile = absPath(s.dir, start.LogFile)
+	}
+	result.EndTime = result.StartTime
+	return result
+}
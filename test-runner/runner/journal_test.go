@@ -0,0 +1,263 @@
+package runner
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+
+	"test-runner/test_conf"
+)
+
+func TestJournalRoundTrip(t *testing.T) {
+	tmpDir := t.TempDir()
+	logDir := filepath.Join(tmpDir, "logs")
+	if err := os.MkdirAll(logDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	journalPath := filepath.Join(logDir, JournalFileName)
+
+	tests := map[string]test_conf.Test{
+		"suite.fail": {Command: []string{"bash", "-c", "echo oops; exit 1"}},
+		"suite.pass": {Command: []string{"bash", "-c", "exit 0"}},
+		"suite.skip": {Command: []string{"bash", "-c", "exit 0"}, Tags: []string{"slow"}},
+	}
+	journal, err := CreateJournal(journalPath, []string{"suite.skip", "suite.pass", "suite.fail"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	runResults, err := RunTests(&RunOptions{
+		RequestedTests: tests,
+		SkipTags:       map[string]bool{"slow": true},
+		LogDir:         logDir,
+		Journal:        journal,
+	})
+	if err != nil {
+		t.Fatalf("RunTests returned error: %v", err)
+	}
+	journal.Close()
+
+	// Reading it from somewhere else should find the logs in the new place.
+	movedDir := filepath.Join(tmpDir, "moved")
+	if err := os.Rename(logDir, movedDir); err != nil {
+		t.Fatal(err)
+	}
+	state, err := ReadJournal(filepath.Join(movedDir, JournalFileName))
+	if err != nil {
+		t.Fatalf("ReadJournal returned error: %v", err)
+	}
+
+	if diff := cmp.Diff([]string{"suite.fail", "suite.pass", "suite.skip"}, state.Tests); diff != "" {
+		t.Errorf("Tests mismatch (-want +got):\n%s", diff)
+	}
+	if len(state.InProgress) != 0 || len(state.NotStarted) != 0 {
+		t.Errorf("expected everything to have finished, got InProgress %v NotStarted %v", state.InProgress, state.NotStarted)
+	}
+	got := make(map[string]*TestResult)
+	for _, result := range state.Results {
+		got[result.TestID] = result
+	}
+	for _, want := range runResults {
+		result := got[want.TestID]
+		if result == nil {
+			t.Errorf("no result for %s in journal", want.TestID)
+			continue
+		}
+		if result.Result != want.Result || result.SkipReason != want.SkipReason {
+			t.Errorf("%s: expected %s %q, got %s %q", want.TestID, want.Result, want.SkipReason, result.Result, result.SkipReason)
+		}
+		if !result.StartTime.Equal(want.StartTime) || !result.EndTime.Equal(want.EndTime) {
+			t.Errorf("%s: times don't match", want.TestID)
+		}
+	}
+	wantLog := filepath.Join(movedDir, "suite", "fail.log")
+	if got["suite.fail"].LogFile != wantLog {
+		t.Errorf("expected log file %s, got %s", wantLog, got["suite.fail"].LogFile)
+	}
+}
+
+func TestReadJournalCrashed(t *testing.T) {
+	logDir := t.TempDir()
+	journalPath := filepath.Join(logDir, JournalFileName)
+	journal, err := CreateJournal(journalPath, []string{"suite.a", "suite.b", "suite.c"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := journal.TestStarted("suite.a", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := journal.TestEnded(&TestResult{TestID: "suite.a", Result: TestPassed}); err != nil {
+		t.Fatal(err)
+	}
+	if err := journal.TestStarted("suite.b", filepath.Join(logDir, "suite", "b.log")); err != nil {
+		t.Fatal(err)
+	}
+	// Simulate a crash while an entry was being written.
+	if _, err := journal.f.WriteString(`{"event":"test_e`); err != nil {
+		t.Fatal(err)
+	}
+	journal.Close()
+
+	state, err := ReadJournal(journalPath)
+	if err != nil {
+		t.Fatalf("ReadJournal returned error: %v", err)
+	}
+	if diff := cmp.Diff([]string{"suite.b"}, state.InProgress); diff != "" {
+		t.Errorf("InProgress mismatch (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff([]string{"suite.c"}, state.NotStarted); diff != "" {
+		t.Errorf("NotStarted mismatch (-want +got):\n%s", diff)
+	}
+	crashed := state.CrashedResult("suite.b")
+	if crashed.Result != TestCrashed || crashed.LogFile != filepath.Join(logDir, "suite", "b.log") {
+		t.Errorf("unexpected crashed result %+v", crashed)
+	}
+
+	// Resuming should drop the broken entry and carry on.
+	journal, err = AppendJournal(journalPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := journal.TestEnded(crashed); err != nil {
+		t.Fatal(err)
+	}
+	journal.Close()
+	state, err = ReadJournal(journalPath)
+	if err != nil {
+		t.Fatalf("ReadJournal after resuming returned error: %v", err)
+	}
+	if len(state.InProgress) != 0 {
+		t.Errorf("expected nothing in progress after resuming, got %v", state.InProgress)
+	}
+	if len(state.Results) != 2 || state.Results[1].Result != TestCrashed {
+		t.Errorf("unexpected results after resuming: %+v", state.Results)
+	}
+}
+
+type nopWriteCloser struct{ io.Writer }
+
+func (nopWriteCloser) Close() error { return nil }
+
+func TestReadStream(t *testing.T) {
+	var buf bytes.Buffer
+	j := &Journal{w: nopWriteCloser{&buf}, stream: true}
+	if err := j.runStarted([]string{"suite.b", "suite.a"}); err != nil {
+		t.Fatal(err)
+	}
+	j.TestStarted("suite.a", "")
+	j.outputWriter("suite.a").Write([]byte("hello\n"))
+	j.TestEnded(&TestResult{TestID: "suite.a", Result: TestPassed})
+	j.TestStarted("suite.b", "")
+	j.outputWriter("suite.b").Write([]byte("about to crash\n"))
+	// Connection drops here.
+
+	var console bytes.Buffer
+	state, err := ReadStream(&buf, &console, "")
+	if err != nil {
+		t.Fatalf("ReadStream returned error: %v", err)
+	}
+	wantConsole := "hello\n" + fmt.Sprintf("%-60s %s\n", "suite.a", TestPassed) + "about to crash\n"
+	if diff := cmp.Diff(wantConsole, console.String()); diff != "" {
+		t.Errorf("console output mismatch (-want +got):\n%s", diff)
+	}
+	if state.Finished {
+		t.Errorf("expected run not to be finished")
+	}
+	if diff := cmp.Diff([]string{"suite.b"}, state.InProgress); diff != "" {
+		t.Errorf("InProgress mismatch (-want +got):\n%s", diff)
+	}
+}
+
+type failingWriteCloser struct{ writes int }
+
+func (w *failingWriteCloser) Write(data []byte) (int, error) {
+	w.writes++
+	return 0, fmt.Errorf("connection reset by peer")
+}
+
+func (*failingWriteCloser) Close() error { return nil }
+
+func TestBrokenStream(t *testing.T) {
+	w := &failingWriteCloser{}
+	j := &Journal{w: w, stream: true}
+	if err := j.TestStarted("suite.a", ""); err != nil {
+		t.Errorf("TestStarted returned error for a broken stream: %v", err)
+	}
+	if err := j.TestEnded(&TestResult{TestID: "suite.a", Result: TestPassed}); err != nil {
+		t.Errorf("TestEnded returned error for a broken stream: %v", err)
+	}
+	if err := j.RunEnded(); err != nil {
+		t.Errorf("RunEnded returned error for a broken stream: %v", err)
+	}
+	if w.writes != 1 {
+		t.Errorf("broken stream got %d writes, want 1", w.writes)
+	}
+
+	// Journal files are what resuming relies on, so they still fail.
+	j = &Journal{w: &failingWriteCloser{}}
+	if err := j.RunEnded(); err == nil {
+		t.Errorf("expected an error writing a broken journal")
+	}
+}
+
+func TestReadStreamLogs(t *testing.T) {
+	// Like a stream from a runner that still sent its own paths.
+	var buf bytes.Buffer
+	j := &Journal{w: nopWriteCloser{&buf}}
+	if err := j.runStarted([]string{"suite.a", "suite.b"}); err != nil {
+		t.Fatal(err)
+	}
+	j.TestStarted("suite.a", "/guest/logs/suite/a.log")
+	j.write(&journalEntry{Event: eventOutput, TestID: "suite.a", Data: "hello\n"})
+	j.TestEnded(&TestResult{TestID: "suite.a", Result: TestFailed, LogFile: "/guest/logs/suite/a.log"})
+	j.TestStarted("suite.b", "/guest/logs/suite/b.log")
+
+	logDir := t.TempDir()
+	state, err := ReadStream(&buf, io.Discard, logDir)
+	if err != nil {
+		t.Fatalf("ReadStream returned error: %v", err)
+	}
+	logFile := filepath.Join(logDir, "suite", "a.log")
+	if len(state.Results) != 1 || state.Results[0].LogFile != logFile {
+		t.Fatalf("expected suite.a's log at %s, got results %+v", logFile, state.Results)
+	}
+	if content, err := os.ReadFile(logFile); err != nil || string(content) != "hello\n" {
+		t.Errorf("saved log is %q, %v", content, err)
+	}
+	// It didn't send any output, so there's no log for it.
+	if crashed := state.CrashedResult("suite.b"); crashed.LogFile != "" {
+		t.Errorf("crashed test has log %q, want none", crashed.LogFile)
+	}
+}
+
+func TestStalledStream(t *testing.T) {
+	defer func(timeout time.Duration) { streamWriteTimeout = timeout }(streamWriteTimeout)
+	streamWriteTimeout = 50 * time.Millisecond
+
+	// Nothing ever reads from the other end.
+	conn, other := net.Pipe()
+	defer other.Close()
+	j := &Journal{w: conn, stream: true}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		j.outputWriter("suite.a").Write([]byte("hello\n"))
+		if err := j.TestEnded(&TestResult{TestID: "suite.a", Result: TestPassed}); err != nil {
+			t.Errorf("TestEnded returned error for a stalled stream: %v", err)
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("writes to a stalled stream didn't time out")
+	}
+	if !j.broken {
+		t.Errorf("stalled stream wasn't given up on")
+	}
+}
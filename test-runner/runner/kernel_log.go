@@ -0,0 +1,126 @@
+package runner
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"test-runner/kmsg"
+	"test-runner/taint"
+	"test-runner/test_conf"
+)
+
+// checkKmsg returns whether the kernel log can be captured from path. It's
+// fine for it not to exist (e.g. in a container), but if it exists and can't
+// be read, that's worth telling the user about.
+func checkKmsg(path string) bool {
+	if path == "" {
+		return false
+	}
+	r, err := kmsg.Open(path)
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			fmt.Printf("Warning: not capturing kernel log: %v\n", err)
+		}
+		return false
+	}
+	r.Close()
+	return true
+}
+
+// attemptLogPath returns the path for an output file for the nth attempt at a
+// test, e.g. suite/test.log for the first attempt and suite/test.attempt2.log
+// for the second one. Names with dots in them are used as they are, so test
+// mm.ksft_gup_test\.sh logs to mm/ksft_gup_test.sh.log.
+func attemptLogPath(logDir string, testID string, n int, ext string) string {
+	suffix := ext
+	if n > 1 {
+		suffix = fmt.Sprintf(".attempt%d%s", n, ext)
+	}
+	return filepath.Join(logDir, filepath.Join(test_conf.SplitID(testID)...)+suffix)
+}
+
+// collectKernelLog reads the kernel log messages that appeared while the
+// attempt was running and saves them next to its log, if there were any.
+func collectKernelLog(r *kmsg.Reader, attempt *Attempt, logDir string, testID string, n int) error {
+	records, err := r.ReadAvailable()
+	attempt.KernelLog = records
+	if err != nil {
+		return fmt.Errorf("reading kernel log: %w", err)
+	}
+	if logDir == "" || len(records) == 0 {
+		return nil
+	}
+
+	var b strings.Builder
+	for _, record := range records {
+		b.WriteString(record.String())
+		b.WriteString("\n")
+	}
+	path := attemptLogPath(logDir, testID, n, ".dmesg")
+	if err := os.WriteFile(path, []byte(b.String()), 0644); err != nil {
+		return fmt.Errorf("writing kernel log: %w", err)
+	}
+	attempt.KernelLogFile = path
+	return nil
+}
+
+// checkKernelErrors looks for kernel bug reports in the attempt's kernel log
+// and applies the policy. Kernel errors aren't retried, since a retry that
+// doesn't trigger the bug doesn't mean the bug went away.
+func checkKernelErrors(testID string, attempt *Attempt, policy KernelErrorPolicy, consoleWriter io.Writer) {
+	if policy == KernelErrorsIgnore {
+		return
+	}
+	attempt.Splats = kmsg.FindSplats(attempt.KernelLog)
+	if len(attempt.Splats) == 0 {
+		return
+	}
+	fmt.Fprintf(consoleWriter, "Kernel error during %s: %s\n", testID, attempt.Splats[0].Title)
+	if policy != KernelErrorsWarn {
+		attempt.Result = TestKernelError
+	}
+}
+
+// checkTainted returns whether the kernel taint can be read from path. Like
+// for the kernel log, it's fine if it doesn't exist.
+func checkTainted(path string) bool {
+	if path == "" {
+		return false
+	}
+	if _, err := taint.Read(path); err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			fmt.Printf("Warning: not tracking kernel taint: %v\n", err)
+		}
+		return false
+	}
+	return true
+}
+
+func taintMask(opts *RunOptions) taint.Taint {
+	if opts.TaintMask == nil {
+		return DefaultTaintMask
+	}
+	return *opts.TaintMask
+}
+
+// checkTaint applies the TaintFail and TaintMark policies to the attempt,
+// TaintAbort is handled by RunTests. It returns whether the attempt failed
+// because of the taint. Those failures aren't retried: taint flags stay set, so
+// a retry would never see them as new and would always pass.
+func checkTaint(testID string, attempt *Attempt, opts *RunOptions, consoleWriter io.Writer) bool {
+	if attempt.NewTaint == 0 {
+		return false
+	}
+	fmt.Fprintf(consoleWriter, "Kernel was tainted during %s: %s\n", testID, attempt.NewTaint)
+	if opts.OnTaint == TaintFail && attempt.NewTaint&taintMask(opts) != 0 && attempt.Result != TestKernelError {
+		attempt.Result = TestFailed
+		attempt.Err = fmt.Errorf("kernel was tainted: %s", attempt.NewTaint)
+		return true
+	}
+	return false
+}
@@ -0,0 +1,97 @@
+package runner
+
+import (
+	"os"
+	"os/exec"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Used when RunOptions.KillGracePeriod is zero.
+const defaultKillGracePeriod = 10 * time.Second
+
+// runWithTimeout runs cmd in its own process group. If timeout is non-zero and
+// it expires before the command exits, the whole group gets SIGTERM, and then
+// SIGKILL if it's still around after grace. We signal the group instead of just
+// the process because tests are often shell scripts, and killing the shell
+// leaves its children holding the output pipes, so Wait would never return.
+// Being in its own group means the test doesn't get the runner's Ctrl-C from
+// the terminal, so that gets forwarded, see forwardSignals.
+//
+// Returns whether the timeout expired, whether it was necessary to escalate to
+// SIGKILL, and the error from cmd.Wait.
+func runWithTimeout(cmd *exec.Cmd, timeout, grace time.Duration) (timedOut bool, killed bool, err error) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	forwardSignalsOnce.Do(forwardSignals)
+	groups.Lock()
+	if err := cmd.Start(); err != nil {
+		groups.Unlock()
+		return false, false, err
+	}
+	pgid := cmd.Process.Pid
+	groups.pgids[pgid] = true
+	groups.Unlock()
+	defer func() {
+		groups.Lock()
+		delete(groups.pgids, pgid)
+		groups.Unlock()
+	}()
+
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+
+	if timeout == 0 {
+		return false, false, <-done
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case err := <-done:
+		return false, false, err
+	case <-timer.C:
+	}
+
+	// Negative PID means the process group. Errors are ignored because the
+	// only likely one is ESRCH, i.e. it exited in the meantime.
+	syscall.Kill(-pgid, syscall.SIGTERM)
+	graceTimer := time.NewTimer(grace)
+	defer graceTimer.Stop()
+	select {
+	case err := <-done:
+		return true, false, err
+	case <-graceTimer.C:
+	}
+
+	syscall.Kill(-pgid, syscall.SIGKILL)
+	return true, true, <-done
+}
+
+// groups are the process groups of the tests that are running.
+var groups = struct {
+	sync.Mutex
+	pgids map[int]bool
+}{pgids: make(map[int]bool)}
+
+var forwardSignalsOnce sync.Once
+
+// forwardSignals makes SIGINT and SIGTERM go to the tests that are running as
+// well as the runner, like they would if the tests were in the runner's
+// process group. Then the runner gets the signal again with the default
+// handling, so it dies like it would have anyway.
+func forwardSignals() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := (<-signals).(syscall.Signal)
+		// Holding the lock stops any more tests from starting.
+		groups.Lock()
+		for pgid := range groups.pgids {
+			syscall.Kill(-pgid, sig)
+		}
+		signal.Reset(syscall.SIGINT, syscall.SIGTERM)
+		syscall.Kill(os.Getpid(), sig)
+	}()
+}
@@ -0,0 +1,219 @@
+package runner
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"time"
+
+	"test-runner/kmsg"
+	"test-runner/ktap"
+	"test-runner/taint"
+)
+
+// resultRecord is how a TestResult or Attempt is stored as JSON, in the
+// results file and the journal. Fields can be added, but existing ones
+// shouldn't change, since scripts read this.
+type resultRecord struct {
+	TestID    string     `json:"test_id,omitempty"`
+	Status    TestStatus `json:"status"`
+	StartTime time.Time  `json:"start_time"`
+	EndTime   time.Time  `json:"end_time"`
+	// Redundant, just for convenience. Ignored when reading.
+	DurationSeconds float64        `json:"duration_seconds"`
+	LogFile         string         `json:"log_file,omitempty"`
+	Err             string         `json:"error,omitempty"`
+	SkipReason      string         `json:"skip_reason,omitempty"`
+	TimeoutSeconds  float64        `json:"timeout_seconds,omitempty"`
+	Tags            []string       `json:"tags,omitempty"`
+	Command         []string       `json:"command,omitempty"`
+	Attempts        []resultRecord `json:"attempts,omitempty"`
+	Subtests        []*ktap.Result `json:"subtests,omitempty"`
+	KernelLog       []kmsg.Record  `json:"kernel_log,omitempty"`
+	KernelLogFile   string         `json:"kernel_log_file,omitempty"`
+	Splats          []kmsg.Splat   `json:"splats,omitempty"`
+	NewTaint        taint.Taint    `json:"new_taint,omitempty"`
+	ArtifactDir     string         `json:"artifact_dir,omitempty"`
+}
+
+// dropPaths removes the paths to files from a record, including its attempts.
+func (r *resultRecord) dropPaths() {
+	r.LogFile, r.KernelLogFile, r.ArtifactDir = "", "", ""
+	for i := range r.Attempts {
+		r.Attempts[i].dropPaths()
+	}
+}
+
+// relPath makes path relative to dir, if it's inside it.
+func relPath(dir, path string) string {
+	if path == "" || dir == "" {
+		return path
+	}
+	rel, err := filepath.Rel(dir, path)
+	if err != nil || !filepath.IsLocal(rel) {
+		return path
+	}
+	return rel
+}
+
+func absPath(dir, path string) string {
+	if path == "" || filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(dir, path)
+}
+
+func fromSeconds(seconds float64) time.Duration {
+	return time.Duration(math.Round(seconds * float64(time.Second)))
+}
+
+func errString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
+
+func errFromString(s string) error {
+	if s == "" {
+		return nil
+	}
+	return errors.New(s)
+}
+
+// encodeResult converts a result for storing, with log paths relative to dir.
+func encodeResult(result *TestResult, dir string) *resultRecord {
+	r := &resultRecord{
+		TestID:          result.TestID,
+		Status:          result.Result,
+		StartTime:       result.StartTime,
+		EndTime:         result.EndTime,
+		DurationSeconds: result.EndTime.Sub(result.StartTime).Seconds(),
+		LogFile:         relPath(dir, result.LogFile),
+		Err:             errString(result.Err),
+		SkipReason:      result.SkipReason,
+		TimeoutSeconds:  result.Timeout.Seconds(),
+		Tags:            result.Tags,
+		Command:         result.Command,
+		Subtests:        result.Subtests,
+		KernelLog:       result.KernelLog,
+		KernelLogFile:   relPath(dir, result.KernelLogFile),
+		Splats:          result.Splats,
+		NewTaint:        result.NewTaint,
+		ArtifactDir:     relPath(dir, result.ArtifactDir),
+	}
+	for _, a := range result.Attempts {
+		r.Attempts = append(r.Attempts, resultRecord{
+			Status:          a.Result,
+			StartTime:       a.StartTime,
+			EndTime:         a.EndTime,
+			DurationSeconds: a.EndTime.Sub(a.StartTime).Seconds(),
+			LogFile:         relPath(dir, a.LogFile),
+			Err:             errString(a.Err),
+			SkipReason:      a.SkipReason,
+			TimeoutSeconds:  a.Timeout.Seconds(),
+			Subtests:        a.Subtests,
+			KernelLog:       a.KernelLog,
+			KernelLogFile:   relPath(dir, a.KernelLogFile),
+			Splats:          a.Splats,
+			NewTaint:        a.NewTaint,
+		})
+	}
+	return r
+}
+
+// decodeResult is the inverse of encodeResult. Errors only have their
+// messages left.
+func decodeResult(testID string, r *resultRecord, dir string) *TestResult {
+	result := &TestResult{
+		TestID:        testID,
+		Result:        r.Status,
+		StartTime:     r.StartTime,
+		EndTime:       r.EndTime,
+		LogFile:       absPath(dir, r.LogFile),
+		Err:           errFromString(r.Err),
+		SkipReason:    r.SkipReason,
+		Timeout:       fromSeconds(r.TimeoutSeconds),
+		Tags:          r.Tags,
+		Command:       r.Command,
+		Subtests:      r.Subtests,
+		KernelLog:     r.KernelLog,
+		KernelLogFile: absPath(dir, r.KernelLogFile),
+		Splats:        r.Splats,
+		NewTaint:      r.NewTaint,
+		ArtifactDir:   absPath(dir, r.ArtifactDir),
+	}
+	for _, a := range r.Attempts {
+		result.Attempts = append(result.Attempts, &Attempt{
+			Result:        a.Status,
+			StartTime:     a.StartTime,
+			EndTime:       a.EndTime,
+			LogFile:       absPath(dir, a.LogFile),
+			Err:           errFromString(a.Err),
+			SkipReason:    a.SkipReason,
+			Timeout:       fromSeconds(a.TimeoutSeconds),
+			Subtests:      a.Subtests,
+			KernelLog:     a.KernelLog,
+			KernelLogFile: absPath(dir, a.KernelLogFile),
+			Splats:        a.Splats,
+			NewTaint:      a.NewTaint,
+		})
+	}
+	return result
+}
+
+// The version of the results file format. Only bumped for incompatible
+// changes.
+const resultsFileVersion = 1
+
+type resultsFile struct {
+	Version int             `json:"version"`
+	Host    Host            `json:"host"`
+	Results []*resultRecord `json:"results"`
+}
+
+// WriteResultsJSON saves results from the given host to a file at path. Log
+// paths are stored relative to the file's directory where possible, so the file
+// can be moved along with the logs.
+func WriteResultsJSON(results []*TestResult, host Host, path string) error {
+	dir := filepath.Dir(path)
+	file := resultsFile{Version: resultsFileVersion, Host: host, Results: []*resultRecord{}}
+	for _, result := range results {
+		file.Results = append(file.Results, encodeResult(result, dir))
+	}
+	data, err := json.MarshalIndent(file, "", "  ")
+	if err != nil {
+		return fmt.Errorf("encoding results: %w", err)
+	}
+	if err := os.WriteFile(path, append(data, '\n'), 0644); err != nil {
+		return fmt.Errorf("writing results: %w", err)
+	}
+	return nil
+}
+
+// ReadResultsJSON reads a file written by WriteResultsJSON.
+func ReadResultsJSON(path string) ([]*TestResult, Host, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, Host{}, fmt.Errorf("reading results: %w", err)
+	}
+	var file resultsFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, Host{}, fmt.Errorf("parsing results %s: %w", path, err)
+	}
+	if file.Version != resultsFileVersion {
+		return nil, Host{}, fmt.Errorf("results %s have version %d, only %d is supported", path, file.Version, resultsFileVersion)
+	}
+	dir := filepath.Dir(path)
+	var results []*TestResult
+	for _, r := range file.Results {
+		if r.TestID == "" {
+			return nil, Host{}, fmt.Errorf("result without test_id in %s", path)
+		}
+		results = append(results, decodeResult(r.TestID, r, dir))
+	}
+	return results, file.Host, nil
+}
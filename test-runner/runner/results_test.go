@@ -0,0 +1,97 @@
+package runner
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+)
+
+func TestStatusNames(t *testing.T) {
+	for status, name := range statusNames {
+		if got := status.Name(); got != name {
+			t.Errorf("expected name %q for %s, got %q", name, status, got)
+		}
+		parsed, err := ParseStatus(name)
+		if err != nil {
+			t.Errorf("ParseStatus(%q) returned error: %v", name, err)
+		}
+		if parsed != status {
+			t.Errorf("ParseStatus(%q) returned %s, expected %s", name, parsed, status)
+		}
+	}
+	if _, err := ParseStatus("PASS ✔️"); err == nil {
+		t.Errorf("expected error parsing a status that isn't a name")
+	}
+}
+
+func TestResultsJSONRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "results.json")
+	start := time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC)
+	results := []*TestResult{
+		{
+			TestID:      "suite.fail",
+			Result:      TestFailed,
+			StartTime:   start,
+			EndTime:     start.Add(1500 * time.Millisecond),
+			LogFile:     filepath.Join(dir, "suite", "fail.log"),
+			ArtifactDir: filepath.Join(dir, "suite", "fail.artifacts"),
+			Tags:        []string{"slow"},
+			Command:     []string{"false"},
+		},
+		{
+			TestID:     "suite.skip",
+			Result:     TestSkipped,
+			StartTime:  start,
+			EndTime:    start,
+			SkipReason: "[slow]",
+		},
+		{
+			TestID:    "suite.error",
+			Result:    TestError,
+			StartTime: start,
+			EndTime:   start,
+			LogFile:   "/somewhere/else.log",
+			Err:       errors.New("exec: not found"),
+		},
+		{
+			TestID:    "suite.timeout",
+			Result:    TestTimeout,
+			StartTime: start,
+			EndTime:   start.Add(100 * time.Millisecond),
+			Err:       errors.New("terminated with SIGTERM"),
+			Timeout:   100 * time.Millisecond,
+		},
+	}
+	host := Host{Hostname: "testvm", KernelRelease: "6.12.0"}
+	if err := WriteResultsJSON(results, host, path); err != nil {
+		t.Fatalf("WriteResultsJSON returned error: %v", err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{`"status": "FAIL"`, `"log_file": "suite/fail.log"`, `"artifact_dir": "suite/fail.artifacts"`, `"duration_seconds": 1.5`, `"timeout_seconds": 0.1`} {
+		if !strings.Contains(string(data), want) {
+			t.Errorf("results file doesn't contain %s:\n%s", want, data)
+		}
+	}
+
+	got, gotHost, err := ReadResultsJSON(path)
+	if err != nil {
+		t.Fatalf("ReadResultsJSON returned error: %v", err)
+	}
+	errMessage := cmp.Comparer(func(a, b error) bool { return errString(a) == errString(b) })
+	if diff := cmp.Diff(results, got, errMessage, cmpopts.EquateEmpty()); diff != "" {
+		t.Errorf("results mismatch (-want +got):\n%s", diff)
+	}
+	if gotHost != host {
+		t.Errorf("expected host %+v, got %+v", host, gotHost)
+	}
+}
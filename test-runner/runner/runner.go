@@ -1,6 +1,7 @@
 package runner
 
 import (
+	"bytes"
 	"fmt"
 	"io"
 	"os"
@@ -8,8 +9,15 @@ import (
 	"path/filepath"
 	"sort"
 	"strings"
+	"sync"
 	"time"
 
+	"test-runner/kconfig"
+	"test-runner/kmsg"
+	"test-runner/ktap"
+	"test-runner/sysinfo"
+	"test-runner/tagexpr"
+	"test-runner/taint"
 	"test-runner/test_conf"
 )
 
@@ -19,39 +27,229 @@ var (
 	TestFailed TestStatus = "FAIL ❌"
 	TestPassed TestStatus = "PASS ✔️"
 	TestError  TestStatus = "ERR  🔥"
-	// Skipped due to tags.
+	// Skipped due to tags, or the test reported that it skipped.
 	TestSkipped TestStatus = "SKIP 🫥"
 	// Not run because we aborted.
 	TestDropped TestStatus = "DROP ⏸️"
+	// Killed because it ran for longer than its timeout.
+	TestTimeout TestStatus = "TIMEOUT ⏰"
+	// Failed at least once, but then passed on a retry.
+	TestFlaky TestStatus = "FLAKY 🎲"
+	// The kernel reported a bug (WARN, KASAN etc) while the test was running.
+	TestKernelError TestStatus = "KERNEL_ERROR 💥"
+	// Was running when the kernel crashed or the machine rebooted, see
+	// ReadJournal.
+	TestCrashed TestStatus = "CRASH 💀"
 )
 
+// Names for the statuses in machine-readable output, these won't change.
+var statusNames = map[TestStatus]string{
+	TestFailed:      "FAIL",
+	TestPassed:      "PASS",
+	TestError:       "ERROR",
+	TestSkipped:     "SKIP",
+	TestDropped:     "DROP",
+	TestTimeout:     "TIMEOUT",
+	TestFlaky:       "FLAKY",
+	TestKernelError: "KERNEL_ERROR",
+	TestCrashed:     "CRASH",
+}
+
+// Name returns the stable name of the status, like "PASS".
+func (s TestStatus) Name() string {
+	if name, ok := statusNames[s]; ok {
+		return name
+	}
+	return string(s)
+}
+
+// ParseStatus is the inverse of TestStatus.Name.
+func ParseStatus(name string) (TestStatus, error) {
+	for status, n := range statusNames {
+		if n == name {
+			return status, nil
+		}
+	}
+	return "", fmt.Errorf("unknown test status %q", name)
+}
+
+// MarshalText makes statuses appear as their stable names in JSON.
+func (s TestStatus) MarshalText() ([]byte, error) {
+	return []byte(s.Name()), nil
+}
+
+func (s *TestStatus) UnmarshalText(text []byte) error {
+	status, err := ParseStatus(string(text))
+	if err != nil {
+		return err
+	}
+	*s = status
+	return nil
+}
+
+// KernelErrorPolicy says what to do when the kernel reports a bug while a test
+// is running.
+type KernelErrorPolicy string
+
+const (
+	// Report the test as TestKernelError, whatever its actual result.
+	KernelErrorsFail KernelErrorPolicy = "fail"
+	// Keep the test's result, but still record the splats and print a warning.
+	KernelErrorsWarn KernelErrorPolicy = "warn"
+	// Don't look for kernel bug reports at all.
+	KernelErrorsIgnore KernelErrorPolicy = "ignore"
+)
+
+// TaintPolicy says what to do when the kernel gets tainted while a test is
+// running.
+type TaintPolicy string
+
+const (
+	// Just record the new taint in the result and print a warning.
+	TaintMark TaintPolicy = "mark"
+	// Report the test as failed.
+	TaintFail TaintPolicy = "fail"
+	// Stop running tests, the remaining ones get reported as TestDropped.
+	TaintAbort TaintPolicy = "abort"
+)
+
+// Taint flags that trigger the TaintPolicy when RunOptions.TaintMask is nil.
+// Other flags like O (out-of-tree module) and N (test module) are set as a
+// normal part of running kernel tests.
+var DefaultTaintMask, _ = taint.FromLetters("BDLMW")
+
+// Attempt is a single run of a test's command. There's only more than one of
+// these when a test failed and was retried.
+type Attempt struct {
+	Result    TestStatus
+	StartTime time.Time
+	EndTime   time.Time
+	LogFile   string
+	Err       error
+	Timeout   time.Duration
+	// For TestSkipped, when the test itself reported that it skipped.
+	SkipReason string
+	// Parsed from the KTAP in the test's output, if there was any.
+	Subtests []*ktap.Result
+	// Kernel log messages that appeared while the test was running. When
+	// tests run in parallel, these might have come from another test.
+	KernelLog []kmsg.Record
+	// Where KernelLog was saved, if it wasn't empty and there's a LogDir.
+	KernelLogFile string
+	// Kernel bug reports found in KernelLog.
+	Splats []kmsg.Splat
+	// Taint flags that the kernel didn't have before the test ran but did
+	// afterwards.
+	NewTaint taint.Taint
+}
+
 type TestResult struct {
-	TestID     string
-	Result     TestStatus
-	StartTime  time.Time
-	EndTime    time.Time
-	LogFile    string
-	Err        error // For execution errors, not test failures
+	TestID    string
+	Result    TestStatus
+	StartTime time.Time
+	EndTime   time.Time
+	LogFile   string
+	Err       error // For execution errors, not test failures
+	// For TestSkipped. When the skip was due to tags this is a list of the
+	// tags like "[slow,flaky]", when the test itself reported that it skipped
+	// (via ExitCodes) it's a description like "test reported skip (exit code
+	// 4)", and when the machine didn't meet the test's requirements it's like
+	// "CONFIG_TEST_VMALLOC not set, needs 4 CPUs, have 2".
 	SkipReason string
+	// For TestTimeout, the timeout that expired.
+	Timeout time.Duration
+	// Only set if the test was retried, in which case it has every attempt
+	// including the last one. The fields above describe the last attempt,
+	// except StartTime, which is from the first.
+	Attempts []*Attempt
+	// Parsed from the KTAP in the (last attempt's) output, if there was any.
+	Subtests []*ktap.Result
+	// From the last attempt, see Attempt.
+	KernelLog     []kmsg.Record
+	KernelLogFile string
+	Splats        []kmsg.Splat
+	// Taint flags that were set during any of the attempts.
+	NewTaint taint.Taint
+	// The test's TEST_ARTIFACT_DIR, if the test left anything in it and it
+	// was kept (only when there's a LogDir).
+	ArtifactDir string
+	// From the test's config, for reporting.
+	Tags    []string
+	Command []string
+}
+
+// KernelErrorTitle describes a TestKernelError result, by the title of its
+// first splat. Results read back from JSON might not have any splats.
+func (r *TestResult) KernelErrorTitle() string {
+	if len(r.Splats) == 0 {
+		return "no splat recorded"
+	}
+	return r.Splats[0].Title
 }
 
 type RunOptions struct {
 	RequestedTests map[string]test_conf.Test
-	SkipTags       map[string]bool
-	IncludeBad     map[string]bool
-	BadTags        map[string]bool
-	LogDir         string
+	// Only run tests whose tags match this. Nil means all of them. The
+	// tags below get combined with it, see TagFilter.
+	Tags       *tagexpr.Expr
+	SkipTags   map[string]bool
+	IncludeBad map[string]bool
+	BadTags    map[string]bool
+	LogDir     string
 	// Stop running tests and return as soon as one fails. Not this really
 	// specifically refers to failure, this doesn't affect the behaviour for
 	// errors when running tests.
 	BailOnFailure bool
+	// Timeout for tests that don't have one in their config. Zero means no
+	// timeout.
+	DefaultTimeout time.Duration
+	// How long to wait between SIGTERM and SIGKILL when a test times out. Zero
+	// means defaultKillGracePeriod.
+	KillGracePeriod time.Duration
+	// Maximum number of tests to run at once. Values below 1 mean 1. Tests
+	// marked Exclusive never overlap with any other test, and tests sharing a
+	// resource never overlap with each other.
+	Jobs int
+	// Maps tags to a number of times to retry tests with that tag if they
+	// fail. This is on top of test_conf.Test.Retries, the biggest wins.
+	RetryTags map[string]int
+	// Exit code mapping for all tests. Test.ExitCodes takes precedence.
+	ExitCodes test_conf.ExitCodes
+	// Where to read the kernel log from, normally /dev/kmsg. Empty means
+	// don't capture it.
+	KmsgPath string
+	// Only matters if KmsgPath is set. Empty means KernelErrorsFail.
+	KernelErrors KernelErrorPolicy
+	// Where to read the kernel's taint flags from, normally
+	// taint.DefaultPath. Empty means don't track taint.
+	TaintedPath string
+	// What to do when a test taints the kernel with one of the flags in
+	// TaintMask. Empty means TaintMark. All new taint flags get recorded in
+	// the results whatever the policy and mask.
+	OnTaint TaintPolicy
+	// Nil means DefaultTaintMask. Zero means no flags trigger the policy.
+	TaintMask *taint.Taint
+	// The running kernel's config. Tests with RequiresKconfig that it doesn't
+	// meet get skipped. Nil means don't check.
+	Kconfig kconfig.Config
+	// Like Kconfig, but for Test.Requires. Also decides which of the tests'
+	// ConditionalTags apply, none of them do if this is nil.
+	SysInfo *sysinfo.Info
+	// If set, the start and end of each test gets recorded here. Errors
+	// writing to it are reported like errors running tests.
+	Journal *Journal
+	// Like Journal, but for a results stream (see DialStream), which also
+	// gets the tests' output. Errors writing to it are only warnings.
+	Stream *Journal
 }
 
 // RunTests runs the tests in the RequestedTests and returns TestResults. It
 // returns the first error encountered while running tests, but continues
 // running other tests afterwards. Is this a good design? Not sure.
+//
+// The results are in the order of the sorted test IDs, even if the tests
+// actually ran in parallel.
 func RunTests(opts *RunOptions) ([]*TestResult, error) {
-	var runResults []*TestResult
 	var testErr error
 
 	if opts.LogDir != "" {
@@ -60,139 +258,486 @@ func RunTests(opts *RunOptions) ([]*TestResult, error) {
 		}
 	}
 
+	// These print warnings, so only call them once.
+	kmsgOK, taintedOK := checkKmsg(opts.KmsgPath), checkTainted(opts.TaintedPath)
+	if !kmsgOK || !taintedOK {
+		optsCopy := *opts
+		if !kmsgOK {
+			optsCopy.KmsgPath = ""
+		}
+		if !taintedOK {
+			optsCopy.TaintedPath = ""
+		}
+		opts = &optsCopy
+	}
+
+	// Work out which of the conditional tags apply here, so that everything
+	// else only has to look at Tags.
+	resolved := make(map[string]test_conf.Test, len(opts.RequestedTests))
+	for testID, test := range opts.RequestedTests {
+		test.Tags = test.ResolveTags(opts.SysInfo)
+		resolved[testID] = test
+	}
+	optsCopy := *opts
+	optsCopy.RequestedTests = resolved
+	opts = &optsCopy
+
 	var testIDs []string
 	for testID := range opts.RequestedTests {
 		testIDs = append(testIDs, testID)
 	}
 	sort.Strings(testIDs)
 
-	for i, testID := range testIDs {
-		test := opts.RequestedTests[testID]
-		startTime := time.Now()
+	jobs := opts.Jobs
+	if jobs < 1 {
+		jobs = 1
+	}
 
-		if len(test.Command) == 0 {
-			runResults = append(runResults, &TestResult{
-				TestID:    testID,
-				Result:    TestError,
-				StartTime: startTime,
-				EndTime:   time.Now(),
-				Err:       fmt.Errorf("empty command"),
-			})
-			fmt.Printf("Error running %s: empty command\n", testID)
-			if testErr == nil {
-				testErr = fmt.Errorf("error running %s: empty command", testID)
-			}
-			continue
+	type completion struct {
+		idx    int
+		result *TestResult
+		err    error
+	}
+	runResults := make([]*TestResult, len(testIDs))
+	// Buffered so that workers never block, even after we stop listening.
+	done := make(chan completion, len(testIDs))
+	sched := newScheduler(jobs)
+	var outputLock sync.Mutex
+	bailing := false
+	var abortErr error
+
+	recordErr := func(err error) {
+		if err != nil && testErr == nil {
+			testErr = err
 		}
-		if skipped, skipTags := shouldSkipTest(test, opts.SkipTags, opts.IncludeBad, opts.BadTags); skipped {
-			runResults = append(runResults, &TestResult{
-				TestID:     testID,
-				Result:     TestSkipped,
-				StartTime:  startTime,
-				EndTime:    time.Now(),
-				SkipReason: fmt.Sprintf("[%s]", strings.Join(skipTags, ",")),
-			})
-			continue
+	}
+	var journals []*Journal
+	for _, j := range []*Journal{opts.Journal, opts.Stream} {
+		if j != nil {
+			journals = append(journals, j)
 		}
+	}
+	finish := func(i int, result *TestResult) {
+		test := opts.RequestedTests[result.TestID]
+		result.Tags = test.Tags
+		result.Command = test.FullCommand()
+		runResults[i] = result
+		for _, j := range journals {
+			recordErr(j.TestEnded(result))
+		}
+	}
 
-		var logFile string
-		var logWriter io.Writer
-		if opts.LogDir != "" {
-			logPath := filepath.Join(opts.LogDir, strings.ReplaceAll(testID, ".", "/")+".log")
-			if err := os.MkdirAll(filepath.Dir(logPath), 0755); err != nil {
-				return nil, fmt.Errorf("creating log directory for test %s: %w", testID, err)
+	// Indexes into testIDs of the tests that haven't been started yet.
+	var pending []int
+	for i, testID := range testIDs {
+		result, err := checkRunnable(testID, opts.RequestedTests[testID], opts)
+		recordErr(err)
+		if result != nil {
+			finish(i, result)
+		} else {
+			pending = append(pending, i)
+		}
+	}
+	for len(pending) > 0 || sched.running > 0 {
+		var stillPending []int
+		for pos, i := range pending {
+			if bailing {
+				now := time.Now()
+				finish(i, &TestResult{
+					TestID:    testIDs[i],
+					Result:    TestDropped,
+					StartTime: now,
+					EndTime:   now,
+				})
+				continue
 			}
-			f, err := os.Create(logPath)
-			if err != nil {
-				return nil, fmt.Errorf("creating log file for test %s: %w", testID, err)
+
+			test := opts.RequestedTests[testIDs[i]]
+			if !sched.canStart(test) {
+				stillPending = append(stillPending, i)
+				if test.Exclusive {
+					// Don't let later tests overtake an exclusive one,
+					// otherwise it might never get to run.
+					stillPending = append(stillPending, pending[pos+1:]...)
+					break
+				}
+				continue
 			}
-			defer f.Close()
-			logFile = logPath
-			logWriter = io.MultiWriter(f, os.Stdout)
-		} else {
-			logWriter = os.Stdout
+			sched.start(test)
+			var logFile string
+			if opts.LogDir != "" {
+				logFile = attemptLogPath(opts.LogDir, testIDs[i], 1, ".log")
+			}
+			for _, j := range journals {
+				recordErr(j.TestStarted(testIDs[i], logFile))
+			}
+			go func(idx int) {
+				result, err := runTest(testIDs[idx], opts.RequestedTests[testIDs[idx]], opts, &outputLock)
+				done <- completion{idx: idx, result: result, err: err}
+			}(i)
 		}
+		pending = stillPending
 
-		cmd := exec.Command(test.Command[0], test.Command[1:]...)
-		cmd.Stdout = logWriter
-		cmd.Stderr = logWriter
+		if sched.running == 0 {
+			continue
+		}
+		c := <-done
+		sched.finish(opts.RequestedTests[testIDs[c.idx]])
+		recordErr(c.err)
+		finish(c.idx, c.result)
+		if opts.BailOnFailure && failed(c.result) {
+			bailing = true
+		}
+		if opts.OnTaint == TaintAbort && c.result.NewTaint&taintMask(opts) != 0 && abortErr == nil {
+			bailing = true
+			abortErr = fmt.Errorf("aborting, kernel was tainted (%s) by %s", c.result.NewTaint, c.result.TestID)
+			fmt.Println(abortErr)
+		}
+	}
 
-		err := cmd.Run()
-		endTime := time.Now()
+	if abortErr != nil {
+		return runResults, abortErr
+	}
+	if bailing {
+		// Bailing out isn't considered an error.
+		return runResults, nil
+	}
+	return runResults, testErr
+}
 
-		result := &TestResult{
+// checkRunnable returns a result if the test should be reported without
+// actually running it.
+func checkRunnable(testID string, test test_conf.Test, opts *RunOptions) (*TestResult, error) {
+	now := time.Now()
+	if len(test.FullCommand()) == 0 {
+		fmt.Printf("Error running %s: empty command\n", testID)
+		return &TestResult{
 			TestID:    testID,
-			StartTime: startTime,
-			EndTime:   endTime,
-			LogFile:   logFile,
+			Result:    TestError,
+			StartTime: now,
+			EndTime:   now,
+			Err:       fmt.Errorf("empty command"),
+		}, fmt.Errorf("error running %s: empty command", testID)
+	}
+	if skipped, reasons := shouldSkipTest(test, opts.TagFilter()); skipped {
+		return &TestResult{
+			TestID:     testID,
+			Result:     TestSkipped,
+			StartTime:  now,
+			EndTime:    now,
+			SkipReason: fmt.Sprintf("[%s]", strings.Join(reasons, ",")),
+		}, nil
+	}
+	if unmet := UnmetRequirements(test, opts.Kconfig, opts.SysInfo); len(unmet) > 0 {
+		return &TestResult{
+			TestID:     testID,
+			Result:     TestSkipped,
+			StartTime:  now,
+			EndTime:    now,
+			SkipReason: strings.Join(unmet, ", "),
+		}, nil
+	}
+	return nil, nil
+}
+
+// UnmetRequirements returns the reasons the test can't run on this machine,
+// from its RequiresKconfig and Requires. Either kconfigs or info can be nil,
+// then those requirements aren't checked.
+func UnmetRequirements(test test_conf.Test, kconfigs kconfig.Config, info *sysinfo.Info) []string {
+	var unmet []string
+	if kconfigs != nil {
+		unmet = append(unmet, kconfigs.CheckAll(test.RequiresKconfig)...)
+	}
+	if info != nil {
+		unmet = append(unmet, info.Check(test.Requires)...)
+	}
+	return unmet
+}
+
+// failed returns whether a result should trigger BailOnFailure.
+func failed(result *TestResult) bool {
+	switch result.Result {
+	case TestFailed, TestTimeout, TestKernelError:
+		return true
+	case TestError:
+		_, exited := result.Err.(*exec.ExitError)
+		return exited
+	}
+	return false
+}
+
+// runTest runs a single test, re-running it if it fails and it has retries.
+// The error is for problems running the test, as opposed to the test failing.
+// When there are parallel jobs, the test's output is held back and then
+// printed all at once under outputLock when it finishes, so that it doesn't
+// get interleaved with other tests' output.
+func runTest(testID string, test test_conf.Test, opts *RunOptions, outputLock *sync.Mutex) (*TestResult, error) {
+	var consoleWriter io.Writer = os.Stdout
+	var consoleBuf *bytes.Buffer
+	if opts.Jobs > 1 {
+		consoleBuf = &bytes.Buffer{}
+		consoleWriter = consoleBuf
+		defer func() {
+			outputLock.Lock()
+			defer outputLock.Unlock()
+			fmt.Printf("=== %s ===\n", testID)
+			os.Stdout.Write(consoleBuf.Bytes())
+		}()
+	}
+
+	dirs, err := makeTestDirs(testID, opts.LogDir)
+	if err != nil {
+		now := time.Now()
+		return &TestResult{
+			TestID:    testID,
+			Result:    TestError,
+			StartTime: now,
+			EndTime:   now,
 			Err:       err,
+		}, err
+	}
+	env, cwd := commandEnv(testID, test, opts.LogDir, dirs)
+
+	retries := retriesFor(test, opts.RetryTags)
+	var attempts []*Attempt
+	for n := 1; n <= retries+1; n++ {
+		if n > 1 {
+			fmt.Fprintf(consoleWriter, "Retrying %s (attempt %d/%d)\n", testID, n, retries+1)
 		}
+		var attempt *Attempt
+		attempt, err = runAttempt(testID, test, opts, n, env, cwd, consoleWriter)
+		checkKernelErrors(testID, attempt, opts.KernelErrors, consoleWriter)
+		taintFailed := checkTaint(testID, attempt, opts, consoleWriter)
+		attempts = append(attempts, attempt)
+		if taintFailed || (attempt.Result != TestFailed && attempt.Result != TestTimeout) {
+			break
+		}
+	}
 
-		if err != nil {
-			if exitErr, ok := err.(*exec.ExitError); ok {
-				if exitErr.ExitCode() == 127 {
-					result.Result = TestError
-				} else {
-					result.Result = TestFailed
-				}
-				if opts.BailOnFailure {
-					runResults = append(runResults, result)
-					for j := i + 1; j < len(testIDs); j++ {
-						runResults = append(runResults, &TestResult{
-							TestID:    testIDs[j],
-							Result:    TestDropped,
-							StartTime: endTime,
-							EndTime:   endTime,
-						})
-					}
-					return runResults, nil
-				}
-			} else {
-				result.Result = TestError
-				fmt.Printf("Error running %s: %v\n", testID, err)
-				if testErr == nil {
-					testErr = fmt.Errorf("error running %s: %v", testID, err)
-				}
-			}
-		} else {
-			result.Result = TestPassed
+	first, last := attempts[0], attempts[len(attempts)-1]
+	result := &TestResult{
+		TestID:        testID,
+		Result:        last.Result,
+		StartTime:     first.StartTime,
+		EndTime:       last.EndTime,
+		LogFile:       last.LogFile,
+		Err:           last.Err,
+		Timeout:       last.Timeout,
+		Subtests:      last.Subtests,
+		SkipReason:    last.SkipReason,
+		KernelLog:     last.KernelLog,
+		KernelLogFile: last.KernelLogFile,
+		Splats:        last.Splats,
+	}
+	for _, attempt := range attempts {
+		result.NewTaint |= attempt.NewTaint
+	}
+	artifactDir, cleanupErr := dirs.cleanup()
+	if cleanupErr != nil {
+		fmt.Fprintf(consoleWriter, "Warning: %s: %v\n", testID, cleanupErr)
+	}
+	result.ArtifactDir = artifactDir
+	if len(attempts) > 1 {
+		result.Attempts = attempts
+		if last.Result == TestPassed {
+			result.Result = TestFlaky
 		}
-		runResults = append(runResults, result)
 	}
+	return result, err
+}
 
-	return runResults, testErr
+// retriesFor returns how many times a test should be re-run if it fails.
+func retriesFor(test test_conf.Test, retryTags map[string]int) int {
+	retries := test.Retries
+	for _, tag := range test.Tags {
+		if retryTags[tag] > retries {
+			retries = retryTags[tag]
+		}
+	}
+	return retries
 }
 
-// shouldSkipTest checks if a test should be skipped based on its tags.
-// Returns true and the tags causing the skip if it should be skipped.
-func shouldSkipTest(test test_conf.Test, skipTags, includeBad, badTags map[string]bool) (bool, []string) {
-	var foundBadTags []string
-	for _, testTag := range test.Tags {
-		if badTags[testTag] {
-			foundBadTags = append(foundBadTags, testTag)
+// runAttempt runs the test's command once, with the environment and working
+// directory from commandEnv. The first attempt logs to <test>.log, later ones
+// to <test>.attempt<n>.log.
+func runAttempt(testID string, test test_conf.Test, opts *RunOptions, n int, env []string, cwd string, consoleWriter io.Writer) (*Attempt, error) {
+	startTime := time.Now()
+
+	var logFile string
+	logWriter := consoleWriter
+	if opts.LogDir != "" {
+		logPath := attemptLogPath(opts.LogDir, testID, n, ".log")
+		err := os.MkdirAll(filepath.Dir(logPath), 0755)
+		var f *os.File
+		if err == nil {
+			f, err = os.Create(logPath)
+		}
+		if err != nil {
+			err = fmt.Errorf("creating log file for test %s: %w", testID, err)
+			return &Attempt{
+				Result:    TestError,
+				StartTime: startTime,
+				EndTime:   time.Now(),
+				Err:       err,
+			}, err
 		}
+		defer f.Close()
+		logFile = logPath
+		logWriter = io.MultiWriter(f, consoleWriter)
 	}
 
-	if len(foundBadTags) > 0 {
-		if len(includeBad) == 0 {
-			return true, foundBadTags
+	grace := opts.KillGracePeriod
+	if grace == 0 {
+		grace = defaultKillGracePeriod
+	}
+	timeout := time.Duration(test.Timeout)
+	if timeout == 0 {
+		timeout = opts.DefaultTimeout
+	}
+
+	parser := ktap.NewParser()
+	logWriter = io.MultiWriter(logWriter, parser)
+	if opts.Stream != nil {
+		logWriter = io.MultiWriter(logWriter, opts.Stream.outputWriter(testID))
+	}
+
+	var kmsgReader *kmsg.Reader
+	if opts.KmsgPath != "" {
+		var err error
+		kmsgReader, err = kmsg.Open(opts.KmsgPath)
+		if err != nil {
+			fmt.Fprintf(consoleWriter, "Warning: not capturing kernel log for %s: %v\n", testID, err)
+		} else {
+			defer kmsgReader.Close()
 		}
-		for _, testTag := range test.Tags {
-			if includeBad[testTag] {
-				return false, nil
-			}
+	}
+
+	var taintBefore taint.Taint
+	if opts.TaintedPath != "" {
+		var err error
+		if taintBefore, err = taint.Read(opts.TaintedPath); err != nil {
+			fmt.Fprintf(consoleWriter, "Warning: reading taint before %s: %v\n", testID, err)
+		}
+	}
+
+	command := test.FullCommand()
+	cmd := exec.Command(command[0], command[1:]...)
+	cmd.Env = env
+	cmd.Dir = cwd
+	cmd.Stdout = logWriter
+	cmd.Stderr = logWriter
+
+	timedOut, killed, err := runWithTimeout(cmd, timeout, grace)
+	endTime := time.Now()
+
+	var newTaint taint.Taint
+	if opts.TaintedPath != "" {
+		if taintAfter, err := taint.Read(opts.TaintedPath); err != nil {
+			fmt.Fprintf(consoleWriter, "Warning: reading taint after %s: %v\n", testID, err)
+		} else {
+			newTaint = taintAfter &^ taintBefore
+		}
+	}
+
+	attempt := &Attempt{
+		StartTime: startTime,
+		EndTime:   endTime,
+		LogFile:   logFile,
+		Err:       err,
+		Subtests:  parser.Finish(),
+		NewTaint:  newTaint,
+	}
+	if kmsgReader != nil {
+		if err := collectKernelLog(kmsgReader, attempt, opts.LogDir, testID, n); err != nil {
+			fmt.Fprintf(consoleWriter, "Warning: %s: %v\n", testID, err)
 		}
-		return true, foundBadTags
 	}
 
-	var foundSkipTags []string
-	for _, testTag := range test.Tags {
-		if skipTags[testTag] {
-			foundSkipTags = append(foundSkipTags, testTag)
+	if timedOut {
+		attempt.Result = TestTimeout
+		attempt.Timeout = timeout
+		// The timeout itself is in attempt.Timeout, this is how it ended.
+		if killed {
+			attempt.Err = fmt.Errorf("killed with SIGKILL after %v grace period", grace)
+		} else {
+			attempt.Err = fmt.Errorf("terminated with SIGTERM")
 		}
+		fmt.Fprintf(consoleWriter, "Test %s timed out after %v\n", testID, timeout)
+		return attempt, nil
 	}
-	if len(foundSkipTags) > 0 {
-		return true, foundSkipTags
+	exitErr, exited := err.(*exec.ExitError)
+	if err == nil || exited {
+		code := 0
+		if exited {
+			code = exitErr.ExitCode()
+		}
+		outcome, ok := test.ExitCodes[code]
+		if !ok {
+			outcome, ok = opts.ExitCodes[code]
+		}
+		if !ok {
+			outcome = defaultOutcome(code)
+		}
+		switch outcome {
+		case test_conf.OutcomePass:
+			attempt.Result = TestPassed
+			// Don't leave a misleading error around for a mapped exit code.
+			attempt.Err = nil
+		case test_conf.OutcomeSkip:
+			attempt.Result = TestSkipped
+			attempt.SkipReason = fmt.Sprintf("test reported skip (exit code %d)", code)
+			attempt.Err = nil
+		case test_conf.OutcomeError:
+			attempt.Result = TestError
+		case test_conf.OutcomeTimeout:
+			attempt.Result = TestTimeout
+		default:
+			attempt.Result = TestFailed
+		}
+		return attempt, nil
 	}
-	return false, nil
+	attempt.Result = TestError
+	fmt.Fprintf(consoleWriter, "Error running %s: %v\n", testID, err)
+	return attempt, fmt.Errorf("error running %s: %v", testID, err)
+}
+
+func defaultOutcome(exitCode int) test_conf.ExitCodeOutcome {
+	switch exitCode {
+	case 0:
+		return test_conf.OutcomePass
+	case 127:
+		return test_conf.OutcomeError
+	default:
+		return test_conf.OutcomeFail
+	}
+}
+
+// TagFilter returns the expression that decides which tests run, from their
+// tags. Tests have to match Tags. A test with one of the BadTags only runs if it
+// also has one of the IncludeBad tags, and then the SkipTags don't apply to it.
+// Otherwise, it mustn't have any of the SkipTags. Nil means all tests run.
+func (opts *RunOptions) TagFilter() *tagexpr.Expr {
+	var notSkipped *tagexpr.Expr
+	if skip := tagexpr.AnyTag(sortedMapKeys(opts.SkipTags)...); skip != nil {
+		notSkipped = tagexpr.Not(skip)
+	}
+	bad := tagexpr.AnyTag(sortedMapKeys(opts.BadTags)...)
+	if bad == nil {
+		return tagexpr.And(opts.Tags, notSkipped)
+	}
+	normal := tagexpr.And(tagexpr.Not(bad), notSkipped)
+	include := tagexpr.AnyTag(sortedMapKeys(opts.IncludeBad)...)
+	if include == nil {
+		return tagexpr.And(opts.Tags, normal)
+	}
+	return tagexpr.And(opts.Tags, tagexpr.Or(normal, tagexpr.And(bad, include)))
+}
+
+// shouldSkipTest checks if a test should be skipped based on its tags, which
+// have to include the conditional tags that apply (see RunTests). Returns true
+// and the reasons from tagexpr.Expr.Explain, like "slow" or "!kvm", if it should
+// be skipped.
+func shouldSkipTest(test test_conf.Test, filter *tagexpr.Expr) (bool, []string) {
+	reasons := filter.Explain(test.Tags)
+	return len(reasons) > 0, reasons
 }
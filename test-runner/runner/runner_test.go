@@ -1,11 +1,22 @@
 package runner
 
 import (
+	"fmt"
+	"os"
 	"path/filepath"
 	"sort"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/google/go-cmp/cmp"
+
+	"test-runner/kconfig"
+	"test-runner/kmsg"
+	"test-runner/ktap"
+	"test-runner/sysinfo"
+	"test-runner/tagexpr"
+	"test-runner/taint"
 	"test-runner/test_conf"
 )
 
@@ -162,3 +173,717 @@ func TestRunTestsBailOnFailure(t *testing.T) {
 		}
 	}
 }
+
+func TestRunTestsTimeout(t *testing.T) {
+	tmpDir := t.TempDir()
+	logDir := filepath.Join(tmpDir, "logs")
+
+	tests := map[string]test_conf.Test{
+		"suite.fast": {
+			Command: []string{"bash", "-c", "exit 0"},
+		},
+		// The backgrounded child holds the stdout pipe open, so this only
+		// finishes if the whole process group gets killed.
+		"suite.hang": {
+			Command: []string{"bash", "-c", "sleep 100 & wait"},
+		},
+		"suite.ignores_sigterm": {
+			Command: []string{"bash", "-c", "trap '' TERM; sleep 100 & wait"},
+			Timeout: test_conf.Duration(50 * time.Millisecond),
+		},
+	}
+
+	opts := &RunOptions{
+		RequestedTests:  tests,
+		LogDir:          logDir,
+		DefaultTimeout:  100 * time.Millisecond,
+		KillGracePeriod: 100 * time.Millisecond,
+	}
+
+	start := time.Now()
+	runResults, err := RunTests(opts)
+	if err != nil {
+		t.Fatalf("RunTests returned error: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf("RunTests took %v, timeouts don't seem to have worked", elapsed)
+	}
+
+	wantStatus := map[string]TestStatus{
+		"suite.fast":            TestPassed,
+		"suite.hang":            TestTimeout,
+		"suite.ignores_sigterm": TestTimeout,
+	}
+	wantTimeout := map[string]time.Duration{
+		"suite.hang":            100 * time.Millisecond,
+		"suite.ignores_sigterm": 50 * time.Millisecond,
+	}
+	for _, res := range runResults {
+		if res.Result != wantStatus[res.TestID] {
+			t.Errorf("%s expected %s, got %s", res.TestID, wantStatus[res.TestID], res.Result)
+		}
+		if res.Timeout != wantTimeout[res.TestID] {
+			t.Errorf("%s expected Timeout %v, got %v", res.TestID, wantTimeout[res.TestID], res.Timeout)
+		}
+	}
+}
+
+func TestRunTestsParallel(t *testing.T) {
+	tmpDir := t.TempDir()
+	stateDir := t.TempDir()
+
+	// Every test leaves a marker in stateDir while it's running, the
+	// exclusive test checks that nobody else has one. Tests sharing a resource
+	// use mkdir as a lock and fail if it's already taken.
+	script := func(lock string, exclusive bool) []string {
+		s := "touch " + stateDir + "/running.$$; "
+		if exclusive {
+			s += "[ $(ls " + stateDir + " | wc -l) = 1 ] || exit 1; "
+		}
+		if lock != "" {
+			s += "mkdir " + stateDir + "/" + lock + " || exit 1; "
+		}
+		s += "sleep 0.2; "
+		if exclusive {
+			s += "[ $(ls " + stateDir + " | wc -l) = 1 ] || exit 1; "
+		}
+		if lock != "" {
+			s += "rmdir " + stateDir + "/" + lock + "; "
+		}
+		s += "rm " + stateDir + "/running.$$"
+		return []string{"bash", "-c", s}
+	}
+
+	tests := map[string]test_conf.Test{
+		"suite.a_free_1":    {Command: script("", false)},
+		"suite.b_free_2":    {Command: script("", false)},
+		"suite.c_res_1":     {Command: script("res", false), Resources: []string{"res"}},
+		"suite.d_res_2":     {Command: script("res", false), Resources: []string{"res", "other"}},
+		"suite.e_exclusive": {Command: script("", true), Exclusive: true},
+		"suite.f_free_3":    {Command: script("", false)},
+		"suite.g_res_3":     {Command: script("res", false), Resources: []string{"res"}},
+	}
+
+	opts := &RunOptions{
+		RequestedTests: tests,
+		LogDir:         filepath.Join(tmpDir, "logs"),
+		Jobs:           4,
+	}
+
+	start := time.Now()
+	runResults, err := RunTests(opts)
+	if err != nil {
+		t.Fatalf("RunTests returned error: %v", err)
+	}
+	elapsed := time.Since(start)
+
+	var gotIDs []string
+	for _, res := range runResults {
+		gotIDs = append(gotIDs, res.TestID)
+		if res.Result != TestPassed {
+			t.Errorf("%s expected %s, got %s", res.TestID, TestPassed, res.Result)
+		}
+	}
+	if !sort.StringsAreSorted(gotIDs) || len(gotIDs) != len(tests) {
+		t.Errorf("expected results for all tests in sorted order, got %v", gotIDs)
+	}
+	// Serially this would be 7*0.2s, 3 res tests + 1 exclusive need at least
+	// 0.8s even with infinite jobs.
+	if elapsed > 1300*time.Millisecond {
+		t.Errorf("tests took %v, doesn't look like they ran in parallel", elapsed)
+	}
+}
+
+func TestSchedulerCanStart(t *testing.T) {
+	exclusive := test_conf.Test{Exclusive: true}
+	plain := test_conf.Test{}
+	withRes := test_conf.Test{Resources: []string{"hugepages"}}
+
+	s := newScheduler(2)
+	if !s.canStart(exclusive) {
+		t.Errorf("exclusive test should be able to start on idle scheduler")
+	}
+	s.start(withRes)
+	if s.canStart(exclusive) {
+		t.Errorf("exclusive test shouldn't start while another test is running")
+	}
+	if s.canStart(withRes) {
+		t.Errorf("test shouldn't start while its resource is held")
+	}
+	if !s.canStart(plain) {
+		t.Errorf("test without resources should be able to start")
+	}
+	s.start(plain)
+	if s.canStart(plain) {
+		t.Errorf("test shouldn't start when all jobs are busy")
+	}
+	s.finish(withRes)
+	if !s.canStart(withRes) {
+		t.Errorf("test should be able to start after resource is released")
+	}
+	s.finish(plain)
+	s.start(exclusive)
+	if s.canStart(plain) {
+		t.Errorf("test shouldn't start while an exclusive test is running")
+	}
+}
+
+func TestRunTestsRetries(t *testing.T) {
+	tmpDir := t.TempDir()
+	logDir := filepath.Join(tmpDir, "logs")
+	counterFile := filepath.Join(tmpDir, "counter")
+
+	tests := map[string]test_conf.Test{
+		"suite.pass": {
+			Command: []string{"bash", "-c", "exit 0"},
+			Retries: 2,
+		},
+		// Fails the first time it's run, passes after that.
+		"suite.flaky": {
+			Command: []string{"bash", "-c", "n=$(cat " + counterFile + " || echo 0); echo $((n+1)) > " + counterFile + "; [ $n -ge 1 ]"},
+			Retries: 2,
+		},
+		"suite.broken": {
+			Command: []string{"bash", "-c", "exit 1"},
+			Tags:    []string{"flaky"},
+		},
+		"suite.no_retries": {
+			Command: []string{"bash", "-c", "exit 1"},
+		},
+	}
+
+	runResults, err := RunTests(&RunOptions{
+		RequestedTests: tests,
+		LogDir:         logDir,
+		RetryTags:      map[string]int{"flaky": 2},
+	})
+	if err != nil {
+		t.Fatalf("RunTests returned error: %v", err)
+	}
+
+	want := map[string]struct {
+		status   TestStatus
+		attempts []TestStatus
+	}{
+		"suite.pass":       {status: TestPassed},
+		"suite.flaky":      {status: TestFlaky, attempts: []TestStatus{TestFailed, TestPassed}},
+		"suite.broken":     {status: TestFailed, attempts: []TestStatus{TestFailed, TestFailed, TestFailed}},
+		"suite.no_retries": {status: TestFailed},
+	}
+	for _, res := range runResults {
+		w := want[res.TestID]
+		if res.Result != w.status {
+			t.Errorf("%s expected %s, got %s", res.TestID, w.status, res.Result)
+		}
+		var gotAttempts []TestStatus
+		for _, a := range res.Attempts {
+			gotAttempts = append(gotAttempts, a.Result)
+		}
+		if diff := cmp.Diff(w.attempts, gotAttempts); diff != "" {
+			t.Errorf("%s attempts mismatch (-want +got):\n%s", res.TestID, diff)
+		}
+		if len(res.Attempts) > 1 {
+			if res.Attempts[1].LogFile != filepath.Join(logDir, "suite", strings.TrimPrefix(res.TestID, "suite.")+".attempt2.log") {
+				t.Errorf("%s: unexpected log file for 2nd attempt: %s", res.TestID, res.Attempts[1].LogFile)
+			}
+			if res.LogFile != res.Attempts[len(res.Attempts)-1].LogFile {
+				t.Errorf("%s: LogFile should be from last attempt, got %s", res.TestID, res.LogFile)
+			}
+		}
+	}
+}
+
+func TestRunTestsKTAP(t *testing.T) {
+	tests := map[string]test_conf.Test{
+		"suite.ktap": {
+			Command: []string{"printf", "TAP version 13\\n1..2\\nok 1 foo\\nnot ok 2 bar\\n"},
+		},
+	}
+
+	runResults, err := RunTests(&RunOptions{
+		RequestedTests: tests,
+		LogDir:         filepath.Join(t.TempDir(), "logs"),
+	})
+	if err != nil {
+		t.Fatalf("RunTests returned error: %v", err)
+	}
+
+	want := []*ktap.Result{
+		{Number: 1, Name: "foo", Status: ktap.Pass},
+		{Number: 2, Name: "bar", Status: ktap.Fail},
+	}
+	if diff := cmp.Diff(want, runResults[0].Subtests); diff != "" {
+		t.Errorf("Subtests mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestRunTestsEnvCwd(t *testing.T) {
+	dir := t.TempDir()
+	logDir := filepath.Join(t.TempDir(), "logs")
+	tests := map[string]test_conf.Test{
+		"suite.env": {
+			CommandPrefix: []string{"bash", "-c"},
+			Command:       []string{`echo "$FOO $(pwd)"`},
+			Env:           map[string]string{"FOO": "bar"},
+			Cwd:           dir,
+		},
+	}
+
+	runResults, err := RunTests(&RunOptions{
+		RequestedTests: tests,
+		LogDir:         logDir,
+	})
+	if err != nil {
+		t.Fatalf("RunTests returned error: %v", err)
+	}
+	if runResults[0].Result != TestPassed {
+		t.Fatalf("expected %s, got %s: %v", TestPassed, runResults[0].Result, runResults[0].Err)
+	}
+	wantCommand := []string{"bash", "-c", `echo "$FOO $(pwd)"`}
+	if diff := cmp.Diff(wantCommand, runResults[0].Command); diff != "" {
+		t.Errorf("Command mismatch (-want +got):\n%s", diff)
+	}
+	log, err := os.ReadFile(runResults[0].LogFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "bar " + dir + "\n"; string(log) != want {
+		t.Errorf("expected log %q, got %q", want, log)
+	}
+}
+
+func TestRunTestsStandardEnv(t *testing.T) {
+	logDir := filepath.Join(t.TempDir(), "logs")
+	t.Setenv("RUNNER_VAR", "from-runner")
+	tests := map[string]test_conf.Test{
+		"suite.artifacts": {
+			Command: []string{"bash", "-c", `echo "$TEST_ID $TEST_LOG_DIR $EXPANDED" && touch "$TEST_ARTIFACT_DIR/out" "$TEST_TMPDIR/scratch" && [ "$(pwd)" = "$TEST_TMPDIR" ]`},
+			Env:     map[string]string{"EXPANDED": "${RUNNER_VAR}-$${TEST_ID}"},
+			Cwd:     "${TEST_TMPDIR}",
+		},
+		"suite.no_artifacts": {
+			Command: []string{"bash", "-c", `echo "$TEST_TMPDIR"`},
+		},
+	}
+
+	runResults, err := RunTests(&RunOptions{
+		RequestedTests: tests,
+		LogDir:         logDir,
+	})
+	if err != nil {
+		t.Fatalf("RunTests returned error: %v", err)
+	}
+	for _, res := range runResults {
+		if res.Result != TestPassed {
+			t.Fatalf("%s: expected %s, got %s: %v", res.TestID, TestPassed, res.Result, res.Err)
+		}
+	}
+
+	log, err := os.ReadFile(runResults[0].LogFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "suite.artifacts " + logDir + " from-runner-${TEST_ID}\n"; string(log) != want {
+		t.Errorf("expected log %q, got %q", want, log)
+	}
+	wantArtifacts := filepath.Join(logDir, "suite", "artifacts.artifacts")
+	if runResults[0].ArtifactDir != wantArtifacts {
+		t.Errorf("expected artifact dir %q, got %q", wantArtifacts, runResults[0].ArtifactDir)
+	}
+	if _, err := os.Stat(filepath.Join(wantArtifacts, "out")); err != nil {
+		t.Errorf("artifact missing: %v", err)
+	}
+
+	// Empty artifact dirs and the temporary dirs get cleaned up.
+	if runResults[1].ArtifactDir != "" {
+		t.Errorf("expected no artifact dir, got %q", runResults[1].ArtifactDir)
+	}
+	if _, err := os.Stat(filepath.Join(logDir, "suite", "no_artifacts.artifacts")); !os.IsNotExist(err) {
+		t.Errorf("expected empty artifact dir to be deleted, got %v", err)
+	}
+	log, err = os.ReadFile(runResults[1].LogFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tmpDir := strings.TrimSpace(string(log)); tmpDir == "" {
+		t.Errorf("TEST_TMPDIR not set")
+	} else if _, err := os.Stat(tmpDir); !os.IsNotExist(err) {
+		t.Errorf("expected %s to be deleted, got %v", tmpDir, err)
+	}
+}
+
+func TestRunTestsRequirements(t *testing.T) {
+	req := func(s string) kconfig.Requirement {
+		r, err := kconfig.ParseRequirement(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return r
+	}
+	tests := map[string]test_conf.Test{
+		"suite.a_met": {
+			Command:         []string{"true"},
+			RequiresKconfig: []kconfig.Requirement{req("KVM"), req("SCSI_DEBUG=m")},
+		},
+		"suite.b_unmet": {
+			Command:         []string{"true"},
+			RequiresKconfig: []kconfig.Requirement{req("TEST_VMALLOC=m|y"), req("SCSI_DEBUG=y"), req("KVM")},
+		},
+		"suite.c_big": {
+			Command:         []string{"true"},
+			RequiresKconfig: []kconfig.Requirement{req("KVM")},
+			Requires:        &sysinfo.Requirements{MinMemory: 128 << 30, MinCPUs: 1, CPUFlags: []string{"vmx|svm"}},
+		},
+	}
+
+	runResults, err := RunTests(&RunOptions{
+		RequestedTests: tests,
+		Kconfig:        kconfig.Config{"KVM": "y", "SCSI_DEBUG": "m"},
+		SysInfo:        &sysinfo.Info{CPUFlags: map[string]bool{"svm": true}, Memory: 8 << 30, CPUs: 2, NUMANodes: 1},
+	})
+	if err != nil {
+		t.Fatalf("RunTests returned error: %v", err)
+	}
+	if runResults[0].Result != TestPassed {
+		t.Errorf("expected %s to pass, got %s", runResults[0].TestID, runResults[0].Result)
+	}
+	if runResults[1].Result != TestSkipped {
+		t.Errorf("expected %s to be skipped, got %s", runResults[1].TestID, runResults[1].Result)
+	}
+	if got, want := runResults[1].SkipReason, "CONFIG_TEST_VMALLOC not set, CONFIG_SCSI_DEBUG=m, need y"; got != want {
+		t.Errorf("expected skip reason %q, got %q", want, got)
+	}
+	if got, want := runResults[2].SkipReason, "needs 128GiB of memory, have 8GiB"; got != want {
+		t.Errorf("expected skip reason %q, got %q", want, got)
+	}
+}
+
+func TestRunTestsConditionalTags(t *testing.T) {
+	lkBrokenOn := func(arch string) []test_conf.ConditionalTag {
+		return []test_conf.ConditionalTag{{Tag: "lk-broken", When: sysinfo.Condition{Arch: sysinfo.StringList{arch}}}}
+	}
+	tests := map[string]test_conf.Test{
+		"x86.a_broken_here": {
+			Command:         []string{"true"},
+			ConditionalTags: lkBrokenOn("i686"),
+		},
+		"x86.b_broken_elsewhere": {
+			Command:         []string{"true"},
+			ConditionalTags: lkBrokenOn("x86_64"),
+		},
+	}
+
+	runResults, err := RunTests(&RunOptions{
+		RequestedTests: tests,
+		BadTags:        map[string]bool{"lk-broken": true},
+		SysInfo:        &sysinfo.Info{Machine: "i686"},
+	})
+	if err != nil {
+		t.Fatalf("RunTests returned error: %v", err)
+	}
+	if runResults[0].Result != TestSkipped || runResults[0].SkipReason != "[lk-broken]" {
+		t.Errorf("expected %s to be skipped due to lk-broken, got %s %q", runResults[0].TestID, runResults[0].Result, runResults[0].SkipReason)
+	}
+	if diff := cmp.Diff([]string{"lk-broken"}, runResults[0].Tags); diff != "" {
+		t.Errorf("Tags mismatch (-want +got):\n%s", diff)
+	}
+	if runResults[1].Result != TestPassed {
+		t.Errorf("expected %s to pass, got %s", runResults[1].TestID, runResults[1].Result)
+	}
+	if len(tests["x86.a_broken_here"].Tags) != 0 {
+		t.Errorf("RunTests modified the requested tests")
+	}
+}
+
+func TestTagFilter(t *testing.T) {
+	kvm, err := tagexpr.Parse("kvm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testCases := []struct {
+		name        string
+		opts        RunOptions
+		tags        []string
+		wantReasons []string
+	}{
+		{name: "no options", tags: []string{"slow"}},
+		{
+			name:        "skip tags",
+			opts:        RunOptions{SkipTags: map[string]bool{"slow": true, "flaky": true}},
+			tags:        []string{"slow", "flaky", "kvm"},
+			wantReasons: []string{"flaky", "slow"},
+		},
+		{
+			name:        "bad",
+			opts:        RunOptions{BadTags: map[string]bool{"bad": true}},
+			tags:        []string{"bad"},
+			wantReasons: []string{"bad"},
+		},
+		{
+			name: "bad but included",
+			opts: RunOptions{BadTags: map[string]bool{"bad": true}, IncludeBad: map[string]bool{"bad": true}},
+			tags: []string{"bad"},
+		},
+		{
+			name:        "bad and included for another tag",
+			opts:        RunOptions{BadTags: map[string]bool{"bad": true}, IncludeBad: map[string]bool{"lk-broken": true}},
+			tags:        []string{"bad"},
+			wantReasons: []string{"bad", "!lk-broken"},
+		},
+		{
+			name: "included bad tests ignore skip tags",
+			opts: RunOptions{
+				BadTags:    map[string]bool{"bad": true},
+				IncludeBad: map[string]bool{"bad": true},
+				SkipTags:   map[string]bool{"slow": true},
+			},
+			tags: []string{"bad", "slow"},
+		},
+		{
+			name: "bad and skipped",
+			opts: RunOptions{
+				BadTags:    map[string]bool{"bad": true},
+				IncludeBad: map[string]bool{"lk-broken": true},
+				SkipTags:   map[string]bool{"slow": true},
+			},
+			tags:        []string{"bad", "slow"},
+			wantReasons: []string{"bad", "slow", "!lk-broken"},
+		},
+		{
+			name:        "included bad tests still need to match tags",
+			opts:        RunOptions{Tags: kvm, BadTags: map[string]bool{"bad": true}, IncludeBad: map[string]bool{"bad": true}},
+			tags:        []string{"bad"},
+			wantReasons: []string{"!kvm"},
+		},
+		{
+			name:        "tags and skip tags",
+			opts:        RunOptions{Tags: kvm, SkipTags: map[string]bool{"slow": true}},
+			tags:        []string{"slow"},
+			wantReasons: []string{"!kvm", "slow"},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			test := test_conf.Test{Tags: tc.tags}
+			skipped, reasons := shouldSkipTest(test, tc.opts.TagFilter())
+			if skipped != (tc.wantReasons != nil) {
+				t.Errorf("shouldSkipTest() = %v, want %v", skipped, tc.wantReasons != nil)
+			}
+			if diff := cmp.Diff(tc.wantReasons, reasons); diff != "" {
+				t.Errorf("reasons mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestRunTestsExitCodes(t *testing.T) {
+	tests := map[string]test_conf.Test{
+		"suite.a_ksft_skip": {
+			Command:   []string{"bash", "-c", "exit 4"},
+			ExitCodes: test_conf.KselftestExitCodes,
+		},
+		"suite.b_global_pass": {
+			Command: []string{"bash", "-c", "exit 2"},
+		},
+		"suite.c_override": {
+			Command:   []string{"bash", "-c", "exit 2"},
+			ExitCodes: test_conf.ExitCodes{2: test_conf.OutcomeFail},
+		},
+		"suite.d_unmapped": {
+			Command: []string{"bash", "-c", "exit 4"},
+		},
+	}
+
+	runResults, err := RunTests(&RunOptions{
+		RequestedTests: tests,
+		ExitCodes:      test_conf.ExitCodes{2: test_conf.OutcomePass},
+		// A skip reported by exit code shouldn't count as a failure.
+		BailOnFailure: true,
+	})
+	if err != nil {
+		t.Fatalf("RunTests returned error: %v", err)
+	}
+
+	want := map[string]TestStatus{
+		"suite.a_ksft_skip":   TestSkipped,
+		"suite.b_global_pass": TestPassed,
+		"suite.c_override":    TestFailed,
+		"suite.d_unmapped":    TestDropped,
+	}
+	for _, res := range runResults {
+		if res.Result != want[res.TestID] {
+			t.Errorf("%s expected %s, got %s", res.TestID, want[res.TestID], res.Result)
+		}
+	}
+	if got := runResults[0].SkipReason; got != "test reported skip (exit code 4)" {
+		t.Errorf("unexpected skip reason %q", got)
+	}
+}
+
+func TestRunTestsKernelLog(t *testing.T) {
+	tmpDir := t.TempDir()
+	logDir := filepath.Join(tmpDir, "logs")
+	// A regular file stands in for /dev/kmsg, the tests append to it.
+	kmsgPath := filepath.Join(tmpDir, "kmsg")
+	if err := os.WriteFile(kmsgPath, []byte("6,1,100,-;from before the run\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]test_conf.Test{
+		"suite.a_noisy": {
+			Command: []string{"bash", "-c", "echo '4,2,2000000,-;hello from the kernel' >> " + kmsgPath},
+		},
+		"suite.b_quiet": {
+			Command: []string{"bash", "-c", "exit 0"},
+		},
+	}
+
+	runResults, err := RunTests(&RunOptions{
+		RequestedTests: tests,
+		LogDir:         logDir,
+		KmsgPath:       kmsgPath,
+	})
+	if err != nil {
+		t.Fatalf("RunTests returned error: %v", err)
+	}
+
+	noisy, quiet := runResults[0], runResults[1]
+	want := []kmsg.Record{{Priority: 4, Seq: 2, Timestamp: 2 * time.Second, Message: "hello from the kernel"}}
+	if diff := cmp.Diff(want, noisy.KernelLog); diff != "" {
+		t.Errorf("KernelLog mismatch (-want +got):\n%s", diff)
+	}
+	wantFile := filepath.Join(logDir, "suite", "a_noisy.dmesg")
+	if noisy.KernelLogFile != wantFile {
+		t.Errorf("expected KernelLogFile %s, got %s", wantFile, noisy.KernelLogFile)
+	}
+	content, err := os.ReadFile(wantFile)
+	if err != nil {
+		t.Fatalf("reading kernel log file: %v", err)
+	}
+	if string(content) != "[    2.000000] hello from the kernel\n" {
+		t.Errorf("unexpected kernel log file content %q", content)
+	}
+
+	if len(quiet.KernelLog) != 0 || quiet.KernelLogFile != "" {
+		t.Errorf("expected no kernel log for quiet test, got %v in %q", quiet.KernelLog, quiet.KernelLogFile)
+	}
+}
+
+func TestRunTestsKernelErrors(t *testing.T) {
+	for _, policy := range []KernelErrorPolicy{"", KernelErrorsFail, KernelErrorsWarn, KernelErrorsIgnore} {
+		t.Run(string(policy), func(t *testing.T) {
+			tmpDir := t.TempDir()
+			kmsgPath := filepath.Join(tmpDir, "kmsg")
+			if err := os.WriteFile(kmsgPath, nil, 0644); err != nil {
+				t.Fatal(err)
+			}
+			warn := "printf '4,1,100,-;------------[ cut here ]------------\\n4,2,100,-;WARNING: CPU: 0 PID: 1 at foo.c:1 foo\\n' >> " + kmsgPath
+			tests := map[string]test_conf.Test{
+				"suite.warns": {
+					Command: []string{"bash", "-c", warn},
+					// Kernel errors shouldn't get retried.
+					Retries: 2,
+				},
+			}
+
+			runResults, err := RunTests(&RunOptions{
+				RequestedTests: tests,
+				KmsgPath:       kmsgPath,
+				KernelErrors:   policy,
+			})
+			if err != nil {
+				t.Fatalf("RunTests returned error: %v", err)
+			}
+
+			res := runResults[0]
+			wantStatus := TestKernelError
+			wantSplats := 1
+			switch policy {
+			case KernelErrorsWarn:
+				wantStatus = TestPassed
+			case KernelErrorsIgnore:
+				wantStatus = TestPassed
+				wantSplats = 0
+			}
+			if res.Result != wantStatus {
+				t.Errorf("expected %s, got %s", wantStatus, res.Result)
+			}
+			if len(res.Splats) != wantSplats {
+				t.Fatalf("expected %d splats, got %d", wantSplats, len(res.Splats))
+			}
+			if wantSplats > 0 && res.Splats[0].Title != "WARNING: CPU: 0 PID: 1 at foo.c:1 foo" {
+				t.Errorf("unexpected splat title %q", res.Splats[0].Title)
+			}
+			if len(res.Attempts) != 0 {
+				t.Errorf("expected no retries, got %d attempts", len(res.Attempts))
+			}
+		})
+	}
+}
+
+func TestRunTestsTaint(t *testing.T) {
+	// W is 1<<9, E is 1<<13, O is 1<<12.
+	testCases := []struct {
+		name      string
+		policy    TaintPolicy
+		mask      *taint.Taint
+		newTaint  int
+		retries   int
+		wantFirst TestStatus
+		wantNext  TestStatus
+		wantErr   bool
+	}{
+		{name: "mark", policy: TaintMark, newTaint: 1 << 9, wantFirst: TestPassed, wantNext: TestPassed},
+		{name: "fail", policy: TaintFail, newTaint: 1 << 9, wantFirst: TestFailed, wantNext: TestPassed},
+		// The taint is still there for the retry, so it mustn't get one.
+		{name: "fail with retries", policy: TaintFail, newTaint: 1 << 9, retries: 2, wantFirst: TestFailed, wantNext: TestPassed},
+		{name: "fail unmasked", policy: TaintFail, newTaint: 1 << 13, wantFirst: TestPassed, wantNext: TestPassed},
+		{name: "fail with empty mask", policy: TaintFail, mask: new(taint.Taint), newTaint: 1 << 9, wantFirst: TestPassed, wantNext: TestPassed},
+		{name: "abort", policy: TaintAbort, newTaint: 1 << 9, wantFirst: TestPassed, wantNext: TestDropped, wantErr: true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			tmpDir := t.TempDir()
+			taintedPath := filepath.Join(tmpDir, "tainted")
+			if err := os.WriteFile(taintedPath, []byte("4096\n"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			tests := map[string]test_conf.Test{
+				"suite.a_taints": {
+					Command: []string{"bash", "-c", fmt.Sprintf("echo %d > %s", 4096|tc.newTaint, taintedPath)},
+					Retries: tc.retries,
+				},
+				"suite.b_next": {
+					Command: []string{"bash", "-c", "exit 0"},
+				},
+			}
+
+			runResults, err := RunTests(&RunOptions{
+				RequestedTests: tests,
+				TaintedPath:    taintedPath,
+				OnTaint:        tc.policy,
+				TaintMask:      tc.mask,
+			})
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("RunTests returned error %v, wanted error: %v", err, tc.wantErr)
+			}
+
+			first, next := runResults[0], runResults[1]
+			if first.Result != tc.wantFirst {
+				t.Errorf("expected %s for first test, got %s", tc.wantFirst, first.Result)
+			}
+			if first.NewTaint != taint.Taint(tc.newTaint) {
+				t.Errorf("expected new taint %s, got %s", taint.Taint(tc.newTaint), first.NewTaint)
+			}
+			if len(first.Attempts) != 0 {
+				t.Errorf("expected no retries, got %d attempts", len(first.Attempts))
+			}
+			if next.Result != tc.wantNext {
+				t.Errorf("expected %s for next test, got %s", tc.wantNext, next.Result)
+			}
+			if next.NewTaint != 0 {
+				t.Errorf("expected no new taint for next test, got %s", next.NewTaint)
+			}
+		})
+	}
+}
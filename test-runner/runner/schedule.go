@@ -0,0 +1,55 @@
+package runner
+
+import "test-runner/test_conf"
+
+// scheduler tracks what's currently running, to decide whether another test
+// can start. It isn't thread safe, it's only used from the RunTests loop.
+type scheduler struct {
+	jobs    int
+	running int
+	// Number of running tests that are marked exclusive (0 or 1).
+	exclusive int
+	resources map[string]bool
+}
+
+func newScheduler(jobs int) *scheduler {
+	return &scheduler{
+		jobs:      jobs,
+		resources: make(map[string]bool),
+	}
+}
+
+func (s *scheduler) canStart(test test_conf.Test) bool {
+	if s.running >= s.jobs || s.exclusive > 0 {
+		return false
+	}
+	if test.Exclusive && s.running > 0 {
+		return false
+	}
+	for _, r := range test.Resources {
+		if s.resources[r] {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *scheduler) start(test test_conf.Test) {
+	s.running++
+	if test.Exclusive {
+		s.exclusive++
+	}
+	for _, r := range test.Resources {
+		s.resources[r] = true
+	}
+}
+
+func (s *scheduler) finish(test test_conf.Test) {
+	s.running--
+	if test.Exclusive {
+		s.exclusive--
+	}
+	for _, r := range test.Resources {
+		delete(s.resources, r)
+	}
+}
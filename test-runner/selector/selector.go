@@ -0,0 +1,160 @@
+// Package selector picks tests by their IDs, with patterns that know about the
+// dots between the names in an ID.
+package selector
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+
+	"test-runner/test_conf"
+)
+
+// Selector is a pattern for test IDs. It's one of:
+//
+//   - A glob, matched one name at a time: * and ? don't cross dots, so "mm.*"
+//     matches mm.foo but not mm.foo.bar. A name that's just ** matches any
+//     number of names, including none, so "mm.**" matches everything under mm
+//     and "**.foo" matches foo anywhere. Dots in names are escaped like in
+//     test IDs (see test_conf.JoinID), so a test's ID matches just that test.
+//   - "re:" followed by a regular expression, which has to match the whole ID.
+//
+// A leading ! makes it an exclusion, which removes tests instead of adding
+// them.
+type Selector struct {
+	// As it was written.
+	raw     string
+	Exclude bool
+	// One of these.
+	names []string
+	re    *regexp.Regexp
+}
+
+// Parse parses a selector, see Selector.
+func Parse(s string) (*Selector, error) {
+	sel := &Selector{raw: s}
+	if rest, ok := strings.CutPrefix(s, "!"); ok {
+		sel.Exclude, s = true, rest
+	}
+	if expr, ok := strings.CutPrefix(s, "re:"); ok {
+		re, err := regexp.Compile("^(?:" + expr + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("invalid regex %s: %v", sel.raw, err)
+		}
+		sel.re = re
+		return sel, nil
+	}
+	if s == "" {
+		return nil, fmt.Errorf("empty test selector %q", sel.raw)
+	}
+	for _, name := range test_conf.SplitID(s) {
+		// Backslashes were ID escapes, the names have them literally.
+		name = strings.ReplaceAll(name, `\`, `\\`)
+		if _, err := path.Match(name, ""); err != nil {
+			return nil, fmt.Errorf("invalid glob pattern %s: %v", sel.raw, err)
+		}
+		sel.names = append(sel.names, name)
+	}
+	return sel, nil
+}
+
+func (s *Selector) String() string {
+	return s.raw
+}
+
+// Matches reports whether the selector matches a test ID, ignoring Exclude.
+func (s *Selector) Matches(testID string) bool {
+	if s.re != nil {
+		return s.re.MatchString(testID)
+	}
+	return matchNames(s.names, test_conf.SplitID(testID))
+}
+
+func matchNames(patterns, names []string) bool {
+	if len(patterns) == 0 {
+		return len(names) == 0
+	}
+	if patterns[0] == "**" {
+		for i := 0; i <= len(names); i++ {
+			if matchNames(patterns[1:], names[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(names) == 0 {
+		return false
+	}
+	// The pattern was checked in Parse.
+	ok, _ := path.Match(patterns[0], names[0])
+	return ok && matchNames(patterns[1:], names[1:])
+}
+
+// Result is what Select picked.
+type Result struct {
+	// In the order of the testIDs passed to Select.
+	TestIDs []string
+	// Selectors that didn't match any test at all.
+	Unmatched []*Selector
+}
+
+// Select returns the tests that any of the selectors that aren't exclusions
+// match, minus the ones that any exclusion matches. The order of the selectors
+// doesn't matter. If they're all exclusions, they apply to all the tests.
+func Select(selectors []*Selector, testIDs []string) Result {
+	var result Result
+	matchedAny := make([]bool, len(selectors))
+	onlyExclusions := true
+	for _, sel := range selectors {
+		onlyExclusions = onlyExclusions && sel.Exclude
+	}
+	for _, testID := range testIDs {
+		included, excluded := onlyExclusions, false
+		for i, sel := range selectors {
+			if !sel.Matches(testID) {
+				continue
+			}
+			matchedAny[i] = true
+			if sel.Exclude {
+				excluded = true
+			} else {
+				included = true
+			}
+		}
+		if included && !excluded {
+			result.TestIDs = append(result.TestIDs, testID)
+		}
+	}
+	for i, sel := range selectors {
+		if !matchedAny[i] {
+			result.Unmatched = append(result.Unmatched, sel)
+		}
+	}
+	return result
+}
+
+// ReadFile reads selectors from a file, one per line. Blank lines and lines
+// starting with # are ignored.
+func ReadFile(filePath string) ([]string, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var selectors []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		selectors = append(selectors, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("reading %s: %w", filePath, err)
+	}
+	return selectors, nil
+}
@@ -0,0 +1,128 @@
+package selector
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestMatches(t *testing.T) {
+	testCases := []struct {
+		selector string
+		testID   string
+		want     bool
+	}{
+		{selector: "mm.foo", testID: "mm.foo", want: true},
+		{selector: "mm.*", testID: "mm.foo", want: true},
+		{selector: "mm.*", testID: "mm.foo.bar", want: false},
+		{selector: "mm.*", testID: "mm", want: false},
+		{selector: "*", testID: "mm", want: true},
+		{selector: "*", testID: "mm.foo", want: false},
+		{selector: "mm.f?o", testID: "mm.foo", want: true},
+		{selector: "mm.**", testID: "mm.foo.bar", want: true},
+		{selector: "mm.**", testID: "mm", want: true},
+		{selector: "mm.**", testID: "mmx.foo", want: false},
+		{selector: "**", testID: "mm.foo.bar", want: true},
+		{selector: "**.bar", testID: "mm.foo.bar", want: true},
+		{selector: "**.bar", testID: "bar", want: true},
+		{selector: "mm.**.bar", testID: "mm.bar", want: true},
+		{selector: "mm.**.bar", testID: "mm.foo.baz", want: false},
+		{selector: "mm.ksft_*", testID: `mm.ksft_gup_test\.sh`, want: true},
+		{selector: `mm.ksft_gup_test\.sh`, testID: `mm.ksft_gup_test\.sh`, want: true},
+		{selector: `mm.ksft_gup_test.sh`, testID: `mm.ksft_gup_test\.sh`, want: false},
+		{selector: `a\\b.*`, testID: `a\\b.c`, want: true},
+		{selector: "re:mm\\..*", testID: "mm.foo.bar", want: true},
+		{selector: "re:foo", testID: "mm.foo", want: false},
+		{selector: "!mm.*", testID: "mm.foo", want: true},
+	}
+	for _, tc := range testCases {
+		sel, err := Parse(tc.selector)
+		if err != nil {
+			t.Errorf("Parse(%q) failed: %v", tc.selector, err)
+			continue
+		}
+		if got := sel.Matches(tc.testID); got != tc.want {
+			t.Errorf("%q.Matches(%q) = %v, want %v", tc.selector, tc.testID, got, tc.want)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, s := range []string{"", "!", "foo[", "re:(", "!re:["} {
+		if _, err := Parse(s); err == nil {
+			t.Errorf("Parse(%q) expected error", s)
+		}
+	}
+}
+
+func TestSelect(t *testing.T) {
+	testIDs := []string{"kvm.a", "kvm.b", "mm.a", "mm.sub.b"}
+	testCases := []struct {
+		name          string
+		selectors     []string
+		wantIDs       []string
+		wantUnmatched []string
+	}{
+		{
+			name:      "include",
+			selectors: []string{"mm.**", "kvm.a"},
+			wantIDs:   []string{"kvm.a", "mm.a", "mm.sub.b"},
+		},
+		{
+			name:      "exclude",
+			selectors: []string{"!mm.sub.*", "**"},
+			wantIDs:   []string{"kvm.a", "kvm.b", "mm.a"},
+		},
+		{
+			name:      "only exclusions",
+			selectors: []string{"!kvm.*"},
+			wantIDs:   []string{"mm.a", "mm.sub.b"},
+		},
+		{
+			name:          "unmatched",
+			selectors:     []string{"kvm.*", "!kvm.c", "mm.c"},
+			wantIDs:       []string{"kvm.a", "kvm.b"},
+			wantUnmatched: []string{"!kvm.c", "mm.c"},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var selectors []*Selector
+			for _, s := range tc.selectors {
+				sel, err := Parse(s)
+				if err != nil {
+					t.Fatal(err)
+				}
+				selectors = append(selectors, sel)
+			}
+			result := Select(selectors, testIDs)
+			if diff := cmp.Diff(tc.wantIDs, result.TestIDs); diff != "" {
+				t.Errorf("TestIDs mismatch (-want +got):\n%s", diff)
+			}
+			var unmatched []string
+			for _, sel := range result.Unmatched {
+				unmatched = append(unmatched, sel.String())
+			}
+			if diff := cmp.Diff(tc.wantUnmatched, unmatched); diff != "" {
+				t.Errorf("Unmatched mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestReadFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tests.txt")
+	content := "# Curated list\nkvm.*\n\n  !kvm.slow  \nmm.**\n"
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ReadFile(path)
+	if err != nil {
+		t.Fatalf("ReadFile failed: %v", err)
+	}
+	if diff := cmp.Diff([]string{"kvm.*", "!kvm.slow", "mm.**"}, got); diff != "" {
+		t.Errorf("ReadFile mismatch (-want +got):\n%s", diff)
+	}
+}
@@ -0,0 +1,112 @@
+// Package stream sets up the connections that results streams go over, from
+// the test-runner in a VM to the one listening on the host. Addresses look
+// like "unix:<path>" or "vsock:<cid>:<port>". When listening on vsock the CID
+// can be left out ("vsock:<port>") to accept connections from any guest.
+package stream
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Conn is the sending end of a stream. Writes that haven't finished by the
+// write deadline fail, so a listener that stops reading can't hold the sender
+// up forever.
+type Conn interface {
+	io.WriteCloser
+	SetWriteDeadline(t time.Time) error
+}
+
+// Listener accepts incoming streams.
+type Listener interface {
+	Accept() (io.ReadCloser, error)
+	Close() error
+}
+
+type address struct {
+	network string
+	// For unix.
+	path string
+	// For vsock.
+	cid  uint32
+	port uint32
+}
+
+func parseAddr(addr string, listening bool) (*address, error) {
+	network, rest, ok := strings.Cut(addr, ":")
+	if !ok {
+		return nil, fmt.Errorf("invalid address %q, expected unix:<path> or vsock:<cid>:<port>", addr)
+	}
+	switch network {
+	case "unix":
+		if rest == "" {
+			return nil, fmt.Errorf("invalid address %q, missing path", addr)
+		}
+		return &address{network: network, path: rest}, nil
+	case "vsock":
+		cidStr, portStr, ok := strings.Cut(rest, ":")
+		cid := uint32(vmaddrCIDAny)
+		if !ok {
+			if !listening {
+				return nil, fmt.Errorf("invalid address %q, missing CID", addr)
+			}
+			portStr = cidStr
+		} else {
+			c, err := strconv.ParseUint(cidStr, 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("invalid CID in address %q: %w", addr, err)
+			}
+			cid = uint32(c)
+		}
+		port, err := strconv.ParseUint(portStr, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid port in address %q: %w", addr, err)
+		}
+		return &address{network: network, cid: cid, port: uint32(port)}, nil
+	}
+	return nil, fmt.Errorf("invalid address %q, unknown network %q", addr, network)
+}
+
+// Dial connects to a listener.
+func Dial(addr string) (Conn, error) {
+	a, err := parseAddr(addr, false)
+	if err != nil {
+		return nil, err
+	}
+	if a.network == "vsock" {
+		return dialVsock(a.cid, a.port)
+	}
+	return net.Dial("unix", a.path)
+}
+
+type unixListener struct {
+	l net.Listener
+}
+
+func (l *unixListener) Accept() (io.ReadCloser, error) {
+	return l.l.Accept()
+}
+
+func (l *unixListener) Close() error {
+	return l.l.Close()
+}
+
+// Listen starts listening for streams.
+func Listen(addr string) (Listener, error) {
+	a, err := parseAddr(addr, true)
+	if err != nil {
+		return nil, err
+	}
+	if a.network == "vsock" {
+		return listenVsock(a.cid, a.port)
+	}
+	l, err := net.Listen("unix", a.path)
+	if err != nil {
+		return nil, err
+	}
+	return &unixListener{l: l}, nil
+}
@@ -0,0 +1,70 @@
+package stream
+
+import (
+	"io"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestParseAddr(t *testing.T) {
+	testCases := []struct {
+		addr      string
+		listening bool
+		want      *address
+		wantErr   bool
+	}{
+		{addr: "unix:/tmp/sock", want: &address{network: "unix", path: "/tmp/sock"}},
+		{addr: "vsock:2:1234", want: &address{network: "vsock", cid: 2, port: 1234}},
+		{addr: "vsock:1234", listening: true, want: &address{network: "vsock", cid: vmaddrCIDAny, port: 1234}},
+		{addr: "vsock:1234", wantErr: true},
+		{addr: "vsock:2:port", wantErr: true},
+		{addr: "unix:", wantErr: true},
+		{addr: "tcp:localhost:1234", wantErr: true},
+		{addr: "/tmp/sock", wantErr: true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.addr, func(t *testing.T) {
+			got, err := parseAddr(tc.addr, tc.listening)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("parseAddr returned error %v, wanted error: %v", err, tc.wantErr)
+			}
+			if diff := cmp.Diff(tc.want, got, cmp.AllowUnexported(address{})); diff != "" {
+				t.Errorf("address mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestUnixStream(t *testing.T) {
+	addr := "unix:" + filepath.Join(t.TempDir(), "sock")
+	listener, err := Listen(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	go func() {
+		conn, err := Dial(addr)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		conn.Write([]byte("hello\n"))
+		conn.Close()
+	}()
+
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	got, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "hello\n" {
+		t.Errorf("expected %q, got %q", "hello\n", got)
+	}
+}
@@ -0,0 +1,11 @@
+//go:build !386
+
+package stream
+
+import "syscall"
+
+const (
+	sysBind    = syscall.SYS_BIND
+	sysConnect = syscall.SYS_CONNECT
+	sysAccept4 = syscall.SYS_ACCEPT4
+)
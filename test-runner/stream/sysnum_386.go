@@ -0,0 +1,9 @@
+package stream
+
+// The syscall package only knows about socketcall on 386, but the kernel has
+// had separate syscalls for these since 4.3.
+const (
+	sysBind    = 361
+	sysConnect = 362
+	sysAccept4 = 364
+)
@@ -0,0 +1,300 @@
+package sysinfo
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Virt is the kind of virtualization the tests are running under.
+type Virt string
+
+const (
+	VirtNone Virt = "none"
+	VirtKVM  Virt = "kvm"
+	// QEMU without KVM.
+	VirtTCG Virt = "tcg"
+	// Some other hypervisor, or one we can't tell, see DetectVirt.
+	VirtOther Virt = "other"
+)
+
+// DetectVirt guesses the virtualization from the files under root, for a
+// machine like uname -m. It only says kvm or tcg when there's evidence for it:
+//
+//   - /sys/hypervisor/type is there for Xen and the like.
+//   - kvm-clock, or a KVM PTP clock (from the ptp_kvm module, which also works
+//     on arm64), means KVM.
+//   - On x86, KVM guests always have kvm-clock unless it's disabled on the
+//     command line, so a QEMU machine without it is TCG.
+//
+// Otherwise, a QEMU machine, which on arm64 could be either, or anything with
+// the hypervisor CPU flag, is other.
+func DetectVirt(root, machine string, cpuFlags map[string]bool) Virt {
+	read := func(path string) string {
+		data, _ := os.ReadFile(filepath.Join(root, path))
+		return strings.TrimSpace(string(data))
+	}
+	if hypervisor := read("sys/hypervisor/type"); hypervisor != "" {
+		if hypervisor == "kvm" {
+			return VirtKVM
+		}
+		return VirtOther
+	}
+	kvmClock := strings.Contains(read("sys/devices/system/clocksource/clocksource0/available_clocksource"), "kvm-clock")
+	if kvmClock {
+		return VirtKVM
+	}
+	ptpClocks, _ := filepath.Glob(filepath.Join(root, "sys/class/ptp/*/clock_name"))
+	for _, path := range ptpClocks {
+		if name, _ := os.ReadFile(path); strings.TrimSpace(string(name)) == "KVM virtual PTP" {
+			return VirtKVM
+		}
+	}
+	if read("sys/class/dmi/id/sys_vendor") == "QEMU" {
+		_, noKVMClock := ParseCmdline(read("proc/cmdline"))["no-kvmclock"]
+		if isX86(machine) && !noKVMClock {
+			return VirtTCG
+		}
+		return VirtOther
+	}
+	if cpuFlags["hypervisor"] {
+		return VirtOther
+	}
+	return VirtNone
+}
+
+func isX86(machine string) bool {
+	switch machine {
+	case "x86_64", "i386", "i486", "i586", "i686":
+		return true
+	}
+	return false
+}
+
+// StringList is a list of strings in the JSON, which can also be written as a
+// single string.
+type StringList []string
+
+func (l *StringList) UnmarshalJSON(b []byte) error {
+	var s string
+	if json.Unmarshal(b, &s) == nil {
+		*l = StringList{s}
+		return nil
+	}
+	var list []string
+	if err := json.Unmarshal(b, &list); err != nil {
+		return fmt.Errorf("must be a string or a list of strings: %w", err)
+	}
+	*l = list
+	return nil
+}
+
+// Condition describes the environments where something applies. Every field
+// that's set has to match.
+type Condition struct {
+	// Any of these, compared to uname -m, e.g. "i686" or "x86_64".
+	Arch StringList `json:"arch,omitempty"`
+	// Constraints on the kernel version, like ">=6.12, <6.15", which all
+	// have to hold.
+	Kernel VersionRange `json:"kernel,omitempty"`
+	// Kernel command line parameters, like "asi=on" or "nokaslr", which all
+	// have to be there. Without a value, the parameter can have any value.
+	Cmdline StringList `json:"cmdline,omitempty"`
+	// Any of these, see Virt.
+	Virt StringList `json:"virt,omitempty"`
+}
+
+func (c *Condition) UnmarshalJSON(data []byte) error {
+	// Without the methods, so this doesn't recurse.
+	type condition Condition
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	var parsed condition
+	if err := decoder.Decode(&parsed); err != nil {
+		return err
+	}
+	for _, virt := range parsed.Virt {
+		switch Virt(virt) {
+		case VirtNone, VirtKVM, VirtTCG, VirtOther:
+		default:
+			return fmt.Errorf("unknown virt %q, must be none, kvm, tcg or other", virt)
+		}
+	}
+	*c = Condition(parsed)
+	return nil
+}
+
+// Matches reports whether the condition holds on the machine described by
+// info.
+func (c *Condition) Matches(info *Info) bool {
+	if len(c.Arch) != 0 && !contains(c.Arch, info.Machine) {
+		return false
+	}
+	if !c.Kernel.Contains(info.KernelRelease) {
+		return false
+	}
+	for _, param := range c.Cmdline {
+		name, want, hasValue := strings.Cut(param, "=")
+		value, ok := info.Cmdline[name]
+		if !ok || (hasValue && value != want) {
+			return false
+		}
+	}
+	if len(c.Virt) != 0 && !contains(c.Virt, string(info.Virt)) {
+		return false
+	}
+	return true
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// VersionRange is a set of constraints on a kernel version, like
+// ">=6.12, <6.15". The operators are >=, >, <=, < and =. Versions are compared
+// numerically, and anything after the numbers in a kernel release (like
+// "-rc3") is ignored, so 6.12.0-rc3 counts as 6.12. Missing components count as
+// 0.
+type VersionRange []versionConstraint
+
+type versionConstraint struct {
+	op      string
+	version []int
+}
+
+// ParseVersionRange parses constraints like ">=6.12, <6.15".
+func ParseVersionRange(s string) (VersionRange, error) {
+	var r VersionRange
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		var c versionConstraint
+		for _, op := range []string{">=", "<=", ">", "<", "="} {
+			if rest, ok := strings.CutPrefix(part, op); ok {
+				c.op, part = op, strings.TrimSpace(rest)
+				break
+			}
+		}
+		if c.op == "" {
+			return nil, fmt.Errorf("invalid kernel version constraint %q, should be like \">=6.12\"", part)
+		}
+		version, rest := parseVersion(part)
+		if version == nil || rest != "" {
+			return nil, fmt.Errorf("invalid kernel version %q", part)
+		}
+		c.version = version
+		r = append(r, c)
+	}
+	return r, nil
+}
+
+// parseVersion parses the numbers at the start of a kernel release and returns
+// what's left.
+func parseVersion(s string) ([]int, string) {
+	var version []int
+	for {
+		end := strings.IndexFunc(s, func(r rune) bool { return r < '0' || r > '9' })
+		if end == -1 {
+			end = len(s)
+		}
+		if end == 0 {
+			return version, s
+		}
+		n, _ := strconv.Atoi(s[:end])
+		version = append(version, n)
+		s = s[end:]
+		if !strings.HasPrefix(s, ".") || len(s) == 1 || s[1] < '0' || s[1] > '9' {
+			return version, s
+		}
+		s = s[1:]
+	}
+}
+
+func compareVersions(a, b []int) int {
+	for i := 0; i < max(len(a), len(b)); i++ {
+		var x, y int
+		if i < len(a) {
+			x = a[i]
+		}
+		if i < len(b) {
+			y = b[i]
+		}
+		if x != y {
+			if x < y {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
+// Contains reports whether the kernel release (like uname -r) is in the range.
+// An empty range contains everything, and a release that doesn't start with a
+// version isn't in any other range.
+func (r VersionRange) Contains(release string) bool {
+	if len(r) == 0 {
+		return true
+	}
+	version, _ := parseVersion(release)
+	if version == nil {
+		return false
+	}
+	for _, c := range r {
+		cmp := compareVersions(version, c.version)
+		var ok bool
+		switch c.op {
+		case ">=":
+			ok = cmp >= 0
+		case ">":
+			ok = cmp > 0
+		case "<=":
+			ok = cmp <= 0
+		case "<":
+			ok = cmp < 0
+		case "=":
+			ok = cmp == 0
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+func (r VersionRange) String() string {
+	var parts []string
+	for _, c := range r {
+		var nums []string
+		for _, n := range c.version {
+			nums = append(nums, strconv.Itoa(n))
+		}
+		parts = append(parts, c.op+strings.Join(nums, "."))
+	}
+	return strings.Join(parts, ", ")
+}
+
+func (r *VersionRange) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("kernel version range must be a string like \">=6.12, <6.15\": %w", err)
+	}
+	parsed, err := ParseVersionRange(s)
+	if err != nil {
+		return err
+	}
+	*r = parsed
+	return nil
+}
+
+func (r VersionRange) MarshalJSON() ([]byte, error) {
+	return json.Marshal(r.String())
+}
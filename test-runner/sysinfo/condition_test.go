@@ -0,0 +1,83 @@
+package sysinfo
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestVersionRange(t *testing.T) {
+	testCases := []struct {
+		constraints string
+		release     string
+		want        bool
+	}{
+		{constraints: ">=6.12", release: "6.12.0", want: true},
+		{constraints: ">=6.12", release: "6.12.0-rc3-00001-gabcdef", want: true},
+		{constraints: ">=6.12", release: "6.11.9", want: false},
+		{constraints: ">=6.1, <6.6", release: "6.5.13", want: true},
+		{constraints: ">=6.1, <6.6", release: "6.6", want: false},
+		{constraints: ">6.6", release: "6.6.1", want: true},
+		{constraints: "<=6.6", release: "6.6.1", want: false},
+		{constraints: "=6.6", release: "6.6.0", want: true},
+		{constraints: ">=6.12", release: "garbage", want: false},
+		{constraints: ">=6.12", release: "6.18.44-fc-v139", want: true},
+	}
+	for _, tc := range testCases {
+		r, err := ParseVersionRange(tc.constraints)
+		if err != nil {
+			t.Errorf("ParseVersionRange(%q) failed: %v", tc.constraints, err)
+			continue
+		}
+		if got := r.Contains(tc.release); got != tc.want {
+			t.Errorf("%q.Contains(%q) = %v, want %v", tc.constraints, tc.release, got, tc.want)
+		}
+	}
+	for _, bad := range []string{"6.12", ">=", ">=6.x", ">=6.12,", "~6.12"} {
+		if _, err := ParseVersionRange(bad); err == nil {
+			t.Errorf("ParseVersionRange(%q) expected error", bad)
+		}
+	}
+}
+
+func TestConditionMatches(t *testing.T) {
+	info := &Info{
+		Machine:       "i686",
+		KernelRelease: "6.12.0",
+		Cmdline:       map[string]string{"asi": "on", "nokaslr": ""},
+		Virt:          VirtKVM,
+	}
+	testCases := []struct {
+		when string
+		want bool
+	}{
+		{when: `{}`, want: true},
+		{when: `{"arch": "i686"}`, want: true},
+		{when: `{"arch": ["x86_64", "i686"]}`, want: true},
+		{when: `{"arch": "x86_64"}`, want: false},
+		{when: `{"kernel": ">=6.12"}`, want: true},
+		{when: `{"kernel": "<6.12"}`, want: false},
+		{when: `{"cmdline": "asi=on"}`, want: true},
+		{when: `{"cmdline": "asi=off"}`, want: false},
+		{when: `{"cmdline": ["asi", "nokaslr"]}`, want: true},
+		{when: `{"cmdline": ["asi=on", "mitigations=off"]}`, want: false},
+		{when: `{"virt": "kvm"}`, want: true},
+		{when: `{"virt": ["tcg", "none"]}`, want: false},
+		{when: `{"arch": "i686", "virt": "tcg"}`, want: false},
+	}
+	for _, tc := range testCases {
+		var c Condition
+		if err := json.Unmarshal([]byte(tc.when), &c); err != nil {
+			t.Errorf("Unmarshal(%s) failed: %v", tc.when, err)
+			continue
+		}
+		if got := c.Matches(info); got != tc.want {
+			t.Errorf("%s.Matches() = %v, want %v", tc.when, got, tc.want)
+		}
+	}
+	for _, bad := range []string{`{"archh": "i686"}`, `{"virt": "xen"}`, `{"kernel": 6}`, `{"arch": 1}`} {
+		var c Condition
+		if err := json.Unmarshal([]byte(bad), &c); err == nil {
+			t.Errorf("Unmarshal(%s) expected error", bad)
+		}
+	}
+}
@@ -0,0 +1,314 @@
+// Package sysinfo finds out about the machine the tests are running on, and
+// checks tests' hardware requirements against it.
+package sysinfo
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// Info is what the requirements and conditions get checked against.
+type Info struct {
+	// From the first CPU in /proc/cpuinfo ("flags" on x86, "Features" on
+	// arm64).
+	CPUFlags map[string]bool
+	// MemTotal from /proc/meminfo.
+	Memory ByteSize
+	// Number of processors in /proc/cpuinfo.
+	CPUs int
+	// From /sys/devices/system/node/online, 1 if the kernel doesn't have NUMA.
+	NUMANodes int
+	// Like uname -m and uname -r.
+	Machine       string
+	KernelRelease string
+	// The parameters from /proc/cmdline. Parameters without a value, like
+	// "nokaslr", map to "". If a parameter is there more than once, the last
+	// one wins.
+	Cmdline map[string]string
+	// See DetectVirt.
+	Virt Virt
+}
+
+// Uname returns what uname -m and uname -r say.
+func Uname() (machine, release string, err error) {
+	var uts syscall.Utsname
+	if err := syscall.Uname(&uts); err != nil {
+		return "", "", err
+	}
+	return utsString(uts.Machine[:]), utsString(uts.Release[:]), nil
+}
+
+// The fields of Utsname are int8 on some architectures and uint8 on others.
+func utsString[T int8 | uint8](field []T) string {
+	var b []byte
+	for _, c := range field {
+		if c == 0 {
+			break
+		}
+		b = append(b, byte(c))
+	}
+	return string(b)
+}
+
+// Read reads the info from /proc and /sys under root, which is normally "/".
+// Machine and KernelRelease always come from the running kernel.
+func Read(root string) (*Info, error) {
+	info := &Info{CPUFlags: make(map[string]bool)}
+	var err error
+	if info.Machine, info.KernelRelease, err = Uname(); err != nil {
+		return nil, fmt.Errorf("uname: %w", err)
+	}
+
+	cpuinfo, err := os.ReadFile(filepath.Join(root, "proc/cpuinfo"))
+	if err != nil {
+		return nil, err
+	}
+	for _, line := range strings.Split(string(cpuinfo), "\n") {
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		switch strings.TrimSpace(key) {
+		case "processor":
+			info.CPUs++
+		case "flags", "Features":
+			// Every CPU lists its flags, just take the first one's.
+			if info.CPUs <= 1 {
+				for _, flag := range strings.Fields(value) {
+					info.CPUFlags[flag] = true
+				}
+			}
+		}
+	}
+
+	meminfo, err := os.ReadFile(filepath.Join(root, "proc/meminfo"))
+	if err != nil {
+		return nil, err
+	}
+	if info.Memory, err = parseMemTotal(meminfo); err != nil {
+		return nil, err
+	}
+
+	info.NUMANodes = 1
+	online, err := os.ReadFile(filepath.Join(root, "sys/devices/system/node/online"))
+	if err == nil {
+		if info.NUMANodes, err = countList(strings.TrimSpace(string(online))); err != nil {
+			return nil, fmt.Errorf("parsing NUMA nodes: %w", err)
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	cmdline, err := os.ReadFile(filepath.Join(root, "proc/cmdline"))
+	if err != nil {
+		return nil, err
+	}
+	info.Cmdline = ParseCmdline(string(cmdline))
+	info.Virt = DetectVirt(root, info.Machine, info.CPUFlags)
+	return info, nil
+}
+
+// ParseCmdline parses a kernel command line into its parameters, see
+// Info.Cmdline. Anything after "--" is for init, not the kernel, so it's
+// ignored.
+func ParseCmdline(cmdline string) map[string]string {
+	params := make(map[string]string)
+	for _, field := range strings.Fields(cmdline) {
+		if field == "--" {
+			break
+		}
+		name, value, _ := strings.Cut(field, "=")
+		params[name] = strings.Trim(value, `"`)
+	}
+	return params
+}
+
+func parseMemTotal(meminfo []byte) (ByteSize, error) {
+	scanner := bufio.NewScanner(bytes.NewReader(meminfo))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 3 && fields[0] == "MemTotal:" && fields[2] == "kB" {
+			kb, err := strconv.ParseInt(fields[1], 10, 64)
+			if err != nil {
+				return 0, fmt.Errorf("parsing MemTotal: %w", err)
+			}
+			return ByteSize(kb * 1024), nil
+		}
+	}
+	return 0, fmt.Errorf("no MemTotal in meminfo")
+}
+
+// countList counts the entries in a kernel list like "0-3,8".
+func countList(list string) (int, error) {
+	count := 0
+	for _, part := range strings.Split(list, ",") {
+		first, last, isRange := strings.Cut(part, "-")
+		start, err := strconv.Atoi(first)
+		if err != nil {
+			return 0, err
+		}
+		end := start
+		if isRange {
+			if end, err = strconv.Atoi(last); err != nil {
+				return 0, err
+			}
+		}
+		count += end - start + 1
+	}
+	return count, nil
+}
+
+// ByteSize is an amount of memory. In the JSON it's a number of bytes or a
+// string like "128GiB". The suffixes are powers of 1024 whether or not they
+// have the "i", like in the kernel's mem= parameter.
+type ByteSize int64
+
+var byteSuffixes = []struct {
+	suffix string
+	shift  int
+}{
+	{"T", 40}, {"G", 30}, {"M", 20}, {"K", 10},
+}
+
+// ParseByteSize parses a size like "128GiB", "512M" or "4096".
+func ParseByteSize(s string) (ByteSize, error) {
+	num := strings.TrimSuffix(strings.TrimSuffix(strings.ToUpper(s), "B"), "I")
+	shift := 0
+	for _, bs := range byteSuffixes {
+		if trimmed, ok := strings.CutSuffix(num, bs.suffix); ok {
+			num, shift = trimmed, bs.shift
+			break
+		}
+	}
+	n, err := strconv.ParseInt(strings.TrimSpace(num), 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q, should be like \"128GiB\"", s)
+	}
+	if n > math.MaxInt64>>shift {
+		return 0, fmt.Errorf("size %q is too big", s)
+	}
+	return ByteSize(n << shift), nil
+}
+
+func (b ByteSize) String() string {
+	for _, bs := range byteSuffixes {
+		unit := ByteSize(1) << bs.shift
+		if b < unit {
+			continue
+		}
+		if b%unit == 0 {
+			return fmt.Sprintf("%d%siB", b/unit, bs.suffix)
+		}
+		return fmt.Sprintf("%.1f%siB", float64(b)/float64(unit), bs.suffix)
+	}
+	return fmt.Sprintf("%dB", int64(b))
+}
+
+func (b *ByteSize) UnmarshalJSON(data []byte) error {
+	var n int64
+	if json.Unmarshal(data, &n) == nil {
+		*b = ByteSize(n)
+		return nil
+	}
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("size must be a number of bytes or a string like \"128GiB\": %w", err)
+	}
+	parsed, err := ParseByteSize(s)
+	if err != nil {
+		return err
+	}
+	*b = parsed
+	return nil
+}
+
+func (b ByteSize) MarshalJSON() ([]byte, error) {
+	return json.Marshal(b.String())
+}
+
+// Requirements are what a test needs from the machine to be worth running.
+type Requirements struct {
+	// Each entry is a flag, or alternatives like "vmx|svm" where any of them
+	// will do.
+	CPUFlags []string `json:"cpu_flags,omitempty"`
+	// Checked against MemTotal, the machine's total RAM, not what's free or
+	// available when the test runs.
+	MinMemory ByteSize `json:"min_memory,omitempty"`
+	MinCPUs   int      `json:"min_cpus,omitempty"`
+	// Minimum number of NUMA nodes.
+	NUMANodes int `json:"numa_nodes,omitempty"`
+}
+
+func (r *Requirements) UnmarshalJSON(data []byte) error {
+	// Without the methods, so this doesn't recurse.
+	type requirements Requirements
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	var parsed requirements
+	if err := decoder.Decode(&parsed); err != nil {
+		return err
+	}
+	for _, flag := range parsed.CPUFlags {
+		for _, alt := range strings.Split(flag, "|") {
+			if alt == "" || strings.ContainsAny(alt, " \t") {
+				return fmt.Errorf("invalid CPU flag %q", flag)
+			}
+		}
+	}
+	*r = Requirements(parsed)
+	return nil
+}
+
+// Merge returns the requirements of both a and b, either can be nil. The
+// result is nil if they both are.
+func Merge(a, b *Requirements) *Requirements {
+	if a == nil || b == nil {
+		if a == nil {
+			return b
+		}
+		return a
+	}
+	return &Requirements{
+		CPUFlags:  append(append([]string(nil), a.CPUFlags...), b.CPUFlags...),
+		MinMemory: max(a.MinMemory, b.MinMemory),
+		MinCPUs:   max(a.MinCPUs, b.MinCPUs),
+		NUMANodes: max(a.NUMANodes, b.NUMANodes),
+	}
+}
+
+// Check returns the reasons the machine doesn't meet the requirements, like
+// "needs 128GiB of memory, have 8GiB". r can be nil.
+func (i *Info) Check(r *Requirements) []string {
+	if r == nil {
+		return nil
+	}
+	var unmet []string
+	for _, flag := range r.CPUFlags {
+		found := false
+		for _, alt := range strings.Split(flag, "|") {
+			found = found || i.CPUFlags[alt]
+		}
+		if !found {
+			unmet = append(unmet, fmt.Sprintf("needs CPU flag %s", strings.ReplaceAll(flag, "|", " or ")))
+		}
+	}
+	if i.Memory < r.MinMemory {
+		unmet = append(unmet, fmt.Sprintf("needs %v of memory, have %v", r.MinMemory, i.Memory))
+	}
+	if i.CPUs < r.MinCPUs {
+		unmet = append(unmet, fmt.Sprintf("needs %d CPUs, have %d", r.MinCPUs, i.CPUs))
+	}
+	if i.NUMANodes < r.NUMANodes {
+		unmet = append(unmet, fmt.Sprintf("needs %d NUMA nodes, have %d", r.NUMANodes, i.NUMANodes))
+	}
+	return unmet
+}
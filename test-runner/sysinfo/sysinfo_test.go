@@ -0,0 +1,221 @@
+package sysinfo
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func writeFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRead(t *testing.T) {
+	root := t.TempDir()
+	writeFile(t, filepath.Join(root, "proc/cpuinfo"), `processor	: 0
+vendor_id	: GenuineIntel
+flags		: fpu vme vmx avx2
+
+processor	: 1
+vendor_id	: GenuineIntel
+flags		: fpu vme vmx avx2 other
+`)
+	writeFile(t, filepath.Join(root, "proc/meminfo"), "MemTotal:        8388608 kB\nMemFree:         1024 kB\n")
+	writeFile(t, filepath.Join(root, "proc/cmdline"), "console=ttyS0 asi=on nokaslr asi=off -- init-arg\n")
+	machine, release, err := Uname()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := Read(root)
+	if err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	want := &Info{
+		CPUFlags:      map[string]bool{"fpu": true, "vme": true, "vmx": true, "avx2": true},
+		Memory:        8 << 30,
+		CPUs:          2,
+		NUMANodes:     1,
+		Machine:       machine,
+		KernelRelease: release,
+		Cmdline:       map[string]string{"console": "ttyS0", "asi": "off", "nokaslr": ""},
+		Virt:          VirtNone,
+	}
+	if diff := cmp.Diff(want, info); diff != "" {
+		t.Errorf("Read mismatch (-want +got):\n%s", diff)
+	}
+
+	writeFile(t, filepath.Join(root, "sys/devices/system/node/online"), "0-1,3\n")
+	if info, err = Read(root); err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	if info.NUMANodes != 3 {
+		t.Errorf("expected 3 NUMA nodes, got %d", info.NUMANodes)
+	}
+}
+
+func TestDetectVirt(t *testing.T) {
+	testCases := []struct {
+		name     string
+		machine  string
+		files    map[string]string
+		cpuFlags map[string]bool
+		want     Virt
+	}{
+		{name: "bare metal", machine: "x86_64", want: VirtNone},
+		{
+			name:    "x86 KVM",
+			machine: "x86_64",
+			files: map[string]string{
+				"sys/devices/system/clocksource/clocksource0/available_clocksource": "kvm-clock tsc acpi_pm\n",
+				"sys/class/dmi/id/sys_vendor":                                       "QEMU\n",
+			},
+			want: VirtKVM,
+		},
+		{
+			name:    "x86 TCG",
+			machine: "i686",
+			files:   map[string]string{"sys/class/dmi/id/sys_vendor": "QEMU\n"},
+			want:    VirtTCG,
+		},
+		{
+			name:    "x86 KVM without kvm-clock",
+			machine: "x86_64",
+			files: map[string]string{
+				"sys/class/dmi/id/sys_vendor": "QEMU\n",
+				"proc/cmdline":                "console=ttyS0 no-kvmclock\n",
+			},
+			want: VirtOther,
+		},
+		{
+			name:    "arm64 QEMU",
+			machine: "aarch64",
+			files:   map[string]string{"sys/class/dmi/id/sys_vendor": "QEMU\n"},
+			want:    VirtOther,
+		},
+		{
+			name:    "arm64 KVM with ptp_kvm",
+			machine: "aarch64",
+			files: map[string]string{
+				"sys/class/dmi/id/sys_vendor":   "QEMU\n",
+				"sys/class/ptp/ptp0/clock_name": "KVM virtual PTP\n",
+			},
+			want: VirtKVM,
+		},
+		{
+			name:    "Xen",
+			machine: "x86_64",
+			files:   map[string]string{"sys/hypervisor/type": "xen\n"},
+			want:    VirtOther,
+		},
+		{name: "other hypervisor", machine: "x86_64", cpuFlags: map[string]bool{"hypervisor": true}, want: VirtOther},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			root := t.TempDir()
+			for path, content := range tc.files {
+				writeFile(t, filepath.Join(root, path), content)
+			}
+			if got := DetectVirt(root, tc.machine, tc.cpuFlags); got != tc.want {
+				t.Errorf("DetectVirt() = %s, want %s", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestByteSize(t *testing.T) {
+	testCases := []struct {
+		in     string
+		want   ByteSize
+		string string
+	}{
+		{in: "128GiB", want: 128 << 30, string: "128GiB"},
+		{in: "512M", want: 512 << 20, string: "512MiB"},
+		{in: "2tb", want: 2 << 40, string: "2TiB"},
+		{in: "1536MiB", want: 1536 << 20, string: "1.5GiB"},
+		{in: "100", want: 100, string: "100B"},
+	}
+	for _, tc := range testCases {
+		got, err := ParseByteSize(tc.in)
+		if err != nil {
+			t.Errorf("ParseByteSize(%q) failed: %v", tc.in, err)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("ParseByteSize(%q) = %d, want %d", tc.in, got, tc.want)
+		}
+		if got.String() != tc.string {
+			t.Errorf("ByteSize(%d).String() = %q, want %q", got, got.String(), tc.string)
+		}
+	}
+	for _, in := range []string{"", "GiB", "lots", "-1G", "20000000000TiB"} {
+		if _, err := ParseByteSize(in); err == nil {
+			t.Errorf("ParseByteSize(%q) expected error", in)
+		}
+	}
+}
+
+func TestRequirementsJSON(t *testing.T) {
+	var r Requirements
+	if err := json.Unmarshal([]byte(`{"cpu_flags": ["vmx|svm"], "min_memory": "128GiB", "min_cpus": 4, "numa_nodes": 2}`), &r); err != nil {
+		t.Fatalf("Unmarshal failed: %v", err)
+	}
+	want := Requirements{CPUFlags: []string{"vmx|svm"}, MinMemory: 128 << 30, MinCPUs: 4, NUMANodes: 2}
+	if diff := cmp.Diff(want, r); diff != "" {
+		t.Errorf("Unmarshal mismatch (-want +got):\n%s", diff)
+	}
+
+	for _, bad := range []string{`{"min_mem": "1G"}`, `{"cpu_flags": ["vmx|"]}`, `{"min_memory": "lots"}`} {
+		if err := json.Unmarshal([]byte(bad), &r); err == nil {
+			t.Errorf("Unmarshal(%s) expected error", bad)
+		}
+	}
+}
+
+func TestCheck(t *testing.T) {
+	info := &Info{
+		CPUFlags:  map[string]bool{"svm": true},
+		Memory:    8 << 30,
+		CPUs:      2,
+		NUMANodes: 1,
+	}
+	if unmet := info.Check(nil); unmet != nil {
+		t.Errorf("expected no requirements to be met, got %v", unmet)
+	}
+	met := &Requirements{CPUFlags: []string{"vmx|svm"}, MinMemory: 1 << 30, MinCPUs: 2, NUMANodes: 1}
+	if unmet := info.Check(met); unmet != nil {
+		t.Errorf("expected %+v to be met, got %v", met, unmet)
+	}
+	unmet := info.Check(&Requirements{CPUFlags: []string{"avx512f", "vmx"}, MinMemory: 128 << 30, MinCPUs: 4, NUMANodes: 2})
+	want := []string{
+		"needs CPU flag avx512f",
+		"needs CPU flag vmx",
+		"needs 128GiB of memory, have 8GiB",
+		"needs 4 CPUs, have 2",
+		"needs 2 NUMA nodes, have 1",
+	}
+	if diff := cmp.Diff(want, unmet); diff != "" {
+		t.Errorf("Check mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestMerge(t *testing.T) {
+	a := &Requirements{CPUFlags: []string{"vmx|svm"}, MinMemory: 1 << 30, MinCPUs: 4}
+	b := &Requirements{CPUFlags: []string{"avx2"}, MinMemory: 2 << 30, MinCPUs: 2, NUMANodes: 2}
+	want := &Requirements{CPUFlags: []string{"vmx|svm", "avx2"}, MinMemory: 2 << 30, MinCPUs: 4, NUMANodes: 2}
+	if diff := cmp.Diff(want, Merge(a, b)); diff != "" {
+		t.Errorf("Merge mismatch (-want +got):\n%s", diff)
+	}
+	if Merge(nil, nil) != nil || Merge(a, nil) != a || Merge(nil, b) != b {
+		t.Errorf("Merge with nil should return the other one")
+	}
+}
@@ -0,0 +1,341 @@
+// Package tagexpr implements boolean expressions over test tags, like
+// "kvm && !(slow || flaky)", for choosing which tests to run.
+package tagexpr
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+type op int
+
+const (
+	opTag op = iota
+	opNot
+	opAnd
+	opOr
+)
+
+// Expr is a parsed expression. A tag is true if the test has it, and the
+// operators are ! (not), && (and) and || (or), from tightest to loosest, with
+// parentheses for grouping. A nil *Expr matches every test.
+type Expr struct {
+	op op
+	// For opTag.
+	tag string
+	// One for opNot, at least two for opAnd and opOr.
+	args []*Expr
+}
+
+// Tag returns an expression that's true for tests with the tag.
+func Tag(tag string) *Expr {
+	return &Expr{op: opTag, tag: tag}
+}
+
+// Not returns the negation of e.
+func Not(e *Expr) *Expr {
+	return &Expr{op: opNot, args: []*Expr{e}}
+}
+
+// And returns an expression that's true when all the exprs are. Nil exprs are
+// ignored, and the result is nil if they all are.
+func And(exprs ...*Expr) *Expr {
+	return combine(opAnd, exprs)
+}
+
+// Or returns an expression that's true when any of the exprs is. Nil exprs are
+// ignored, and the result is nil if they all are.
+func Or(exprs ...*Expr) *Expr {
+	return combine(opOr, exprs)
+}
+
+// AnyTag returns an expression that's true for tests with any of the tags, or
+// nil if there aren't any. The tags are sorted so the result doesn't depend on
+// their order.
+func AnyTag(tags ...string) *Expr {
+	tags = append([]string(nil), tags...)
+	sort.Strings(tags)
+	var exprs []*Expr
+	for _, tag := range tags {
+		exprs = append(exprs, Tag(tag))
+	}
+	return Or(exprs...)
+}
+
+func combine(o op, exprs []*Expr) *Expr {
+	var args []*Expr
+	for _, e := range exprs {
+		if e == nil {
+			continue
+		}
+		// Flatten, a && (b && c) is the same as a && b && c.
+		if e.op == o {
+			args = append(args, e.args...)
+		} else {
+			args = append(args, e)
+		}
+	}
+	switch len(args) {
+	case 0:
+		return nil
+	case 1:
+		return args[0]
+	}
+	return &Expr{op: o, args: args}
+}
+
+// Matches reports whether a test with the tags matches the expression.
+func (e *Expr) Matches(tags []string) bool {
+	return e.eval(tagSet(tags))
+}
+
+func tagSet(tags []string) map[string]bool {
+	set := make(map[string]bool, len(tags))
+	for _, tag := range tags {
+		set[tag] = true
+	}
+	return set
+}
+
+func (e *Expr) eval(tags map[string]bool) bool {
+	if e == nil {
+		return true
+	}
+	switch e.op {
+	case opTag:
+		return tags[e.tag]
+	case opNot:
+		return !e.args[0].eval(tags)
+	case opAnd:
+		for _, arg := range e.args {
+			if !arg.eval(tags) {
+				return false
+			}
+		}
+		return true
+	default:
+		for _, arg := range e.args {
+			if arg.eval(tags) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// Explain returns why a test with the tags doesn't match the expression, as
+// the tags that excluded it: "slow" if it has the slow tag and the expression
+// wanted it not to, "!mm" if it doesn't have mm and the expression wanted it
+// to. All of them together are enough to exclude the test. It returns nil if
+// the test matches.
+func (e *Expr) Explain(tags []string) []string {
+	set := tagSet(tags)
+	if e.eval(set) {
+		return nil
+	}
+	var reasons []string
+	seen := make(map[string]bool)
+	for _, reason := range e.whyFalse(set) {
+		if !seen[reason] {
+			seen[reason] = true
+			reasons = append(reasons, reason)
+		}
+	}
+	return reasons
+}
+
+// whyFalse explains an expression that evaluates to false. For an and, only
+// the arguments that are false matter, but every argument of an or has to be
+// false.
+func (e *Expr) whyFalse(tags map[string]bool) []string {
+	switch e.op {
+	case opTag:
+		return []string{"!" + e.tag}
+	case opNot:
+		return e.args[0].whyTrue(tags)
+	}
+	var reasons []string
+	for _, arg := range e.args {
+		if e.op == opOr || !arg.eval(tags) {
+			reasons = append(reasons, arg.whyFalse(tags)...)
+		}
+	}
+	return reasons
+}
+
+// whyTrue is the opposite of whyFalse.
+func (e *Expr) whyTrue(tags map[string]bool) []string {
+	switch e.op {
+	case opTag:
+		return []string{e.tag}
+	case opNot:
+		return e.args[0].whyFalse(tags)
+	}
+	var reasons []string
+	for _, arg := range e.args {
+		if e.op == opAnd || arg.eval(tags) {
+			reasons = append(reasons, arg.whyTrue(tags)...)
+		}
+	}
+	return reasons
+}
+
+// String returns the expression in the syntax Parse takes, with only the
+// parentheses it needs.
+func (e *Expr) String() string {
+	if e == nil {
+		return ""
+	}
+	switch e.op {
+	case opTag:
+		return e.tag
+	case opNot:
+		return "!" + e.args[0].group(opNot)
+	}
+	sep := " && "
+	if e.op == opOr {
+		sep = " || "
+	}
+	var parts []string
+	for _, arg := range e.args {
+		parts = append(parts, arg.group(e.op))
+	}
+	return strings.Join(parts, sep)
+}
+
+// group returns the expression as an argument of an operator, in parentheses
+// if it binds more loosely.
+func (e *Expr) group(parent op) string {
+	// The ops are in order of precedence, tightest first.
+	if e.op > parent {
+		return "(" + e.String() + ")"
+	}
+	return e.String()
+}
+
+// Parse parses an expression like "kvm && !(slow || flaky)". Tags can contain
+// anything but whitespace, parentheses and the operator characters &, | and !.
+func Parse(s string) (*Expr, error) {
+	p := &parser{input: s}
+	p.next()
+	e, err := p.parseOr()
+	if err != nil {
+		return nil, fmt.Errorf("invalid tag expression %q: %w", s, err)
+	}
+	if p.token != "" {
+		return nil, fmt.Errorf("invalid tag expression %q: unexpected %q", s, p.token)
+	}
+	return e, nil
+}
+
+type parser struct {
+	input string
+	// The current token, "" at the end.
+	token string
+}
+
+func isTagChar(r rune) bool {
+	return !unicode.IsSpace(r) && !strings.ContainsRune("()&|!", r)
+}
+
+func (p *parser) next() {
+	p.input = strings.TrimLeftFunc(p.input, unicode.IsSpace)
+	if p.input == "" {
+		p.token = ""
+		return
+	}
+	for _, t := range []string{"&&", "||", "!", "(", ")"} {
+		if strings.HasPrefix(p.input, t) {
+			p.token, p.input = t, p.input[len(t):]
+			return
+		}
+	}
+	end := strings.IndexFunc(p.input, func(r rune) bool { return !isTagChar(r) })
+	switch end {
+	case -1:
+		end = len(p.input)
+	case 0:
+		// A lone & or |.
+		end = 1
+	}
+	p.token, p.input = p.input[:end], p.input[end:]
+}
+
+func (p *parser) parseOr() (*Expr, error) {
+	return p.parseBinary(opOr, "||", p.parseAnd)
+}
+
+func (p *parser) parseAnd() (*Expr, error) {
+	return p.parseBinary(opAnd, "&&", p.parseNot)
+}
+
+func (p *parser) parseBinary(o op, token string, parseArg func() (*Expr, error)) (*Expr, error) {
+	arg, err := parseArg()
+	if err != nil {
+		return nil, err
+	}
+	args := []*Expr{arg}
+	for p.token == token {
+		p.next()
+		if arg, err = parseArg(); err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
+	}
+	return combine(o, args), nil
+}
+
+func (p *parser) parseNot() (*Expr, error) {
+	if p.token != "!" {
+		return p.parsePrimary()
+	}
+	p.next()
+	arg, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	return Not(arg), nil
+}
+
+func (p *parser) parsePrimary() (*Expr, error) {
+	switch {
+	case p.token == "":
+		return nil, fmt.Errorf("unexpected end")
+	case p.token == "(":
+		p.next()
+		e, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if p.token != ")" {
+			return nil, fmt.Errorf("missing )")
+		}
+		p.next()
+		return e, nil
+	case !isTagChar([]rune(p.token)[0]):
+		return nil, fmt.Errorf("unexpected %q", p.token)
+	}
+	e := Tag(p.token)
+	p.next()
+	return e, nil
+}
+
+func (e *Expr) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("tag expression must be a string like \"kvm && !slow\": %w", err)
+	}
+	parsed, err := Parse(s)
+	if err != nil {
+		return err
+	}
+	*e = *parsed
+	return nil
+}
+
+func (e *Expr) MarshalJSON() ([]byte, error) {
+	return json.Marshal(e.String())
+}
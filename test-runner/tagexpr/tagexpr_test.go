@@ -0,0 +1,91 @@
+package tagexpr
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestParse(t *testing.T) {
+	testCases := []struct {
+		expr string
+		// What String gives back.
+		want string
+	}{
+		{expr: "slow", want: "slow"},
+		{expr: "  lk-broken ", want: "lk-broken"},
+		{expr: "kvm&&!slow", want: "kvm && !slow"},
+		{expr: "a || b && c", want: "a || b && c"},
+		{expr: "(a || b) && c", want: "(a || b) && c"},
+		{expr: "a && (b && c)", want: "a && b && c"},
+		{expr: "!(a || b)", want: "!(a || b)"},
+		{expr: "!!a", want: "!!a"},
+		{expr: "((a))", want: "a"},
+	}
+	for _, tc := range testCases {
+		e, err := Parse(tc.expr)
+		if err != nil {
+			t.Errorf("Parse(%q) failed: %v", tc.expr, err)
+			continue
+		}
+		if got := e.String(); got != tc.want {
+			t.Errorf("Parse(%q).String() = %q, want %q", tc.expr, got, tc.want)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, s := range []string{"", "a &&", "&& a", "a & b", "a | b", "(a", "a)", "a b", "!", "()"} {
+		if _, err := Parse(s); err == nil {
+			t.Errorf("Parse(%q) expected error", s)
+		}
+	}
+}
+
+func TestMatches(t *testing.T) {
+	testCases := []struct {
+		expr string
+		tags []string
+		want bool
+		// From Explain, when it doesn't match.
+		wantReasons []string
+	}{
+		{expr: "mm", tags: []string{"mm", "slow"}, want: true},
+		{expr: "mm", tags: nil, want: false, wantReasons: []string{"!mm"}},
+		{expr: "kvm && !slow", tags: []string{"kvm"}, want: true},
+		{expr: "kvm && !slow", tags: []string{"kvm", "slow"}, want: false, wantReasons: []string{"slow"}},
+		{expr: "kvm && !slow", tags: []string{"slow"}, want: false, wantReasons: []string{"!kvm", "slow"}},
+		{expr: "flaky || mm", tags: []string{"slow"}, want: false, wantReasons: []string{"!flaky", "!mm"}},
+		{expr: "!(bad || lk-broken)", tags: []string{"bad", "lk-broken"}, want: false, wantReasons: []string{"bad", "lk-broken"}},
+		{expr: "!(bad || lk-broken)", tags: []string{"lk-broken"}, want: false, wantReasons: []string{"lk-broken"}},
+		{expr: "!(a && b)", tags: []string{"a", "b"}, want: false, wantReasons: []string{"a", "b"}},
+		{expr: "!bad || ok", tags: []string{"bad"}, want: false, wantReasons: []string{"bad", "!ok"}},
+		{expr: "!a && !(a || b)", tags: []string{"a"}, want: false, wantReasons: []string{"a"}},
+	}
+	for _, tc := range testCases {
+		e, err := Parse(tc.expr)
+		if err != nil {
+			t.Fatalf("Parse(%q) failed: %v", tc.expr, err)
+		}
+		if got := e.Matches(tc.tags); got != tc.want {
+			t.Errorf("%q.Matches(%v) = %v, want %v", tc.expr, tc.tags, got, tc.want)
+		}
+		if diff := cmp.Diff(tc.wantReasons, e.Explain(tc.tags)); diff != "" {
+			t.Errorf("%q.Explain(%v) mismatch (-want +got):\n%s", tc.expr, tc.tags, diff)
+		}
+	}
+}
+
+func TestCombine(t *testing.T) {
+	var nilExpr *Expr
+	if !nilExpr.Matches(nil) || nilExpr.Explain(nil) != nil {
+		t.Errorf("nil expression should match everything")
+	}
+	if e := And(nil, AnyTag()); e != nil {
+		t.Errorf("And of nothing = %v, want nil", e)
+	}
+	e := And(Not(AnyTag("slow", "bad")), nil, Tag("kvm"))
+	if got, want := e.String(), "!(bad || slow) && kvm"; got != want {
+		t.Errorf("combined expression = %q, want %q", got, want)
+	}
+}
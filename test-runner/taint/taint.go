@@ -0,0 +1,88 @@
+// Package taint decodes the kernel's taint flags, see
+// Documentation/admin-guide/tainted-kernels.rst in the kernel tree.
+package taint
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Taint is the bitmask from /proc/sys/kernel/tainted.
+type Taint uint64
+
+// DefaultPath is where the kernel exposes the current taint.
+const DefaultPath = "/proc/sys/kernel/tainted"
+
+// Letters for each taint bit, indexed by bit number. These are the letters the
+// kernel prints in "Tainted:" lines.
+var letters = []byte{
+	'P', // 0: proprietary module was loaded
+	'F', // 1: module was force loaded
+	'S', // 2: kernel running on an out of specification system
+	'R', // 3: module was force unloaded
+	'M', // 4: processor reported a Machine Check Exception
+	'B', // 5: bad page referenced or some unexpected page flags
+	'U', // 6: taint requested by userspace application
+	'D', // 7: kernel died recently, i.e. there was an OOPS or BUG
+	'A', // 8: ACPI table overridden by user
+	'W', // 9: kernel issued warning
+	'C', // 10: staging driver was loaded
+	'I', // 11: workaround for bug in platform firmware applied
+	'O', // 12: externally-built ("out-of-tree") module was loaded
+	'E', // 13: unsigned module was loaded
+	'L', // 14: soft lockup occurred
+	'K', // 15: kernel has been live patched
+	'X', // 16: auxiliary taint, defined for and used by distros
+	'T', // 17: kernel was built with the struct randomization plugin
+	'N', // 18: an in-kernel test has been run
+	'J', // 19: userspace used a mutating debug operation in fwctl
+}
+
+// Read reads the current taint from path, normally DefaultPath.
+func Read(path string) (Taint, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	v, err := strconv.ParseUint(strings.TrimSpace(string(b)), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	return Taint(v), nil
+}
+
+// Letters returns the letters for the bits that are set, in bit order. Bits
+// that don't have a letter are shown as '?'.
+func (t Taint) Letters() string {
+	var b strings.Builder
+	for bit := 0; bit < 64; bit++ {
+		if t&(1<<bit) == 0 {
+			continue
+		}
+		if bit < len(letters) {
+			b.WriteByte(letters[bit])
+		} else {
+			b.WriteByte('?')
+		}
+	}
+	return b.String()
+}
+
+func (t Taint) String() string {
+	return t.Letters()
+}
+
+// FromLetters returns the taint with the bits set for the given letters.
+func FromLetters(s string) (Taint, error) {
+	var t Taint
+	for _, c := range []byte(s) {
+		bit := strings.IndexByte(string(letters), c)
+		if bit < 0 {
+			return 0, fmt.Errorf("unknown taint letter %q", c)
+		}
+		t |= 1 << bit
+	}
+	return t, nil
+}
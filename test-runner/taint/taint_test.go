@@ -0,0 +1,51 @@
+package taint
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLetters(t *testing.T) {
+	testCases := []struct {
+		taint Taint
+		want  string
+	}{
+		{0, ""},
+		{1 << 7, "D"},
+		{1<<9 | 1<<7 | 1<<14, "DWL"},
+		{1 << 40, "?"},
+	}
+	for _, tc := range testCases {
+		if got := tc.taint.Letters(); got != tc.want {
+			t.Errorf("Taint(%d).Letters() = %q, want %q", tc.taint, got, tc.want)
+		}
+	}
+}
+
+func TestFromLetters(t *testing.T) {
+	got, err := FromLetters("WD")
+	if err != nil {
+		t.Fatalf("FromLetters failed: %v", err)
+	}
+	if want := Taint(1<<7 | 1<<9); got != want {
+		t.Errorf("FromLetters(\"WD\") = %d, want %d", got, want)
+	}
+	if _, err := FromLetters("WZ"); err == nil {
+		t.Errorf("FromLetters(\"WZ\") expected error")
+	}
+}
+
+func TestRead(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tainted")
+	if err := os.WriteFile(path, []byte("640\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	got, err := Read(path)
+	if err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	if got.Letters() != "DW" {
+		t.Errorf("Read() = %q, want DW", got.Letters())
+	}
+}
@@ -0,0 +1,166 @@
+package test_conf
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+
+	"test-runner/search"
+)
+
+// StaleNode is a node in an overlay config that doesn't correspond to anything
+// in the base config, so whatever it sets doesn't apply to any test. This
+// usually means a test was renamed.
+type StaleNode struct {
+	// The ID of the node, like a test ID.
+	ID string
+	// The closest test or suite in the base, or empty if nothing was close.
+	Suggestion string
+}
+
+func (s StaleNode) String() string {
+	msg := fmt.Sprintf("%s doesn't match any test or suite in the base config", s.ID)
+	if s.Suggestion != "" {
+		msg += fmt.Sprintf(" (did you mean %s?)", s.Suggestion)
+	}
+	return msg
+}
+
+// rootFields are the keys at the root of a config that aren't tests or suites.
+var rootFields = map[string]bool{
+	"bad_tags":   true,
+	"exit_codes": true,
+	"profiles":   true,
+}
+
+// ReadConfigJSON reads a config as generic JSON, for MergeConfigs.
+func ReadConfigJSON(path string) (map[string]any, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading JSON file: %w", err)
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	// Don't turn integers into floats.
+	decoder.UseNumber()
+	var conf map[string]any
+	if err := decoder.Decode(&conf); err != nil {
+		return nil, fmt.Errorf("error unmarshaling JSON from %s: %w", path, err)
+	}
+	return conf, nil
+}
+
+// MergeConfigs deep-merges overlay onto base, which gets modified. Objects are
+// merged key by key, anything else in the overlay replaces what's in the base.
+//
+// The overlay is expected to add fields to tests and suites that are in the
+// base, like tags. A node in the overlay that isn't in the base is fine if
+// there's a test in it, since then it's adding new tests, but otherwise it
+// doesn't do anything and it's returned as a StaleNode. Only the top-most
+// stale node in each part of the tree is returned.
+func MergeConfigs(base, overlay map[string]any) ([]StaleNode, error) {
+	m := &configMerger{}
+	m.collectIDs("", base)
+	if err := m.merge("", base, overlay); err != nil {
+		return nil, err
+	}
+	return m.stale, nil
+}
+
+type configMerger struct {
+	// Every test and suite in the base.
+	baseIDs []string
+	stale   []StaleNode
+}
+
+func isField(id, key string) bool {
+	return testFields[key] != nil || (id == "" && rootFields[key])
+}
+
+func childID(id, key string) string {
+	if id == "" {
+		return EscapeName(key)
+	}
+	return id + "." + EscapeName(key)
+}
+
+func (m *configMerger) collectIDs(id string, node map[string]any) {
+	for key, value := range node {
+		child, ok := value.(map[string]any)
+		if !ok || isField(id, key) {
+			continue
+		}
+		m.baseIDs = append(m.baseIDs, childID(id, key))
+		m.collectIDs(childID(id, key), child)
+	}
+}
+
+func (m *configMerger) merge(id string, base, overlay map[string]any) error {
+	var keys []string
+	for key := range overlay {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		value := overlay[key]
+		if isField(id, key) {
+			base[key] = mergeValues(base[key], value)
+			continue
+		}
+		cid := childID(id, key)
+		child, ok := value.(map[string]any)
+		if !ok {
+			return fmt.Errorf("%s: tests and suites must be objects, got %T", cid, value)
+		}
+		baseChild, ok := base[key].(map[string]any)
+		if !ok {
+			if !containsTest(child) {
+				suggestion, _ := search.FindClosestTest(cid, m.baseIDs)
+				m.stale = append(m.stale, StaleNode{ID: cid, Suggestion: suggestion})
+			}
+			base[key] = value
+			continue
+		}
+		if err := m.merge(cid, baseChild, child); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mergeValues merges objects, otherwise b wins.
+func mergeValues(a, b any) any {
+	aMap, aOK := a.(map[string]any)
+	bMap, bOK := b.(map[string]any)
+	if !aOK || !bOK {
+		return b
+	}
+	for key, value := range bMap {
+		aMap[key] = mergeValues(aMap[key], value)
+	}
+	return aMap
+}
+
+// containsTest reports whether node is a test or has one under it.
+func containsTest(node map[string]any) bool {
+	if _, ok := node["__is_test"]; ok {
+		return true
+	}
+	for _, value := range node {
+		if child, ok := value.(map[string]any); ok && containsTest(child) {
+			return true
+		}
+	}
+	return false
+}
+
+// NestConfig returns a config with conf under the given path, which is like a
+// suite ID.
+func NestConfig(conf map[string]any, path string) map[string]any {
+	parts := SplitID(path)
+	for i := len(parts) - 1; i >= 0; i-- {
+		conf = map[string]any{parts[i]: conf}
+	}
+	return conf
+}
@@ -0,0 +1,136 @@
+package test_conf
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestMergeConfigs(t *testing.T) {
+	testCases := []struct {
+		name      string
+		base      string
+		overlay   string
+		want      string
+		wantStale []StaleNode
+		wantErr   bool
+	}{
+		{
+			name: "annotate tests",
+			base: `{
+				"mm": {
+					"gup_test": {"__is_test": true, "command": ["gup"]},
+					"thp": {"__is_test": true, "command": ["thp"], "tags": ["a"]}
+				}
+			}`,
+			overlay: `{
+				"bad_tags": ["slow"],
+				"mm": {
+					"timeout": "10m",
+					"gup_test": {"tags": ["slow"]},
+					"thp": {"tags": ["b"]}
+				}
+			}`,
+			want: `{
+				"bad_tags": ["slow"],
+				"mm": {
+					"timeout": "10m",
+					"gup_test": {"__is_test": true, "command": ["gup"], "tags": ["slow"]},
+					"thp": {"__is_test": true, "command": ["thp"], "tags": ["b"]}
+				}
+			}`,
+		},
+		{
+			name: "new tests",
+			base: `{"mm": {"gup_test": {"__is_test": true, "command": ["gup"]}}}`,
+			overlay: `{
+				"blktests": {
+					"throtl": {
+						"001": {"__is_test": true, "command": ["blktests", "throtl/001"]}
+					}
+				}
+			}`,
+			want: `{
+				"mm": {"gup_test": {"__is_test": true, "command": ["gup"]}},
+				"blktests": {
+					"throtl": {
+						"001": {"__is_test": true, "command": ["blktests", "throtl/001"]}
+					}
+				}
+			}`,
+		},
+		{
+			name: "stale",
+			base: `{
+				"kvm": {
+					"msrs_test": {"__is_test": true, "command": ["msrs_test"]},
+					"rseq_test": {"__is_test": true, "command": ["rseq_test"]}
+				}
+			}`,
+			overlay: `{
+				"kvm": {
+					"msr_test": {"tags": ["flaky"]},
+					"rseq_test": {"tags": ["slow"]}
+				},
+				"gone": {
+					"suite": {"test": {"tags": ["slow"]}}
+				}
+			}`,
+			want: `{
+				"kvm": {
+					"msrs_test": {"__is_test": true, "command": ["msrs_test"]},
+					"msr_test": {"tags": ["flaky"]},
+					"rseq_test": {"__is_test": true, "command": ["rseq_test"], "tags": ["slow"]}
+				},
+				"gone": {
+					"suite": {"test": {"tags": ["slow"]}}
+				}
+			}`,
+			wantStale: []StaleNode{
+				{ID: "gone"},
+				{ID: "kvm.msr_test", Suggestion: "kvm.msrs_test"},
+			},
+		},
+		{
+			name:    "bare tag list",
+			base:    `{"kvm": {"msrs_test": {"__is_test": true, "command": ["msrs_test"]}}}`,
+			overlay: `{"kvm": {"msrs_test": ["flaky"]}}`,
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var base, overlay, want map[string]any
+			for _, v := range []struct {
+				s   string
+				out *map[string]any
+			}{{tc.base, &base}, {tc.overlay, &overlay}, {tc.want, &want}} {
+				if v.s == "" {
+					continue
+				}
+				if err := json.Unmarshal([]byte(v.s), v.out); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			stale, err := MergeConfigs(base, overlay)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatal("expected an error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if diff := cmp.Diff(want, base); diff != "" {
+				t.Errorf("merged config mismatch (-want +got):\n%s", diff)
+			}
+			if diff := cmp.Diff(tc.wantStale, stale); diff != "" {
+				t.Errorf("stale nodes mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
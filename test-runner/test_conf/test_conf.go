@@ -1,87 +1,442 @@
 package test_conf
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+
+	"test-runner/kconfig"
+	"test-runner/sysinfo"
+	"test-runner/tagexpr"
 )
 
+// Duration is a time.Duration that appears in the JSON as a string that
+// time.ParseDuration understands, like "30s" or "10m".
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration must be a string like \"30s\": %w", err)
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// ExitCodeOutcome says how to report a test that exited with a given code.
+type ExitCodeOutcome string
+
+const (
+	OutcomePass    ExitCodeOutcome = "pass"
+	OutcomeFail    ExitCodeOutcome = "fail"
+	OutcomeSkip    ExitCodeOutcome = "skip"
+	OutcomeError   ExitCodeOutcome = "error"
+	OutcomeTimeout ExitCodeOutcome = "timeout"
+)
+
+func (o *ExitCodeOutcome) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	switch outcome := ExitCodeOutcome(s); outcome {
+	case OutcomePass, OutcomeFail, OutcomeSkip, OutcomeError, OutcomeTimeout:
+		*o = outcome
+		return nil
+	}
+	return fmt.Errorf("unknown exit code outcome %q", s)
+}
+
+// ExitCodes maps exit codes to outcomes, for tests that don't follow the
+// default convention where 0 is a pass, 127 is an error (command not found)
+// and anything else is a failure. In the JSON the keys are strings.
+type ExitCodes map[int]ExitCodeOutcome
+
+// KselftestExitCodes is the convention from tools/testing/selftests/kselftest.h.
+var KselftestExitCodes = ExitCodes{4: OutcomeSkip}
+
+// Test is a leaf of the config. The inherited fields, like Tags and Timeout,
+// include what's inherited from the suites above.
 type Test struct {
+	// The key of the test in its parent suite.
+	Name   string `json:"-"`
+	Parent *Suite `json:"-"`
+
 	IsTest  bool     `json:"__is_test"`
 	Command []string `json:"command"`
-	Tags    []string `json:"tags,omitempty"`
+	// In the JSON, tags can also be objects like
+	// {"tag": "lk-broken", "when": {"arch": "i686"}}, those end up in
+	// ConditionalTags.
+	Tags []string `json:"tags,omitempty"`
+	// Zero means no timeout (unless the runner has a default). When set on a
+	// suite node, applies to all the tests below it that don't set their own.
+	Timeout Duration `json:"timeout,omitempty"`
+	// When running tests in parallel, don't run anything else at the same
+	// time as this test.
+	Exclusive bool `json:"exclusive,omitempty"`
+	// Arbitrary names for global state that the test messes with. When running
+	// tests in parallel, tests that share a resource won't overlap.
+	Resources []string `json:"resources,omitempty"`
+	// Number of times to re-run the test if it fails. If it then passes it
+	// gets reported as flaky instead of failed.
+	Retries int `json:"retries,omitempty"`
+	// Overrides the exit codes from the root of the config.
+	ExitCodes ExitCodes `json:"exit_codes,omitempty"`
+	// Environment variables for the test, on top of the runner's own. ${VAR}
+	// in the values is expanded from the runner's environment, see
+	// runner.commandEnv.
+	Env map[string]string `json:"env,omitempty"`
+	// Working directory for the test, empty means the runner's. Expanded like
+	// Env.
+	Cwd string `json:"cwd,omitempty"`
+	// Goes in front of Command, e.g. a wrapper script. This is mostly useful
+	// on suites, see FullCommand.
+	CommandPrefix []string `json:"command_prefix,omitempty"`
+	// Kernel config options the test needs, it gets skipped if the running
+	// kernel doesn't have them. Includes the ones from the suites above.
+	RequiresKconfig []kconfig.Requirement `json:"requires_kconfig,omitempty"`
+	// What the test needs from the machine, it gets skipped if it doesn't
+	// have it. Merged with the requirements from the suites above.
+	Requires *sysinfo.Requirements `json:"requires,omitempty"`
+	// Tags that only apply on some machines, see ResolveTags.
+	ConditionalTags []ConditionalTag `json:"-"`
+}
+
+// ConditionalTag is a tag that only applies where its condition matches.
+type ConditionalTag struct {
+	Tag  string            `json:"tag"`
+	When sysinfo.Condition `json:"when"`
+}
+
+// ResolveTags returns the test's tags, plus the conditional ones whose
+// conditions match the machine described by info. If info is nil, none of the
+// conditional tags apply.
+func (t *Test) ResolveTags(info *sysinfo.Info) []string {
+	tags := t.Tags
+	if info == nil {
+		return tags
+	}
+	for _, ct := range t.ConditionalTags {
+		if ct.When.Matches(info) {
+			tags = append(append([]string(nil), tags...), ct.Tag)
+		}
+	}
+	return tags
+}
+
+// tagsField is where the tags go when parsing, since they can be strings or
+// conditional tags.
+type tagsField struct {
+	tags        *[]string
+	conditional *[]ConditionalTag
+}
+
+func (f *tagsField) UnmarshalJSON(b []byte) error {
+	var items []json.RawMessage
+	if err := json.Unmarshal(b, &items); err != nil {
+		return fmt.Errorf("tags must be a list: %w", err)
+	}
+	for _, item := range items {
+		var tag string
+		if json.Unmarshal(item, &tag) == nil {
+			*f.tags = append(*f.tags, tag)
+			continue
+		}
+		decoder := json.NewDecoder(bytes.NewReader(item))
+		decoder.DisallowUnknownFields()
+		var ct ConditionalTag
+		if err := decoder.Decode(&ct); err != nil {
+			return fmt.Errorf("tags must be strings or objects like {\"tag\": \"lk-broken\", \"when\": {\"arch\": \"i686\"}}: %w", err)
+		}
+		if ct.Tag == "" {
+			return fmt.Errorf("conditional tag %s has no \"tag\"", item)
+		}
+		*f.conditional = append(*f.conditional, ct)
+	}
+	return nil
+}
+
+// FullCommand returns the command to run the test, including the prefix.
+func (t *Test) FullCommand() []string {
+	if len(t.CommandPrefix) == 0 {
+		return t.Command
+	}
+	return append(append([]string(nil), t.CommandPrefix...), t.Command...)
+}
+
+// Profile is a named selection of tests, chosen with --profile.
+type Profile struct {
+	// Only run tests whose tags match this, like "kvm && !slow".
+	Tags *tagexpr.Expr `json:"tags,omitempty"`
+}
+
+func (p *Profile) UnmarshalJSON(data []byte) error {
+	// Without the methods, so this doesn't recurse.
+	type profile Profile
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	var parsed profile
+	if err := decoder.Decode(&parsed); err != nil {
+		return err
+	}
+	*p = Profile(parsed)
+	return nil
 }
 
 type TestConf struct {
 	BadTags []string
-	Tests   map[string]Test
+	// Applies to all tests, but entries in Test.ExitCodes take precedence.
+	ExitCodes ExitCodes
+	// Keyed by name.
+	Profiles map[string]Profile
+	// The top of the tree of tests, it doesn't have a name.
+	Root *Suite
+	// All the tests from the tree, keyed by ID.
+	Tests map[string]Test
 }
 
+// Parse reads a test config. The config is checked strictly, anything that
+// doesn't fit the schema is an error, so that mistakes don't just make tests
+// silently disappear. All the problems are reported together, each starting
+// with its JSON path (in jq syntax).
 func Parse(testConfigFile string) (*TestConf, error) {
 	jsonBytes, err := os.ReadFile(testConfigFile)
 	if err != nil {
 		return nil, fmt.Errorf("error reading JSON file: %w", err)
 	}
 
-	var data map[string]interface{}
+	var data map[string]json.RawMessage
 	err = json.Unmarshal(jsonBytes, &data)
 	if err != nil {
 		return nil, fmt.Errorf("error unmarshaling JSON: %w", err)
 	}
 
-	var badTags []string
-	if badTagsData, ok := data["bad_tags"]; ok {
-		if badTagsList, ok := badTagsData.([]interface{}); ok {
-			for _, tag := range badTagsList {
-				if tagStr, ok := tag.(string); ok {
-					badTags = append(badTags, tagStr)
+	p := &parser{tests: make(map[string]Test)}
+	conf := &TestConf{}
+	if raw, ok := data["bad_tags"]; ok {
+		p.decode(jsonPath("", "bad_tags"), raw, &conf.BadTags)
+		delete(data, "bad_tags")
+	}
+	if raw, ok := data["exit_codes"]; ok {
+		p.decode(jsonPath("", "exit_codes"), raw, &conf.ExitCodes)
+		delete(data, "exit_codes")
+	}
+	if raw, ok := data["profiles"]; ok {
+		var profiles map[string]json.RawMessage
+		if p.decode(jsonPath("", "profiles"), raw, &profiles) {
+			conf.Profiles = make(map[string]Profile)
+			for _, name := range sortedKeys(profiles) {
+				var profile Profile
+				if p.decode(jsonPath(jsonPath("", "profiles"), name), profiles[name], &profile) {
+					conf.Profiles[name] = profile
 				}
 			}
 		}
-		delete(data, "bad_tags")
+		delete(data, "profiles")
+	}
+	conf.Root = &Suite{}
+	p.parseSuite(conf.Root, "", data)
+	if len(p.errs) != 0 {
+		return nil, fmt.Errorf("invalid test config %s:\n%w", testConfigFile, errors.Join(p.errs...))
 	}
+	conf.Tests = p.tests
+	return conf, nil
+}
 
-	tests := make(map[string]Test)
-	parseTests("", data, tests, []string{})
+// testFields are the keys allowed in a test node, and where they go.
+var testFields = map[string]func(t *Test) any{
+	"__is_test":        func(t *Test) any { return &t.IsTest },
+	"command":          func(t *Test) any { return &t.Command },
+	"tags":             func(t *Test) any { return &tagsField{&t.Tags, &t.ConditionalTags} },
+	"timeout":          func(t *Test) any { return &t.Timeout },
+	"exclusive":        func(t *Test) any { return &t.Exclusive },
+	"resources":        func(t *Test) any { return &t.Resources },
+	"retries":          func(t *Test) any { return &t.Retries },
+	"exit_codes":       func(t *Test) any { return &t.ExitCodes },
+	"env":              func(t *Test) any { return &t.Env },
+	"cwd":              func(t *Test) any { return &t.Cwd },
+	"command_prefix":   func(t *Test) any { return &t.CommandPrefix },
+	"requires_kconfig": func(t *Test) any { return &t.RequiresKconfig },
+	"requires":         func(t *Test) any { return &t.Requires },
+}
 
-	return &TestConf{
-		BadTags: badTags,
-		Tests:   tests,
-	}, nil
+// suiteFields are the keys in a suite node that aren't its children. They're
+// defaults for all the tests underneath, see Suite.
+var suiteFields = map[string]bool{
+	"tags":             true,
+	"timeout":          true,
+	"retries":          true,
+	"exit_codes":       true,
+	"env":              true,
+	"cwd":              true,
+	"command_prefix":   true,
+	"requires_kconfig": true,
+	"requires":         true,
 }
 
-// Er, this was vibe coded and it's fucking garbage, sorry.
-func parseTests(prefix string, node interface{}, tests map[string]Test, tags []string) {
-	nodeAsMap, ok := node.(map[string]interface{})
-	if !ok {
-		return
+type parser struct {
+	tests map[string]Test
+	errs  []error
+}
+
+func (p *parser) errorf(path string, format string, args ...any) {
+	p.errs = append(p.errs, fmt.Errorf("%s: %s", path, fmt.Sprintf(format, args...)))
+}
+
+// decode unmarshals raw into v, recording an error if that doesn't work.
+func (p *parser) decode(path string, raw json.RawMessage, v any) bool {
+	if err := json.Unmarshal(raw, v); err != nil {
+		p.errorf(path, "%v", err)
+		return false
 	}
+	return true
+}
 
-	// Re-marshal the child map to unmarshal it into the TestNode struct
-	childBytes, err := json.Marshal(nodeAsMap)
-	if err != nil {
-		return
+var identRegexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// jsonPath returns the path of a key inside the node at path, the way jq
+// would write it.
+func jsonPath(path, key string) string {
+	if identRegexp.MatchString(key) {
+		return path + "." + key
 	}
-	var test Test
-	if err := json.Unmarshal(childBytes, &test); err == nil {
-		if test.IsTest {
-			if prefix != "" {
-				test.Tags = append(test.Tags, tags...)
-				tests[prefix] = test
-			}
+	return path + "[" + strconv.Quote(key) + "]"
+}
+
+func sortedKeys(node map[string]json.RawMessage) []string {
+	var keys []string
+	for key := range node {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// asObject returns raw as an object, or nil if it isn't one.
+func asObject(raw json.RawMessage) map[string]json.RawMessage {
+	var obj map[string]json.RawMessage
+	if json.Unmarshal(raw, &obj) != nil {
+		return nil
+	}
+	return obj
+}
+
+// describe says what kind of JSON value raw is, for errors.
+func describe(raw json.RawMessage) string {
+	var v any
+	json.Unmarshal(raw, &v)
+	switch v.(type) {
+	case map[string]any:
+		return "an object"
+	case []any:
+		return "a list"
+	case string:
+		return "a string"
+	case float64:
+		return "a number"
+	case bool:
+		return "a boolean"
+	}
+	return "null"
+}
+
+// parseSuite parses a node that isn't a test into suite. Apart from
+// suiteFields, its keys are its children, which are tests or more suites. path
+// is the node's JSON path.
+func (p *parser) parseSuite(suite *Suite, path string, node map[string]json.RawMessage) {
+	var fields Test
+	suite.set = make(map[string]bool)
+	for _, key := range sortedKeys(node) {
+		if suiteFields[key] {
+			p.decode(jsonPath(path, key), node[key], testFields[key](&fields))
+			suite.set[key] = true
 		}
 	}
+	suite.Tags = fields.Tags
+	suite.ConditionalTags = fields.ConditionalTags
+	suite.Timeout = fields.Timeout
+	suite.Retries = fields.Retries
+	suite.ExitCodes = fields.ExitCodes
+	suite.Env = fields.Env
+	suite.Cwd = fields.Cwd
+	suite.CommandPrefix = fields.CommandPrefix
+	suite.RequiresKconfig = fields.RequiresKconfig
+	suite.Requires = fields.Requires
 
-	currentTags := tags
-	if test.Tags != nil {
-		currentTags = append(currentTags, test.Tags...)
+	for _, key := range sortedKeys(node) {
+		if suiteFields[key] {
+			continue
+		}
+		raw := node[key]
+		childPath := jsonPath(path, key)
+		if testFields[key] != nil {
+			p.errorf(childPath, "%q only applies to tests, but %s isn't a test (is __is_test missing?)", key, pathOrRoot(path))
+			continue
+		}
+		child := asObject(raw)
+		if child == nil {
+			var tagList []string
+			if json.Unmarshal(raw, &tagList) == nil && tagList != nil {
+				p.errorf(childPath, "tests and suites must be objects, this looks like a list of tags (did you mean %s?)", jsonPath(childPath, "tags"))
+			} else {
+				p.errorf(childPath, "tests and suites must be objects, got %s", describe(raw))
+			}
+			continue
+		}
+		if _, ok := child["__is_test"]; ok {
+			p.parseTest(suite, key, childPath, child)
+		} else {
+			childSuite := &Suite{Name: key, Parent: suite}
+			suite.Suites = append(suite.Suites, childSuite)
+			p.parseSuite(childSuite, childPath, child)
+		}
 	}
+}
 
-	for key, childNode := range nodeAsMap {
-		newPrefix := key
-		if prefix != "" {
-			newPrefix = prefix + "." + key
+// parseTest parses a node with __is_test in it. If __is_test is false the
+// test still has to be valid, but it's left out of the config.
+func (p *parser) parseTest(parent *Suite, name, path string, node map[string]json.RawMessage) {
+	test := &Test{Name: name, Parent: parent}
+	ok := true
+	for _, key := range sortedKeys(node) {
+		raw := node[key]
+		field := testFields[key]
+		if field == nil {
+			if asObject(raw) != nil {
+				p.errorf(jsonPath(path, key), "tests can't contain other tests or suites, but %s is a test", path)
+			} else {
+				p.errorf(jsonPath(path, key), "unknown key %q in test", key)
+			}
+			ok = false
+			continue
 		}
-		parseTests(newPrefix, childNode, tests, currentTags)
+		ok = p.decode(jsonPath(path, key), raw, field(test)) && ok
+	}
+	if !ok || !test.IsTest {
+		return
+	}
+	parent.inherit(test, node)
+	parent.Tests = append(parent.Tests, test)
+	p.tests[test.ID()] = *test
+}
+
+func pathOrRoot(path string) string {
+	if path == "" {
+		return "the root"
 	}
+	return path
 }
@@ -1,10 +1,19 @@
 package test_conf
 
 import (
+	"encoding/json"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+
+	"test-runner/kconfig"
+	"test-runner/sysinfo"
+	"test-runner/tagexpr"
 )
 
 func TestParse(t *testing.T) {
@@ -104,6 +113,168 @@ func TestParse(t *testing.T) {
 				},
 			},
 		},
+		{
+			name: "timeout inheritance",
+			jsonContent: `{
+				"foo": {
+					"timeout": "10m",
+					"bar": {
+						"__is_test": true,
+						"command": ["echo", "hello"]
+					},
+					"baz": {
+						"__is_test": true,
+						"command": ["echo", "hello"],
+						"timeout": "30s"
+					}
+				}
+			}`,
+			expected: &TestConf{
+				Tests: map[string]Test{
+					"foo.bar": {
+						IsTest:  true,
+						Command: []string{"echo", "hello"},
+						Timeout: Duration(10 * time.Minute),
+					},
+					"foo.baz": {
+						IsTest:  true,
+						Command: []string{"echo", "hello"},
+						Timeout: Duration(30 * time.Second),
+					},
+				},
+			},
+		},
+		{
+			name: "suite defaults",
+			jsonContent: `{
+				"blktests": {
+					"command_prefix": ["wrapper"],
+					"cwd": "/blktests",
+					"env": {"A": "suite", "B": "suite"},
+					"exit_codes": {"4": "skip", "5": "fail"},
+					"retries": 2,
+					"throtl": {
+						"env": {"B": "throtl"},
+						"retries": 0,
+						"001": {
+							"__is_test": true,
+							"command": ["throtl/001"],
+							"env": {"C": "test"},
+							"exit_codes": {"5": "pass"}
+						},
+						"002": {
+							"__is_test": true,
+							"command": ["throtl/002"],
+							"command_prefix": [],
+							"cwd": "/tmp",
+							"retries": 3
+						}
+					}
+				}
+			}`,
+			expected: &TestConf{
+				Tests: map[string]Test{
+					"blktests.throtl.001": {
+						IsTest:        true,
+						Command:       []string{"throtl/001"},
+						CommandPrefix: []string{"wrapper"},
+						Cwd:           "/blktests",
+						Env:           map[string]string{"A": "suite", "B": "throtl", "C": "test"},
+						ExitCodes:     ExitCodes{4: OutcomeSkip, 5: OutcomePass},
+					},
+					"blktests.throtl.002": {
+						IsTest:        true,
+						Command:       []string{"throtl/002"},
+						CommandPrefix: []string{},
+						Cwd:           "/tmp",
+						Env:           map[string]string{"A": "suite", "B": "throtl"},
+						ExitCodes:     ExitCodes{4: OutcomeSkip, 5: OutcomeFail},
+						Retries:       3,
+					},
+				},
+			},
+		},
+		{
+			name: "kconfig requirements",
+			jsonContent: `{
+				"blktests": {
+					"requires_kconfig": ["BLK_DEV"],
+					"throtl": {
+						"requires_kconfig": ["SCSI_DEBUG=m"],
+						"001": {
+							"__is_test": true,
+							"command": ["throtl/001"],
+							"requires_kconfig": ["BLK_DEV_THROTTLING=y"]
+						}
+					}
+				}
+			}`,
+			expected: &TestConf{
+				Tests: map[string]Test{
+					"blktests.throtl.001": {
+						IsTest:  true,
+						Command: []string{"throtl/001"},
+						RequiresKconfig: []kconfig.Requirement{
+							{Option: "BLK_DEV", Values: []string{"y", "m"}},
+							{Option: "SCSI_DEBUG", Values: []string{"m"}},
+							{Option: "BLK_DEV_THROTTLING", Values: []string{"y"}},
+						},
+					},
+				},
+			},
+		},
+		{
+			name: "hardware requirements",
+			jsonContent: `{
+				"kvm": {
+					"requires": {"cpu_flags": ["vmx|svm"], "min_cpus": 2},
+					"mmu_stress_test": {
+						"__is_test": true,
+						"command": ["mmu_stress_test"],
+						"requires": {"min_memory": "128GiB", "min_cpus": 1}
+					}
+				}
+			}`,
+			expected: &TestConf{
+				Tests: map[string]Test{
+					"kvm.mmu_stress_test": {
+						IsTest:  true,
+						Command: []string{"mmu_stress_test"},
+						Requires: &sysinfo.Requirements{
+							CPUFlags:  []string{"vmx|svm"},
+							MinMemory: 128 << 30,
+							MinCPUs:   2,
+						},
+					},
+				},
+			},
+		},
+		{
+			name: "conditional tags",
+			jsonContent: `{
+				"x86": {
+					"tags": [{"tag": "asi", "when": {"cmdline": "asi=on"}}],
+					"nx_stack_32": {
+						"__is_test": true,
+						"command": ["nx_stack_32"],
+						"tags": ["slow", {"tag": "lk-broken", "when": {"arch": "i686"}}]
+					}
+				}
+			}`,
+			expected: &TestConf{
+				Tests: map[string]Test{
+					"x86.nx_stack_32": {
+						IsTest:  true,
+						Command: []string{"nx_stack_32"},
+						Tags:    []string{"slow"},
+						ConditionalTags: []ConditionalTag{
+							{Tag: "lk-broken", When: sysinfo.Condition{Arch: sysinfo.StringList{"i686"}}},
+							{Tag: "asi", When: sysinfo.Condition{Cmdline: sysinfo.StringList{"asi=on"}}},
+						},
+					},
+				},
+			},
+		},
 		{
 			name: "bad_tags",
 			jsonContent: `{
@@ -125,6 +296,61 @@ func TestParse(t *testing.T) {
 				},
 			},
 		},
+		{
+			name: "exit codes",
+			jsonContent: `{
+				"exit_codes": {"4": "skip"},
+				"foo": {
+					"bar": {
+						"__is_test": true,
+						"command": ["echo", "hello"],
+						"exit_codes": {"1": "pass", "124": "timeout"}
+					}
+				}
+			}`,
+			expected: &TestConf{
+				ExitCodes: ExitCodes{4: OutcomeSkip},
+				Tests: map[string]Test{
+					"foo.bar": {
+						IsTest:    true,
+						Command:   []string{"echo", "hello"},
+						ExitCodes: ExitCodes{1: OutcomePass, 124: OutcomeTimeout},
+					},
+				},
+			},
+		},
+		{
+			name: "profiles",
+			jsonContent: `{
+				"profiles": {
+					"quick": {"tags": "!slow && !flaky"},
+					"all": {}
+				},
+				"foo": {
+					"__is_test": true,
+					"command": ["echo", "hello"]
+				}
+			}`,
+			expected: &TestConf{
+				Profiles: map[string]Profile{
+					"quick": {Tags: mustParseTags(t, "!slow && !flaky")},
+					"all":   {},
+				},
+				Tests: map[string]Test{
+					"foo": {
+						IsTest:  true,
+						Command: []string{"echo", "hello"},
+					},
+				},
+			},
+		},
+		{
+			name: "invalid exit code outcome",
+			jsonContent: `{
+				"exit_codes": {"4": "explode"}
+			}`,
+			expectError: true,
+		},
 		{
 			name: "invalid json",
 			jsonContent: `{
@@ -162,9 +388,325 @@ func TestParse(t *testing.T) {
 				t.Fatalf("unexpected error: %v", err)
 			}
 
-			if diff := cmp.Diff(tc.expected, conf); diff != "" {
+			// The tree is checked in TestTree.
+			ignoreTree := cmp.Options{
+				cmpopts.IgnoreFields(TestConf{}, "Root"),
+				cmpopts.IgnoreFields(Test{}, "Name", "Parent"),
+				cmp.Comparer(func(a, b *tagexpr.Expr) bool { return a.String() == b.String() }),
+			}
+			if diff := cmp.Diff(tc.expected, conf, ignoreTree); diff != "" {
 				t.Errorf("Parse() mismatch (-want +got):\n%s", diff)
 			}
 		})
 	}
 }
+
+func mustParseTags(t *testing.T, s string) *tagexpr.Expr {
+	t.Helper()
+	e, err := tagexpr.Parse(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return e
+}
+
+func TestParseErrors(t *testing.T) {
+	testCases := []struct {
+		name        string
+		jsonContent string
+		// Each error has to be in the message.
+		wantErrs []string
+	}{
+		{
+			name: "unknown key",
+			jsonContent: `{
+				"foo": {
+					"bar": {
+						"__is_test": true,
+						"command": ["echo"],
+						"tgas": ["slow"]
+					}
+				}
+			}`,
+			wantErrs: []string{`.foo.bar.tgas: unknown key "tgas" in test`},
+		},
+		{
+			name: "wrong types",
+			jsonContent: `{
+				"bad_tags": "slow",
+				"foo": {
+					"timeout": 10,
+					"bar": {
+						"__is_test": "yes",
+						"command": "echo",
+						"retries": 1.5
+					}
+				}
+			}`,
+			wantErrs: []string{
+				".bad_tags: json: cannot unmarshal string into Go value of type []string",
+				`.foo.timeout: duration must be a string like "30s"`,
+				".foo.bar.__is_test: json: cannot unmarshal string into Go value of type bool",
+				".foo.bar.command: json: cannot unmarshal string into Go value of type []string",
+				".foo.bar.retries: json: cannot unmarshal number 1.5 into Go value of type int",
+			},
+		},
+		{
+			name: "bad kconfig requirement",
+			jsonContent: `{
+				"foo": {
+					"requires_kconfig": ["CONFIG_KVM=y|"],
+					"bar": {
+						"__is_test": true,
+						"command": ["echo"],
+						"requires_kconfig": ["SCSI DEBUG"]
+					}
+				}
+			}`,
+			wantErrs: []string{
+				`.foo.requires_kconfig: invalid kconfig requirement "CONFIG_KVM=y|", empty value`,
+				`.foo.bar.requires_kconfig: invalid kconfig requirement "SCSI DEBUG"`,
+			},
+		},
+		{
+			name: "bad profiles",
+			jsonContent: `{
+				"profiles": {
+					"quick": {"tags": "!slow &&"},
+					"mm": {"tag": "mm"}
+				}
+			}`,
+			wantErrs: []string{
+				`.profiles.mm: json: unknown field "tag"`,
+				`.profiles.quick: invalid tag expression "!slow &&": unexpected end`,
+			},
+		},
+		{
+			name: "bad hardware requirements",
+			jsonContent: `{
+				"foo": {
+					"bar": {
+						"__is_test": true,
+						"command": ["echo"],
+						"requires": {"min_mem": "1G"}
+					}
+				}
+			}`,
+			wantErrs: []string{`.foo.bar.requires: json: unknown field "min_mem"`},
+		},
+		{
+			name: "bad conditional tags",
+			jsonContent: `{
+				"foo": {
+					"tags": [{"tag": "lk-broken", "when": {"arch": "i686"}, "unless": {}}],
+					"bar": {
+						"__is_test": true,
+						"command": ["echo"],
+						"tags": [{"when": {"arch": "i686"}}]
+					},
+					"baz": {
+						"__is_test": true,
+						"command": ["echo"],
+						"tags": [{"tag": "lk-broken", "when": {"virt": "xen"}}]
+					}
+				}
+			}`,
+			wantErrs: []string{
+				`.foo.tags: tags must be strings or objects like`,
+				`.foo.bar.tags: conditional tag {"when": {"arch": "i686"}} has no "tag"`,
+				`.foo.baz.tags: tags must be strings or objects like {"tag": "lk-broken", "when": {"arch": "i686"}}: unknown virt "xen"`,
+			},
+		},
+		{
+			name: "bare tag list",
+			jsonContent: `{
+				"kselftests": {
+					"kvm": {
+						"msrs_test": ["flaky"]
+					},
+					"blk": {
+						"001": ["lk-broken"]
+					}
+				}
+			}`,
+			wantErrs: []string{
+				".kselftests.kvm.msrs_test: tests and suites must be objects, this looks like a list of tags (did you mean .kselftests.kvm.msrs_test.tags?)",
+				`.kselftests.blk["001"]: tests and suites must be objects, this looks like a list of tags (did you mean .kselftests.blk["001"].tags?)`,
+			},
+		},
+		{
+			name: "other leaf",
+			jsonContent: `{
+				"foo": {
+					"bar": 1
+				}
+			}`,
+			wantErrs: []string{".foo.bar: tests and suites must be objects, got a number"},
+		},
+		{
+			name: "test under test",
+			jsonContent: `{
+				"foo": {
+					"__is_test": true,
+					"command": ["echo"],
+					"bar": {
+						"__is_test": true,
+						"command": ["echo"]
+					}
+				}
+			}`,
+			wantErrs: []string{".foo.bar: tests can't contain other tests or suites, but .foo is a test"},
+		},
+		{
+			name: "test field on suite",
+			jsonContent: `{
+				"foo": {
+					"command": ["echo"]
+				}
+			}`,
+			wantErrs: []string{`.foo.command: "command" only applies to tests, but .foo isn't a test (is __is_test missing?)`},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "test.json")
+			if err := os.WriteFile(path, []byte(tc.jsonContent), 0644); err != nil {
+				t.Fatal(err)
+			}
+			_, err := Parse(path)
+			if err == nil {
+				t.Fatal("expected an error, got nil")
+			}
+			for _, want := range tc.wantErrs {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("error doesn't contain %q:\n%v", want, err)
+				}
+			}
+			if got := strings.Count(err.Error(), "\n"); got != len(tc.wantErrs) {
+				t.Errorf("expected %d errors, got:\n%v", len(tc.wantErrs), err)
+			}
+		})
+	}
+}
+
+func TestTree(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.json")
+	if err := os.WriteFile(path, []byte(`{
+		"kselftests": {
+			"tags": ["ksft"],
+			"timeout": "10m",
+			"mm": {
+				"ksft_gup_test.sh": {
+					"__is_test": true,
+					"command": ["run_kselftest.sh", "-t", "mm:ksft_gup_test.sh"],
+					"tags": ["slow"]
+				},
+				"back\\slash": {
+					"__is_test": true,
+					"command": ["true"]
+				}
+			}
+		}
+	}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	conf, err := Parse(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(conf.Root.Suites) != 1 || len(conf.Root.Suites[0].Suites) != 1 {
+		t.Fatalf("unexpected tree: %+v", conf.Root)
+	}
+	mm := conf.Root.Suites[0].Suites[0]
+	if mm.ID() != "kselftests.mm" || mm.Parent.Name != "kselftests" {
+		t.Errorf("unexpected suite %s with parent %s", mm.ID(), mm.Parent.Name)
+	}
+	var gotIDs []string
+	for _, test := range mm.Tests {
+		gotIDs = append(gotIDs, test.ID())
+		if test.Parent != mm {
+			t.Errorf("%s has the wrong parent", test.ID())
+		}
+	}
+	wantIDs := []string{`kselftests.mm.back\\slash`, `kselftests.mm.ksft_gup_test\.sh`}
+	if diff := cmp.Diff(wantIDs, gotIDs); diff != "" {
+		t.Errorf("test IDs mismatch (-want +got):\n%s", diff)
+	}
+
+	test, ok := conf.Tests[`kselftests.mm.ksft_gup_test\.sh`]
+	if !ok {
+		t.Fatalf("test missing from Tests: %v", conf.Tests)
+	}
+	if test.Name != "ksft_gup_test.sh" {
+		t.Errorf("expected name to be unchanged, got %q", test.Name)
+	}
+	if diff := cmp.Diff([]string{"slow", "ksft"}, test.Tags); diff != "" {
+		t.Errorf("tags mismatch (-want +got):\n%s", diff)
+	}
+	if test.Timeout != Duration(10*time.Minute) {
+		t.Errorf("expected the timeout to be inherited, got %v", test.Timeout)
+	}
+}
+
+func TestResolveTags(t *testing.T) {
+	var test Test
+	if err := json.Unmarshal([]byte(`["slow", {"tag": "lk-broken", "when": {"arch": "i686", "kernel": "<6.12"}}, {"tag": "asi", "when": {"cmdline": "asi=on"}}]`),
+		&tagsField{&test.Tags, &test.ConditionalTags}); err != nil {
+		t.Fatal(err)
+	}
+	testCases := []struct {
+		name string
+		info *sysinfo.Info
+		want []string
+	}{
+		{name: "no info", want: []string{"slow"}},
+		{
+			name: "i686",
+			info: &sysinfo.Info{Machine: "i686", KernelRelease: "6.11.0"},
+			want: []string{"slow", "lk-broken"},
+		},
+		{
+			name: "new kernel",
+			info: &sysinfo.Info{Machine: "i686", KernelRelease: "6.12.0"},
+			want: []string{"slow"},
+		},
+		{
+			name: "asi=on",
+			info: &sysinfo.Info{Machine: "x86_64", KernelRelease: "6.11.0", Cmdline: map[string]string{"asi": "on"}},
+			want: []string{"slow", "asi"},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if diff := cmp.Diff(tc.want, test.ResolveTags(tc.info)); diff != "" {
+				t.Errorf("ResolveTags mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+	if diff := cmp.Diff([]string{"slow"}, test.Tags); diff != "" {
+		t.Errorf("ResolveTags modified Tags (-want +got):\n%s", diff)
+	}
+}
+
+func TestIDs(t *testing.T) {
+	testCases := []struct {
+		names []string
+		id    string
+	}{
+		{names: []string{"suite", "test"}, id: "suite.test"},
+		{names: []string{"mm", "ksft_gup_test.sh"}, id: `mm.ksft_gup_test\.sh`},
+		{names: []string{`a\b`, "c.d.e"}, id: `a\\b.c\.d\.e`},
+		{names: []string{"test"}, id: "test"},
+		{names: []string{"trailing\\"}, id: `trailing\\`},
+	}
+	for _, tc := range testCases {
+		if got := JoinID(tc.names...); got != tc.id {
+			t.Errorf("JoinID(%q) = %q, want %q", tc.names, got, tc.id)
+		}
+		if diff := cmp.Diff(tc.names, SplitID(tc.id)); diff != "" {
+			t.Errorf("SplitID(%q) mismatch (-want +got):\n%s", tc.id, diff)
+		}
+	}
+}
@@ -0,0 +1,186 @@
+package test_conf
+
+import (
+	"encoding/json"
+	"strings"
+
+	"test-runner/kconfig"
+	"test-runner/sysinfo"
+)
+
+// Suite is a node in the config that isn't a test. Its fields are defaults for
+// all the tests underneath, and they're only what's set on the suite itself.
+// The tests have the inherited values, see inherit.
+type Suite struct {
+	// The key of the suite in its parent, empty for the root.
+	Name   string
+	Parent *Suite
+
+	Tags            []string
+	ConditionalTags []ConditionalTag
+	Timeout         Duration
+	Retries         int
+	ExitCodes       ExitCodes
+	Env             map[string]string
+	Cwd             string
+	CommandPrefix   []string
+	RequiresKconfig []kconfig.Requirement
+	Requires        *sysinfo.Requirements
+	// The JSON keys of the fields that were set.
+	set map[string]bool
+
+	// Both sorted by name.
+	Suites []*Suite
+	Tests  []*Test
+}
+
+// Path returns the names of the suite and the ones above it, starting at the
+// top. It's empty for the root.
+func (s *Suite) Path() []string {
+	if s == nil || s.Parent == nil {
+		return nil
+	}
+	return append(s.Parent.Path(), s.Name)
+}
+
+// ID returns the suite's ID, the prefix for the IDs of the tests in it.
+func (s *Suite) ID() string {
+	return JoinID(s.Path()...)
+}
+
+// inheritedTags returns the tags for the tests in this suite, from the top
+// down.
+func (s *Suite) inheritedTags() []string {
+	if s == nil {
+		return nil
+	}
+	return append(s.Parent.inheritedTags(), s.Tags...)
+}
+
+// nearest returns the closest suite to s (including s) that sets the field
+// with the given JSON key, or nil if none of them do.
+func (s *Suite) nearest(key string) *Suite {
+	for ; s != nil; s = s.Parent {
+		if s.set[key] {
+			return s
+		}
+	}
+	return nil
+}
+
+// mergeMaps returns the entries from all the maps, the later ones win. It's
+// nil if they're all empty.
+func mergeMaps[M ~map[K]V, K comparable, V any](maps ...M) M {
+	var merged M
+	for _, m := range maps {
+		for k, v := range m {
+			if merged == nil {
+				merged = make(M)
+			}
+			merged[k] = v
+		}
+	}
+	return merged
+}
+
+// inherit fills in the fields of a test in this suite from the suites above
+// it. node is the test's JSON, to tell which fields it set itself. Tags and
+// requirements from all the suites are added to the test's own. Env and ExitCodes are merged,
+// entry by entry, and the closer to the test the entry is set, the higher its
+// precedence. For the other fields, the value closest to the test wins, so a
+// test (or suite) can override a default by setting the field itself, even to
+// an empty value.
+func (s *Suite) inherit(test *Test, node map[string]json.RawMessage) {
+	test.Tags = append(test.Tags, s.inheritedTags()...)
+
+	var suites []*Suite
+	for suite := s; suite != nil; suite = suite.Parent {
+		suites = append([]*Suite{suite}, suites...)
+	}
+	var envs []map[string]string
+	var exitCodes []ExitCodes
+	var requiresKconfig []kconfig.Requirement
+	var requires *sysinfo.Requirements
+	for _, suite := range suites {
+		test.ConditionalTags = append(test.ConditionalTags, suite.ConditionalTags...)
+		envs = append(envs, suite.Env)
+		exitCodes = append(exitCodes, suite.ExitCodes)
+		requiresKconfig = append(requiresKconfig, suite.RequiresKconfig...)
+		requires = sysinfo.Merge(requires, suite.Requires)
+	}
+	test.RequiresKconfig = append(requiresKconfig, test.RequiresKconfig...)
+	test.Requires = sysinfo.Merge(requires, test.Requires)
+	test.Env = mergeMaps(append(envs, test.Env)...)
+	test.ExitCodes = mergeMaps(append(exitCodes, test.ExitCodes)...)
+
+	inheritField := func(key string, copy func(from *Suite)) {
+		if _, ok := node[key]; ok {
+			return
+		}
+		if from := s.nearest(key); from != nil {
+			copy(from)
+		}
+	}
+	inheritField("timeout", func(from *Suite) { test.Timeout = from.Timeout })
+	inheritField("retries", func(from *Suite) { test.Retries = from.Retries })
+	inheritField("cwd", func(from *Suite) { test.Cwd = from.Cwd })
+	inheritField("command_prefix", func(from *Suite) { test.CommandPrefix = from.CommandPrefix })
+}
+
+// Path returns the names of the test and the suites above it, starting at the
+// top.
+func (t *Test) Path() []string {
+	return append(t.Parent.Path(), t.Name)
+}
+
+// ID returns the ID that identifies the test on the command line and in
+// results.
+func (t *Test) ID() string {
+	return JoinID(t.Path()...)
+}
+
+// EscapeName escapes a test or suite name for use in an ID, where dots
+// separate the names. Dots in the name become "\." and backslashes become
+// "\\".
+func EscapeName(name string) string {
+	if !strings.ContainsAny(name, `.\`) {
+		return name
+	}
+	var b strings.Builder
+	for _, c := range name {
+		if c == '.' || c == '\\' {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+// JoinID builds an ID from the names of a test and the suites above it.
+func JoinID(names ...string) string {
+	escaped := make([]string, len(names))
+	for i, name := range names {
+		escaped[i] = EscapeName(name)
+	}
+	return strings.Join(escaped, ".")
+}
+
+// SplitID splits an ID into the names of the test and the suites above it.
+// It's the opposite of JoinID. A backslash at the very end is taken literally.
+func SplitID(id string) []string {
+	var names []string
+	var b strings.Builder
+	for i := 0; i < len(id); i++ {
+		switch c := id[i]; {
+		case c == '\\' && i+1 < len(id):
+			i++
+			b.WriteByte(id[i])
+		case c == '.':
+			names = append(names, b.String())
+			b.Reset()
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return append(names, b.String())
+}